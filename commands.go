@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	mandibleConf "github.com/Imgur/mandible/config"
+	_ "github.com/Imgur/mandible/imagestore" // registers the store types
+)
+
+const usage = `Usage:
+  mandible                start the server
+  mandible config print   print the effective configuration with secrets redacted`
+
+// Runs a command line subcommand, returning the process exit code.
+func runCommand(args []string, configFile string) int {
+	switch strings.Join(args, " ") {
+	case "config print":
+		config, err := mandibleConf.NewConfiguration(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		if err := config.WriteRedacted(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
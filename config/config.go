@@ -1,36 +1,399 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 )
 
 type Configuration struct {
-	MaxFileSize     int64
-	HashLength      int
-	UserAgent       string
-	Stores          []map[string]string
-	Port            int
-	DatadogEnabled  bool
-	DatadogHostname string
+	MaxFileSize           int64
+	HashLength            int
+	UserAgent             string
+	Stores                StoreList
+	Port                  int
+	DatadogEnabled        bool
+	DatadogHostname       string
+	PrometheusEnabled     bool
+	Stats                 StatsList
+	Tracing               TracingConfig
+	AuthenticationHMACKey string `secret:"true"`
+	AdminKey              string `secret:"true"`
+
+	// debug, info, warn or error. Defaults to info.
+	LogLevel string
+	// json or text. Defaults to json.
+	LogFormat string
+	// Log a line for every request
+	AccessLog bool
+
+	// Named processing pipelines. The one named default is used for uploads that don't select one, without it
+	// uploads get the built in steps.
+	Pipelines PipelineMap
+	// The pipeline used by each upload route, i.e. "/user/{user_id}/file": "full"
+	RoutePipelines map[string]string
+
+	// Named thumbnail specs that uploads and /thumbnail can ask for with the presets parameter
+	ThumbPresets ThumbPresetMap
+	// Presets created for every upload
+	DefaultThumbPresets []string
+	// Reject thumbnail specs sent in the thumbs parameter, only allowing presets
+	StrictThumbPresets bool
+
+	// Named constraints on uploads, and the ones uploads to each route, i.e. "/user/{user_id}/file": "avatar", and by
+	// each authenticated user ID have to meet
+	UploadPolicies UploadPolicyMap
+	RoutePolicies  map[string]string
+	UserPolicies   map[string]string
+
+	// Respond once the original is stored and create thumbnails in the background
+	BackgroundThumbs bool
+	// How many uploads' thumbnails are created at once in the background. Defaults to 4.
+	ThumbWorkers int
+	// How many uploads' thumbnails may wait to be created before uploads create them up front again. Defaults to 256.
+	ThumbQueueSize int
+
+	// What HEIC, HEIF, AVIF, BMP, TIFF and ICO uploads are converted to, jpeg or png. Defaults to jpeg.
+	CanonicalFormat string
+	// Store HEIC, HEIF and AVIF uploads as they were received beside the converted original
+	KeepOriginalContainer bool
+	// Store the pages after the first of multi-page TIFFs beside the original, which is the first page
+	KeepTiffPages bool
+
+	// The upload routes that accept PDFs, i.e. "/user/{user_id}/file". Other routes reject them.
+	PdfRoutes []string
+	// The dots per inch PDF pages are rasterized at, for thumbnails and page sizes. Defaults to 150.
+	PdfDPI int
+	// PDFs with more pages than this are rejected. Defaults to 100.
+	MaxPdfPages int
+
+	// Video uploads longer or larger than these are rejected before anything else is done with them. The defaults are
+	// 60 seconds and MaxFileSize.
+	MaxVideoSeconds int
+	MaxVideoBytes   int64
+	// Where in a video upload its thumbnails' poster frame is taken from, in seconds. Videos shorter than that use
+	// their middle frame. Defaults to the first frame.
+	PosterFrameSeconds float64
+
+	// JPEG, PNG, GIF and WebP uploads declaring more pixels, or more frames, than these are rejected before they're
+	// decoded. Defaults to 100 million pixels and 1000 frames.
+	MaxPixels int64
+	MaxFrames int
+
+	// Scratch space for uploads being processed, a directory is created inside it. Defaults to the system temp dir.
+	ScratchDir string
+	// Readiness fails when ScratchDir has less free space than this. Defaults to 100.
+	MinFreeScratchMB int
+	// How long /readyz serves the result of its last checks before running them again. Defaults to 10.
+	ReadinessCacheSeconds int
+
+	// HTTP server timeouts and how long to wait for in-flight requests and background jobs on shutdown. Zero means
+	// the default.
+	ReadTimeoutSeconds     int
+	WriteTimeoutSeconds    int
+	IdleTimeoutSeconds     int
+	ShutdownTimeoutSeconds int
+
+	// How long to fail the readiness check before closing the listener on shutdown, so load balancers stop sending
+	// new requests first.
+	DrainDelaySeconds int
+
+	// Deprecated settings the config was loaded with, i.e. legacy environment variables
+	deprecated []string
+}
+
+const (
+	defaultReadTimeout     = 60 * time.Second
+	defaultWriteTimeout    = 300 * time.Second
+	defaultIdleTimeout     = 120 * time.Second
+	defaultShutdownTimeout = 30 * time.Second
+	defaultReadinessCache  = 10 * time.Second
+
+	defaultMinFreeScratchMB = 100
+	defaultThumbWorkers     = 4
+	defaultThumbQueueSize   = 256
+	defaultPdfDPI           = 150
+	maxPdfDPI               = 600
+	defaultMaxPdfPages      = 100
+	defaultMaxVideoSeconds  = 60
+	defaultMaxPixels        = 100000000
+	defaultMaxFrames        = 1000
+)
+
+// NewConfiguration loads the JSON configuration file at path, applies MANDIBLE_ environment variable overrides and
+// validates the result.
+func NewConfiguration(path string) (*Configuration, error) {
+	return LoadConfiguration(path, os.Environ())
 }
 
-func NewConfiguration(path string) *Configuration {
-	file, err := os.Open(path)
+// Deprecations are warnings about deprecated settings the config was loaded with, to log once logging is set up.
+func (c *Configuration) Deprecations() []string {
+	return c.deprecated
+}
 
+// LoadConfiguration is NewConfiguration with the environment given as a list of key=value pairs.
+func LoadConfiguration(path string, environ []string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Printf("Error opening config file!")
-		os.Exit(-1)
+		return nil, fmt.Errorf("Error opening config file: %s", err.Error())
 	}
 
-	decoder := json.NewDecoder(file)
 	configuration := &Configuration{}
-	err = decoder.Decode(configuration)
+	err = decodeStrict(data, configuration, "")
+	if err != nil {
+		return nil, fmt.Errorf("Error loading config file %s: %s", path, err.Error())
+	}
+
+	err = applyEnvironment(configuration, environ)
+	if err != nil {
+		return nil, fmt.Errorf("Error applying environment to config: %s", err.Error())
+	}
 
+	err = configuration.Validate()
 	if err != nil {
-		fmt.Println("Error loading config file: ", err)
+		return nil, fmt.Errorf("Invalid config file %s: %s", path, err.Error())
+	}
+
+	return configuration, nil
+}
+
+// Validate checks that required fields are set. Errors are *FieldError values naming the offending field.
+func (c *Configuration) Validate() error {
+	if c.MaxFileSize <= 0 {
+		return &FieldError{"MaxFileSize", "must be greater than 0"}
+	}
+
+	if c.HashLength <= 0 {
+		return &FieldError{"HashLength", "must be greater than 0"}
+	}
+
+	if c.Port <= 0 || c.Port > 65535 {
+		return &FieldError{"Port", "must be between 1 and 65535"}
+	}
+
+	if c.DatadogEnabled && c.DatadogHostname == "" {
+		return &FieldError{"DatadogHostname", "is required when DatadogEnabled is set"}
+	}
+
+	prometheus := 0
+	for i, backend := range c.Stats {
+		if err := backend.Validate(); err != nil {
+			return prefixFieldError(fmt.Sprintf("Stats[%d]", i), err)
+		}
+
+		if backend.Type == StatsPrometheus {
+			prometheus++
+		}
+	}
+
+	if c.PrometheusEnabled {
+		prometheus++
+	}
+
+	if prometheus > 1 {
+		return &FieldError{"Stats", "only one prometheus backend may be configured"}
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return &FieldError{"LogLevel", "must be one of debug, info, warn or error"}
+	}
+
+	switch c.LogFormat {
+	case "", "json", "text":
+	default:
+		return &FieldError{"LogFormat", "must be json or text"}
+	}
+
+	switch c.CanonicalFormat {
+	case "", "jpeg", "png":
+	default:
+		return &FieldError{"CanonicalFormat", "must be jpeg or png"}
+	}
+
+	if err := c.validatePipelines(); err != nil {
+		return err
+	}
+
+	if err := c.validateThumbPresets(); err != nil {
+		return err
+	}
+
+	if err := c.validateUploadPolicies(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return prefixFieldError("Tracing", err)
+	}
+
+	timeouts := map[string]int{
+		"ReadTimeoutSeconds":     c.ReadTimeoutSeconds,
+		"WriteTimeoutSeconds":    c.WriteTimeoutSeconds,
+		"IdleTimeoutSeconds":     c.IdleTimeoutSeconds,
+		"ShutdownTimeoutSeconds": c.ShutdownTimeoutSeconds,
+		"DrainDelaySeconds":      c.DrainDelaySeconds,
+	}
+	for field, seconds := range timeouts {
+		if seconds < 0 {
+			return &FieldError{field, "can't be negative"}
+		}
+	}
+
+	counts := map[string]int{
+		"MinFreeScratchMB":      c.MinFreeScratchMB,
+		"ReadinessCacheSeconds": c.ReadinessCacheSeconds,
+		"ThumbWorkers":          c.ThumbWorkers,
+		"ThumbQueueSize":        c.ThumbQueueSize,
+		"PdfDPI":                c.PdfDPI,
+		"MaxPdfPages":           c.MaxPdfPages,
+		"MaxVideoSeconds":       c.MaxVideoSeconds,
+		"MaxFrames":             c.MaxFrames,
+	}
+	for field, count := range counts {
+		if count < 0 {
+			return &FieldError{field, "can't be negative"}
+		}
+	}
+
+	if c.PdfDPI > maxPdfDPI {
+		return &FieldError{"PdfDPI", fmt.Sprintf("can't be more than %d", maxPdfDPI)}
+	}
+
+	if c.MaxVideoBytes < 0 {
+		return &FieldError{"MaxVideoBytes", "can't be negative"}
+	}
+
+	if c.MaxPixels < 0 {
+		return &FieldError{"MaxPixels", "can't be negative"}
+	}
+
+	if c.PosterFrameSeconds < 0 {
+		return &FieldError{"PosterFrameSeconds", "can't be negative"}
+	}
+
+	if len(c.Stores) == 0 {
+		return &FieldError{"Stores", "at least one store is required"}
+	}
+
+	for i, store := range c.Stores {
+		if err := store.Validate(); err != nil {
+			return prefixFieldError(fmt.Sprintf("Stores[%d]", i), err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Configuration) ReadTimeout() time.Duration {
+	return secondsOrDefault(c.ReadTimeoutSeconds, defaultReadTimeout)
+}
+
+func (c *Configuration) WriteTimeout() time.Duration {
+	return secondsOrDefault(c.WriteTimeoutSeconds, defaultWriteTimeout)
+}
+
+func (c *Configuration) IdleTimeout() time.Duration {
+	return secondsOrDefault(c.IdleTimeoutSeconds, defaultIdleTimeout)
+}
+
+func (c *Configuration) ShutdownTimeout() time.Duration {
+	return secondsOrDefault(c.ShutdownTimeoutSeconds, defaultShutdownTimeout)
+}
+
+func (c *Configuration) ReadinessCache() time.Duration {
+	return secondsOrDefault(c.ReadinessCacheSeconds, defaultReadinessCache)
+}
+
+func (c *Configuration) DrainDelay() time.Duration {
+	return time.Duration(c.DrainDelaySeconds) * time.Second
+}
+
+// MinFreeScratch is MinFreeScratchMB in bytes.
+func (c *Configuration) MinFreeScratch() uint64 {
+	mb := c.MinFreeScratchMB
+	if mb == 0 {
+		mb = defaultMinFreeScratchMB
+	}
+
+	return uint64(mb) * 1024 * 1024
+}
+
+func (c *Configuration) ThumbWorkerCount() int {
+	return intOrDefault(c.ThumbWorkers, defaultThumbWorkers)
+}
+
+func (c *Configuration) ThumbQueueLength() int {
+	return intOrDefault(c.ThumbQueueSize, defaultThumbQueueSize)
+}
+
+func (c *Configuration) PdfDensity() int {
+	return intOrDefault(c.PdfDPI, defaultPdfDPI)
+}
+
+func (c *Configuration) PdfPageLimit() int {
+	return intOrDefault(c.MaxPdfPages, defaultMaxPdfPages)
+}
+
+// AcceptsPdf is whether PDFs can be uploaded to route, which is the route template.
+func (c *Configuration) AcceptsPdf(route string) bool {
+	for _, r := range c.PdfRoutes {
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Configuration) MaxVideoDuration() time.Duration {
+	return time.Duration(intOrDefault(c.MaxVideoSeconds, defaultMaxVideoSeconds)) * time.Second
+}
+
+func (c *Configuration) MaxVideoSize() int64 {
+	if c.MaxVideoBytes == 0 {
+		return c.MaxFileSize
+	}
+
+	return c.MaxVideoBytes
+}
+
+// PosterFrame is where the poster frame of a video lasting duration seconds is taken from.
+func (c *Configuration) PosterFrame(duration float64) float64 {
+	if c.PosterFrameSeconds >= duration {
+		return duration / 2
+	}
+
+	return c.PosterFrameSeconds
+}
+
+func (c *Configuration) MaxImagePixels() int64 {
+	if c.MaxPixels == 0 {
+		return defaultMaxPixels
+	}
+
+	return c.MaxPixels
+}
+
+func (c *Configuration) MaxImageFrames() int {
+	return intOrDefault(c.MaxFrames, defaultMaxFrames)
+}
+
+func intOrDefault(n, def int) int {
+	if n == 0 {
+		return def
+	}
+
+	return n
+}
+
+func secondsOrDefault(seconds int, def time.Duration) time.Duration {
+	if seconds == 0 {
+		return def
 	}
 
-	return configuration
+	return time.Duration(seconds) * time.Second
 }
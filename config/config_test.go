@@ -0,0 +1,203 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testStoreConfig struct {
+	BucketName string
+	Versioned  bool
+}
+
+func (this *testStoreConfig) StoreType() string {
+	return "test"
+}
+
+func (this *testStoreConfig) Validate() error {
+	return RequireString("BucketName", this.BucketName)
+}
+
+// Stands in for imagestore's s3 config, which the legacy S3 variables set
+type testS3StoreConfig struct {
+	BucketName string
+	AWSKey     string
+}
+
+func (this *testS3StoreConfig) StoreType() string {
+	return "s3"
+}
+
+func (this *testS3StoreConfig) Validate() error {
+	return RequireString("BucketName", this.BucketName)
+}
+
+func init() {
+	RegisterStoreType("test", func() StoreConfig { return &testStoreConfig{} })
+	RegisterStoreType("s3", func() StoreConfig { return &testS3StoreConfig{} })
+}
+
+func loadTestConfig(t *testing.T, contents string) (*Configuration, error) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(contents)
+	file.Close()
+
+	return NewConfiguration(file.Name())
+}
+
+func TestLoadingTypedStores(t *testing.T) {
+	cfg, err := loadTestConfig(t, `{
+		"Port": 8080,
+		"MaxFileSize": 100,
+		"HashLength": 7,
+		"Stores": [{"Type": "test", "BucketName": "images", "Versioned": true}]
+	}`)
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err.Error())
+	}
+
+	store, ok := cfg.Stores[0].(*testStoreConfig)
+	if !ok {
+		t.Fatalf("Expected a *testStoreConfig, instead %T", cfg.Stores[0])
+	}
+
+	if store.BucketName != "images" || !store.Versioned {
+		t.Fatalf("Store config wasn't decoded: %+v", store)
+	}
+}
+
+func TestConfigErrorsNameTheField(t *testing.T) {
+	cases := []struct {
+		stores   string
+		expected string
+	}{
+		{`[{"Type": "test", "BucketName": "a"}, {"Type": "test", "BucketName": "b", "Region": "x"}]`, "Stores[1].Region: unknown field"},
+		{`[{"Type": "test", "BucketName": "a"}, {"Type": "test"}]`, "Stores[1].BucketName: is required"},
+		{`[{"Type": "test", "BucketName": "a", "Versioned": "yes"}]`, "Stores[0].Versioned: expected a value of type bool"},
+		{`[{"Type": "nope"}]`, "Stores[0].Type: unsupported store"},
+		{`[{"BucketName": "a"}]`, "Stores[0].Type: is required"},
+		{`[]`, "Stores: at least one store is required"},
+		{`[], "HashLenght": 7`, "HashLenght: unknown field"},
+		{`[`, "invalid character"},
+		{`[{"Type": "test", "BucketName": "a"}], "Stats": [{"Type": "statsd"}]`, "Stats[0].Address: is required"},
+		{`[{"Type": "test", "BucketName": "a"}], "Stats": [{"Type": "prometheus", "Adress": "x"}]`, "Stats[0].Adress: unknown field"},
+		{`[{"Type": "test", "BucketName": "a"}], "Pipelines": {"fast": [{"Async": [{"Step": "ocr", "Whne": {}}]}]}`, "Pipelines.fast[0].Async[0].Whne: unknown field"},
+		{`[{"Type": "test", "BucketName": "a"}], "Pipelines": {"fast": [{"Step": "scale", "When": {"MinBytes": 9, "MaxBytes": 1}}]}`, "Pipelines.fast[0].When.MinBytes: can't be greater than MaxBytes"},
+		{`[{"Type": "test", "BucketName": "a"}], "RoutePipelines": {"/file": "fast"}`, "RoutePipelines./file: no pipeline named \"fast\""},
+		{`[{"Type": "test", "BucketName": "a"}], "ThumbPresets": {"avatar": {"Shape": "circle"}}`, "ThumbPresets.avatar.Width: is required for circle thumbnails"},
+		{`[{"Type": "test", "BucketName": "a"}], "CanonicalFormat": "heic"`, "CanonicalFormat: must be jpeg or png"},
+		{`[{"Type": "test", "BucketName": "a"}], "PdfDPI": 1200`, "PdfDPI: can't be more than 600"},
+		{`[{"Type": "test", "BucketName": "a"}], "PosterFrameSeconds": -1`, "PosterFrameSeconds: can't be negative"},
+		{`[{"Type": "test", "BucketName": "a"}], "UploadPolicies": {"banner": {"AspectRatios": ["4:1-2:1"]}}`, "UploadPolicies.banner.AspectRatios[0]: 4:1 is wider than 2:1"},
+		{`[{"Type": "test", "BucketName": "a"}], "UserPolicies": {"42": "banner"}`, "UserPolicies.42: no policy named \"banner\""},
+	}
+
+	for _, c := range cases {
+		_, err := loadTestConfig(t, `{"Port": 8080, "MaxFileSize": 100, "HashLength": 7, "Stores": `+c.stores+`}`)
+		if err == nil {
+			t.Fatalf("Expected an error loading stores %s", c.stores)
+		}
+
+		if !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected error containing %q, instead %q", c.expected, err.Error())
+		}
+	}
+}
+
+func TestEnvironmentOverridesConfigFile(t *testing.T) {
+	secretFile, err := ioutil.TempFile(os.TempDir(), "secret")
+	if err != nil {
+		t.Fatalf("Unable to create secret file: %s", err.Error())
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString("hunter2\n")
+	secretFile.Close()
+
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"Port": 8080, "MaxFileSize": 100, "HashLength": 7, "Stores": [{"Type": "test", "BucketName": "a"}]}`)
+	file.Close()
+
+	cfg, err := LoadConfiguration(file.Name(), []string{
+		"MANDIBLE_PORT=9090",
+		"MANDIBLE_DATADOG_ENABLED=true",
+		"MANDIBLE_DATADOG_HOSTNAME=statsd",
+		"MANDIBLE_AUTHENTICATION_HMAC_KEY_FILE=" + secretFile.Name(),
+		"MANDIBLE_STORES_0_VERSIONED=true",
+		"MANDIBLE_STORES_1_TYPE=test",
+		"MANDIBLE_STORES_1_BUCKET_NAME=b",
+		"MANDIBLE_STATS_0_TYPE=prometheus",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err.Error())
+	}
+
+	if cfg.Port != 9090 || !cfg.DatadogEnabled || cfg.DatadogHostname != "statsd" {
+		t.Fatalf("Top level fields weren't overridden: %+v", cfg)
+	}
+
+	if cfg.AuthenticationHMACKey != "hunter2" {
+		t.Fatalf("Expected the HMAC key to be read from the secret file, instead %q", cfg.AuthenticationHMACKey)
+	}
+
+	if len(cfg.Stores) != 2 {
+		t.Fatalf("Expected a second store to be added, instead %d stores", len(cfg.Stores))
+	}
+
+	if !cfg.Stores[0].(*testStoreConfig).Versioned || cfg.Stores[1].(*testStoreConfig).BucketName != "b" {
+		t.Fatalf("Store fields weren't overridden: %+v %+v", cfg.Stores[0], cfg.Stores[1])
+	}
+
+	if len(cfg.Stats) != 1 || cfg.Stats[0].Type != StatsPrometheus || len(cfg.StatsBackends()) != 2 {
+		t.Fatalf("Expected a prometheus stats backend to be added alongside datadog, instead %+v", cfg.StatsBackends())
+	}
+
+	var printed bytes.Buffer
+	cfg.WriteRedacted(&printed)
+	if strings.Contains(printed.String(), "hunter2") {
+		t.Fatalf("Secret wasn't redacted: %s", printed.String())
+	}
+}
+
+func TestLegacyEnvironmentVariablesFillInUnsetFields(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	if err != nil {
+		t.Fatalf("Unable to create config file: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"Port": 8080, "MaxFileSize": 100, "HashLength": 7, "Stores": [{"Type": "s3", "AWSKey": "file"}]}`)
+	file.Close()
+
+	cfg, err := LoadConfiguration(file.Name(), []string{
+		"S3_BUCKET=images",
+		"AWS_ACCESS_KEY_ID=legacy",
+		"AUTHENTICATION_HMAC_KEY=hunter2",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err.Error())
+	}
+
+	store := cfg.Stores[0].(*testS3StoreConfig)
+	if store.BucketName != "images" || cfg.AuthenticationHMACKey != "hunter2" {
+		t.Fatalf("Legacy variables weren't applied: %+v %q", store, cfg.AuthenticationHMACKey)
+	}
+
+	if store.AWSKey != "file" {
+		t.Fatalf("Expected the config file to win over a legacy variable, instead %q", store.AWSKey)
+	}
+
+	if len(cfg.Deprecations()) != 2 {
+		t.Fatalf("Expected a deprecation warning for each legacy variable used, instead %v", cfg.Deprecations())
+	}
+}
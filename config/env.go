@@ -0,0 +1,327 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of environment variables that override config file fields.
+const EnvPrefix = "MANDIBLE_"
+
+// Variables deploys set before the MANDIBLE_ overrides existed. They still fill in the field they used to set when
+// neither the config file nor the MANDIBLE_ variable replacing them sets it. The S3 ones set the first store if it's
+// an s3 store.
+var legacyEnv = []struct {
+	name        string
+	store       bool
+	field       string
+	replacement string
+}{
+	{"AUTHENTICATION_HMAC_KEY", false, "AuthenticationHMACKey", EnvPrefix + "AUTHENTICATION_HMAC_KEY"},
+	{"S3_BUCKET", true, "BucketName", EnvPrefix + "STORES_0_BUCKET_NAME"},
+	{"AWS_ACCESS_KEY_ID", true, "AWSKey", EnvPrefix + "STORES_0_AWS_KEY"},
+	{"AWS_SECRET_ACCESS_KEY", true, "AWSSecret", EnvPrefix + "STORES_0_AWS_SECRET"},
+}
+
+var storeEnvRegex = regexp.MustCompile("^" + EnvPrefix + `STORES_(\d+)_`)
+
+// Applies MANDIBLE_ environment variables on top of the config file. Every field is named after its path with
+// CamelCase converted to upper snake case, i.e. MaxFileSize is MANDIBLE_MAX_FILE_SIZE and the BucketName of the
+// first store is MANDIBLE_STORES_0_BUCKET_NAME. Setting MANDIBLE_STORES_<n>_TYPE replaces store n with an empty
+// store of that type, or adds it if n is the number of stores. Every variable has a _FILE variant holding the path of
+// a file to read the value from, for secrets mounted into containers.
+func applyEnvironment(c *Configuration, environ []string) error {
+	overlay := &envOverlay{make(map[string]string)}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			overlay.env[parts[0]] = parts[1]
+		}
+	}
+
+	if err := overlay.applyStruct(reflect.ValueOf(c).Elem(), EnvPrefix); err != nil {
+		return err
+	}
+
+	applyLegacyEnvironment(c, overlay.env)
+
+	return nil
+}
+
+func applyLegacyEnvironment(c *Configuration, env map[string]string) {
+	for _, legacy := range legacyEnv {
+		value, ok := env[legacy.name]
+		if !ok {
+			continue
+		}
+
+		target := reflect.ValueOf(c).Elem()
+		if legacy.store {
+			if len(c.Stores) == 0 || c.Stores[0].StoreType() != "s3" {
+				continue
+			}
+			target = reflect.ValueOf(c.Stores[0]).Elem()
+		}
+
+		field := target.FieldByName(legacy.field)
+		if !field.IsValid() || field.Kind() != reflect.String || field.String() != "" {
+			continue
+		}
+
+		field.SetString(value)
+		c.deprecated = append(c.deprecated, fmt.Sprintf("%s is deprecated, use %s", legacy.name, legacy.replacement))
+	}
+}
+
+type envOverlay struct {
+	env map[string]string
+}
+
+// Returns the value of the variable name or the contents of the file named by name_FILE.
+func (this *envOverlay) lookup(name string) (string, bool, error) {
+	value, ok := this.env[name]
+	path, fileOk := this.env[name+"_FILE"]
+
+	if ok && fileOk {
+		return "", false, &FieldError{name, fmt.Sprintf("only one of %s and %s_FILE may be set", name, name)}
+	}
+
+	if fileOk {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, &FieldError{name + "_FILE", err.Error()}
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+
+	return value, ok, nil
+}
+
+func (this *envOverlay) applyStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := this.applyStruct(value, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := prefix + envName(field.Name)
+
+		if stores, ok := value.Addr().Interface().(*StoreList); ok {
+			if err := this.applyStores(stores, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct {
+			if err := this.applyStructSlice(value, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := this.applyStruct(value, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		str, ok, err := this.lookup(name)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := setFromString(value, str); err != nil {
+			return &FieldError{name, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func (this *envOverlay) applyStores(stores *StoreList, prefix string) error {
+	for i := 0; ; i++ {
+		storePrefix := fmt.Sprintf("%s%d_", prefix, i)
+
+		storeType, hasType, err := this.lookup(storePrefix + "TYPE")
+		if err != nil {
+			return err
+		}
+
+		if hasType {
+			store, ok := newStoreConfig(storeType)
+			if !ok {
+				return &FieldError{storePrefix + "TYPE", fmt.Sprintf("unsupported store %q, expected one of %v", storeType, StoreTypes())}
+			}
+
+			if i == len(*stores) {
+				*stores = append(*stores, store)
+			} else if i < len(*stores) && (*stores)[i].StoreType() != storeType {
+				(*stores)[i] = store
+			}
+		}
+
+		if i >= len(*stores) {
+			break
+		}
+
+		if err := this.applyStruct(reflect.ValueOf((*stores)[i]).Elem(), storePrefix); err != nil {
+			return err
+		}
+	}
+
+	// Catch overrides of stores that don't exist rather than silently ignoring them
+	names := make([]string, 0)
+	for name := range this.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		matches := storeEnvRegex.FindStringSubmatch(name)
+		if matches == nil {
+			continue
+		}
+
+		if index, _ := strconv.Atoi(matches[1]); index >= len(*stores) {
+			return &FieldError{name, fmt.Sprintf("there is no store %d, set %s%d_TYPE to add one", index, prefix, index)}
+		}
+	}
+
+	return nil
+}
+
+// Applies overrides to each element of a slice of structs, i.e. MANDIBLE_STATS_0_ADDRESS. Setting any field of
+// element n, where n is the length of the slice, appends a new element.
+func (this *envOverlay) applyStructSlice(v reflect.Value, prefix string) error {
+	for i := 0; ; i++ {
+		elemPrefix := fmt.Sprintf("%s%d_", prefix, i)
+
+		if i == v.Len() && this.hasPrefix(elemPrefix) {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+
+		if i >= v.Len() {
+			break
+		}
+
+		if err := this.applyStruct(v.Index(i), elemPrefix); err != nil {
+			return err
+		}
+	}
+
+	indexRegex := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `(\d+)_`)
+	for name := range this.env {
+		matches := indexRegex.FindStringSubmatch(name)
+		if matches == nil {
+			continue
+		}
+
+		if index, _ := strconv.Atoi(matches[1]); index >= v.Len() {
+			return &FieldError{name, fmt.Sprintf("there is no entry %d, only %d can be added", index, v.Len())}
+		}
+	}
+
+	return nil
+}
+
+func (this *envOverlay) hasPrefix(prefix string) bool {
+	for name := range this.env {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setFromString(value reflect.Value, str string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", str)
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(str, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", str)
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(str, 10, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a positive integer, got %q", str)
+		}
+		value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, value.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", str)
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't be set from the environment")
+		}
+
+		parts := make([]string, 0)
+		for _, part := range strings.Split(str, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		value.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+
+	return nil
+}
+
+// Converts a CamelCase field name to UPPER_SNAKE_CASE, keeping acronyms together: AWSKey is AWS_KEY.
+func envName(field string) string {
+	runes := []rune(field)
+	name := make([]rune, 0, len(runes)+4)
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				name = append(name, '_')
+			}
+		}
+
+		name = append(name, unicode.ToUpper(r))
+	}
+
+	return string(name)
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// FieldError describes an invalid config field, i.e. "Stores[1].BucketName: is required".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (this *FieldError) Error() string {
+	return this.Field + ": " + this.Message
+}
+
+// RequireString returns a *FieldError if a required string field is empty.
+func RequireString(field, value string) error {
+	if value == "" {
+		return &FieldError{field, "is required"}
+	}
+
+	return nil
+}
+
+func prefixFieldError(prefix string, err error) error {
+	if fieldErr, ok := err.(*FieldError); ok {
+		return &FieldError{prefix + "." + fieldErr.Field, fieldErr.Message}
+	}
+
+	return &FieldError{prefix, err.Error()}
+}
+
+// Decodes a JSON object into v, failing on keys that don't match a field of v (besides the allowed ones) so typos
+// aren't silently ignored. Field names in errors are prefixed with prefix.
+func decodeStrict(data []byte, v interface{}, prefix string, allowed ...string) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			return syntaxErr
+		}
+
+		return &FieldError{strings.TrimSuffix(prefix, "."), "must be an object"}
+	}
+
+	fields := jsonFieldNames(reflect.TypeOf(v).Elem())
+	for _, name := range allowed {
+		fields[strings.ToLower(name)] = true
+	}
+
+	for key := range keys {
+		// encoding/json matches keys to fields case insensitively
+		if !fields[strings.ToLower(key)] {
+			return &FieldError{prefix + key, "unknown field"}
+		}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return &FieldError{prefix + typeErr.Field, "expected a value of type " + typeErr.Type.String()}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Returns the lowercased JSON keys of a struct type, including the fields of embedded structs.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name := range jsonFieldNames(field.Type) {
+				names[name] = true
+			}
+			continue
+		}
+
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		names[strings.ToLower(name)] = true
+	}
+
+	return names
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// PipelineStep is a single step of a pipeline: either a registered step with its params, or a group of steps run one
+// after the other (Steps) or concurrently (Async).
+type PipelineStep struct {
+	// A registered step, i.e. orient, compress, strip_exif, scale, ocr or thumbnails
+	Step   string
+	Params map[string]interface{}
+
+	Steps []PipelineStep
+	Async []PipelineStep
+
+	// The step is skipped for uploads that don't match
+	When *StepCondition
+}
+
+// StepCondition matches uploads on their MIME type, size in bytes and dimensions as received, or on the MIME type
+// they're converted to after a normalize step. Dimensions that can't be read don't match. Zero values aren't checked.
+type StepCondition struct {
+	Mime      []string
+	MinBytes  int64
+	MaxBytes  int64
+	MinWidth  int
+	MaxWidth  int
+	MinHeight int
+	MaxHeight int
+}
+
+// PipelineMap holds the Pipelines of the config file by name.
+type PipelineMap map[string][]PipelineStep
+
+func (this *PipelineMap) UnmarshalJSON(data []byte) error {
+	var pipelines map[string]json.RawMessage
+	if err := json.Unmarshal(data, &pipelines); err != nil {
+		return &FieldError{"Pipelines", "must be an object of pipelines by name"}
+	}
+
+	decoded := make(PipelineMap, len(pipelines))
+	for name, steps := range pipelines {
+		var err error
+		decoded[name], err = decodeSteps(steps, "Pipelines."+name)
+		if err != nil {
+			return err
+		}
+	}
+
+	*this = decoded
+
+	return nil
+}
+
+// Decodes an array of steps strictly, recursing into groups since they can't have an UnmarshalJSON that knows their
+// path.
+func decodeSteps(data []byte, path string) ([]PipelineStep, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, &FieldError{path, "must be an array of steps"}
+	}
+
+	steps := make([]PipelineStep, len(entries))
+	for i, entry := range entries {
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+
+		var step struct {
+			Step   string
+			Params map[string]interface{}
+			Steps  json.RawMessage
+			Async  json.RawMessage
+			When   json.RawMessage
+		}
+		if err := decodeStrict(entry, &step, stepPath+"."); err != nil {
+			return nil, err
+		}
+
+		steps[i].Step = step.Step
+		steps[i].Params = step.Params
+
+		var err error
+		if len(step.Steps) > 0 {
+			if steps[i].Steps, err = decodeSteps(step.Steps, stepPath+".Steps"); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(step.Async) > 0 {
+			if steps[i].Async, err = decodeSteps(step.Async, stepPath+".Async"); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(step.When) > 0 {
+			steps[i].When = &StepCondition{}
+			if err := decodeStrict(step.When, steps[i].When, stepPath+".When."); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return steps, nil
+}
+
+// Validates each step, naming invalid fields by their path from the pipeline, i.e. Pipelines.default[2].Async[0].Step.
+func validateSteps(steps []PipelineStep, path string) error {
+	for i, step := range steps {
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+
+		kinds := 0
+		for _, set := range []bool{step.Step != "", step.Steps != nil, step.Async != nil} {
+			if set {
+				kinds++
+			}
+		}
+
+		if kinds != 1 {
+			return &FieldError{stepPath, "exactly one of Step, Steps or Async is required"}
+		}
+
+		if step.Step == "" && step.Params != nil {
+			return &FieldError{stepPath + ".Params", "only applies to a Step"}
+		}
+
+		if err := validateSteps(step.Steps, stepPath+".Steps"); err != nil {
+			return err
+		}
+
+		if err := validateSteps(step.Async, stepPath+".Async"); err != nil {
+			return err
+		}
+
+		if step.When != nil {
+			if err := step.When.Validate(); err != nil {
+				return prefixFieldError(stepPath+".When", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (this *StepCondition) Validate() error {
+	ranges := []struct {
+		field    string
+		min, max int64
+	}{
+		{"Bytes", this.MinBytes, this.MaxBytes},
+		{"Width", int64(this.MinWidth), int64(this.MaxWidth)},
+		{"Height", int64(this.MinHeight), int64(this.MaxHeight)},
+	}
+
+	for _, r := range ranges {
+		if r.min < 0 {
+			return &FieldError{"Min" + r.field, "can't be negative"}
+		}
+
+		if r.max < 0 {
+			return &FieldError{"Max" + r.field, "can't be negative"}
+		}
+
+		if r.max > 0 && r.min > r.max {
+			return &FieldError{"Min" + r.field, "can't be greater than Max" + r.field}
+		}
+	}
+
+	return nil
+}
+
+func (c *Configuration) validatePipelines() error {
+	names := make([]string, 0, len(c.Pipelines))
+	for name := range c.Pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(c.Pipelines[name]) == 0 {
+			return &FieldError{"Pipelines." + name, "must have at least one step"}
+		}
+
+		if err := validateSteps(c.Pipelines[name], "Pipelines."+name); err != nil {
+			return err
+		}
+	}
+
+	for route, name := range c.RoutePipelines {
+		if _, ok := c.Pipelines[name]; !ok {
+			return &FieldError{"RoutePipelines." + route, fmt.Sprintf("no pipeline named %q", name)}
+		}
+	}
+
+	return nil
+}
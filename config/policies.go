@@ -0,0 +1,246 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UploadPolicy is what uploads on a route or by a user have to be. Zero values aren't checked.
+type UploadPolicy struct {
+	MinWidth  int
+	MaxWidth  int
+	MinHeight int
+	MaxHeight int
+	// Allowed width:height ratios, each exact like "3:1" or an inclusive range like "1:4-4:1". Any one will do.
+	AspectRatios []string
+	// i.e. image/jpeg
+	MimeTypes []string
+	MaxBytes  int64
+}
+
+// PolicyViolation is a constraint of an UploadPolicy an upload doesn't meet.
+type PolicyViolation struct {
+	Policy     string `json:"policy"`
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+func (this *UploadPolicy) Validate() error {
+	sizes := map[string]int{
+		"MinWidth":  this.MinWidth,
+		"MaxWidth":  this.MaxWidth,
+		"MinHeight": this.MinHeight,
+		"MaxHeight": this.MaxHeight,
+	}
+	for field, size := range sizes {
+		if size < 0 {
+			return &FieldError{field, "can't be negative"}
+		}
+	}
+
+	if this.MaxWidth > 0 && this.MinWidth > this.MaxWidth {
+		return &FieldError{"MinWidth", "can't be greater than MaxWidth"}
+	}
+
+	if this.MaxHeight > 0 && this.MinHeight > this.MaxHeight {
+		return &FieldError{"MinHeight", "can't be greater than MaxHeight"}
+	}
+
+	if this.MaxBytes < 0 {
+		return &FieldError{"MaxBytes", "can't be negative"}
+	}
+
+	for i, ratio := range this.AspectRatios {
+		if _, err := parseAspectRange(ratio); err != nil {
+			return &FieldError{fmt.Sprintf("AspectRatios[%d]", i), err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// CheckFile is the violations of the policy's MimeTypes and MaxBytes, which are known as soon as a file is received.
+func (this *UploadPolicy) CheckFile(name, mime string, size int64) []PolicyViolation {
+	var violations []PolicyViolation
+
+	if len(this.MimeTypes) > 0 {
+		allowed := false
+		for _, t := range this.MimeTypes {
+			allowed = allowed || t == mime
+		}
+
+		if !allowed {
+			violations = append(violations, PolicyViolation{name, "MimeTypes", fmt.Sprintf("%s isn't one of %s", mime, strings.Join(this.MimeTypes, ", "))})
+		}
+	}
+
+	if this.MaxBytes > 0 && size > this.MaxBytes {
+		violations = append(violations, PolicyViolation{name, "MaxBytes", fmt.Sprintf("%d bytes is more than %d", size, this.MaxBytes)})
+	}
+
+	return violations
+}
+
+// CheckDimensions is the violations of the policy's sizes and AspectRatios.
+func (this *UploadPolicy) CheckDimensions(name string, width, height int) []PolicyViolation {
+	var violations []PolicyViolation
+
+	limits := []struct {
+		constraint string
+		value      int
+		limit      int
+		tooBig     bool
+	}{
+		{"MinWidth", width, this.MinWidth, false},
+		{"MaxWidth", width, this.MaxWidth, true},
+		{"MinHeight", height, this.MinHeight, false},
+		{"MaxHeight", height, this.MaxHeight, true},
+	}
+
+	for _, l := range limits {
+		if l.limit == 0 {
+			continue
+		}
+
+		dimension := strings.ToLower(l.constraint[3:])
+		if l.tooBig && l.value > l.limit {
+			violations = append(violations, PolicyViolation{name, l.constraint, fmt.Sprintf("%s %d is more than %d", dimension, l.value, l.limit)})
+		} else if !l.tooBig && l.value < l.limit {
+			violations = append(violations, PolicyViolation{name, l.constraint, fmt.Sprintf("%s %d is less than %d", dimension, l.value, l.limit)})
+		}
+	}
+
+	if len(this.AspectRatios) > 0 {
+		allowed := false
+		for _, ratio := range this.AspectRatios {
+			aspect, _ := parseAspectRange(ratio)
+			allowed = allowed || aspect.contains(width, height)
+		}
+
+		if !allowed {
+			violations = append(violations, PolicyViolation{name, "AspectRatios", fmt.Sprintf("%d:%d isn't within %s", width, height, strings.Join(this.AspectRatios, ", "))})
+		}
+	}
+
+	return violations
+}
+
+// A range of width:height ratios, compared as integers so exact ratios match exactly.
+type aspectRange struct {
+	minWidth, minHeight int
+	maxWidth, maxHeight int
+}
+
+func parseAspectRange(value string) (aspectRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+
+	minWidth, minHeight, err := parseRatio(bounds[0])
+	if err != nil {
+		return aspectRange{}, err
+	}
+
+	maxWidth, maxHeight := minWidth, minHeight
+	if len(bounds) == 2 {
+		if maxWidth, maxHeight, err = parseRatio(bounds[1]); err != nil {
+			return aspectRange{}, err
+		}
+	}
+
+	if minWidth*maxHeight > maxWidth*minHeight {
+		return aspectRange{}, fmt.Errorf("%s is wider than %s", bounds[0], bounds[1])
+	}
+
+	return aspectRange{minWidth, minHeight, maxWidth, maxHeight}, nil
+}
+
+func parseRatio(value string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q must be a ratio like 4:3, or a range like 1:4-4:1", value)
+	}
+
+	width, werr := strconv.Atoi(parts[0])
+	height, herr := strconv.Atoi(parts[1])
+	if werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("%q must be a ratio like 4:3, or a range like 1:4-4:1", value)
+	}
+
+	return width, height, nil
+}
+
+func (this aspectRange) contains(width, height int) bool {
+	w, h := int64(width), int64(height)
+
+	return w*int64(this.minHeight) >= int64(this.minWidth)*h && w*int64(this.maxHeight) <= int64(this.maxWidth)*h
+}
+
+// UploadPolicyMap holds the UploadPolicies of the config file by name.
+type UploadPolicyMap map[string]UploadPolicy
+
+func (this *UploadPolicyMap) UnmarshalJSON(data []byte) error {
+	var policies map[string]json.RawMessage
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return &FieldError{"UploadPolicies", "must be an object of policies by name"}
+	}
+
+	decoded := make(UploadPolicyMap, len(policies))
+	for name, data := range policies {
+		var policy UploadPolicy
+		if err := decodeStrict(data, &policy, "UploadPolicies."+name+"."); err != nil {
+			return err
+		}
+		decoded[name] = policy
+	}
+
+	*this = decoded
+
+	return nil
+}
+
+// PoliciesFor is the names of the policies uploads to route by userID have to meet: the route's, then the user's.
+// userID is empty for uploads that aren't authenticated.
+func (c *Configuration) PoliciesFor(route, userID string) []string {
+	var names []string
+
+	if name, ok := c.RoutePolicies[route]; ok {
+		names = append(names, name)
+	}
+
+	if name, ok := c.UserPolicies[userID]; ok && userID != "" && (len(names) == 0 || names[0] != name) {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func (c *Configuration) validateUploadPolicies() error {
+	names := make([]string, 0, len(c.UploadPolicies))
+	for name := range c.UploadPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		policy := c.UploadPolicies[name]
+		if err := policy.Validate(); err != nil {
+			return prefixFieldError("UploadPolicies."+name, err)
+		}
+	}
+
+	attached := map[string]map[string]string{
+		"RoutePolicies": c.RoutePolicies,
+		"UserPolicies":  c.UserPolicies,
+	}
+	for field, policies := range attached {
+		for key, name := range policies {
+			if _, ok := c.UploadPolicies[name]; !ok {
+				return &FieldError{field + "." + key, fmt.Sprintf("no policy named %q", name)}
+			}
+		}
+	}
+
+	return nil
+}
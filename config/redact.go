@@ -0,0 +1,126 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+const redacted = "REDACTED"
+
+// WriteRedacted writes the configuration as indented JSON with fields tagged `secret:"true"` replaced by REDACTED.
+func (c *Configuration) WriteRedacted(w io.Writer) error {
+	data, err := json.MarshalIndent(redactValue(reflect.ValueOf(c)), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// A JSON object that keeps its keys in struct field order.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (this *orderedObject) set(key string, value interface{}) {
+	if _, ok := this.values[key]; !ok {
+		this.keys = append(this.keys, key)
+	}
+	this.values[key] = value
+}
+
+func (this *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range this.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(this.values[key])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func redactValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+
+		if store, ok := v.Interface().(StoreConfig); ok {
+			obj := &orderedObject{values: make(map[string]interface{})}
+			obj.set("Type", store.StoreType())
+			redactStruct(reflect.Indirect(reflect.ValueOf(store)), obj)
+			return obj
+		}
+
+		return redactValue(v.Elem())
+	case reflect.Struct:
+		obj := &orderedObject{values: make(map[string]interface{})}
+		redactStruct(v, obj)
+		return obj
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = redactValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+
+		m := make(map[string]interface{})
+		for _, key := range v.MapKeys() {
+			m[key.String()] = redactValue(v.MapIndex(key))
+		}
+		return m
+	}
+
+	return v.Interface()
+}
+
+func redactStruct(v reflect.Value, obj *orderedObject) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			redactStruct(v.Field(i), obj)
+			continue
+		}
+
+		value := v.Field(i)
+		if field.Tag.Get("secret") == "true" && !reflect.DeepEqual(value.Interface(), reflect.Zero(field.Type).Interface()) {
+			obj.set(field.Name, redacted)
+			continue
+		}
+
+		obj.set(field.Name, redactValue(value))
+	}
+}
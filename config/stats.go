@@ -0,0 +1,97 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	StatsDatadog    = "datadog"
+	StatsStatsd     = "statsd"
+	StatsPrometheus = "prometheus"
+)
+
+// StatsConfig is a single entry in the Stats array. Every backend receives all stats.
+type StatsConfig struct {
+	// One of datadog, statsd or prometheus
+	Type string
+
+	// host:port of the agent for datadog and statsd, the port defaults to 8125
+	Address string
+
+	// Prepended to metric names sent to a plain statsd server. Defaults to mandible.
+	Prefix string
+
+	// How many stats may be queued for the backend before new ones are dropped. Defaults to 1024.
+	BufferSize int
+}
+
+func (this *StatsConfig) Validate() error {
+	switch this.Type {
+	case StatsDatadog, StatsStatsd:
+		if err := RequireString("Address", this.Address); err != nil {
+			return err
+		}
+	case StatsPrometheus:
+		if this.Address != "" {
+			return &FieldError{"Address", "isn't used by prometheus, metrics are served at /metrics"}
+		}
+	case "":
+		return &FieldError{"Type", "is required"}
+	default:
+		return &FieldError{"Type", fmt.Sprintf("unsupported stats backend %q, expected one of %v", this.Type, []string{StatsDatadog, StatsStatsd, StatsPrometheus})}
+	}
+
+	if this.BufferSize < 0 {
+		return &FieldError{"BufferSize", "can't be negative"}
+	}
+
+	return nil
+}
+
+type StatsList []StatsConfig
+
+func (this *StatsList) UnmarshalJSON(data []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return &FieldError{"Stats", "must be an array of objects"}
+	}
+
+	list := make(StatsList, len(entries))
+	for i, entry := range entries {
+		if err := decodeStrict(entry, &list[i], fmt.Sprintf("Stats[%d].", i)); err != nil {
+			return err
+		}
+	}
+
+	*this = list
+
+	return nil
+}
+
+// StatsBackends returns the Stats array along with the backends enabled by the older DatadogEnabled and
+// PrometheusEnabled fields.
+func (c *Configuration) StatsBackends() StatsList {
+	backends := append(StatsList{}, c.Stats...)
+
+	if c.DatadogEnabled {
+		backends = append(backends, StatsConfig{Type: StatsDatadog, Address: c.DatadogHostname})
+	}
+
+	if c.PrometheusEnabled {
+		backends = append(backends, StatsConfig{Type: StatsPrometheus})
+	}
+
+	return backends
+}
+
+// ServesMetrics is true if a prometheus backend is configured, so /metrics should be mounted.
+func (c *Configuration) ServesMetrics() bool {
+	for _, backend := range c.StatsBackends() {
+		if backend.Type == StatsPrometheus {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// StoreConfig is the typed configuration of a single entry in the Stores array. Each store type registers a
+// StoreConfigFactory under the name used in the entry's "Type" field.
+type StoreConfig interface {
+	// The name the store type was registered under, i.e. s3
+	StoreType() string
+
+	// Checks that required fields are set, returning a *FieldError naming the offending field.
+	Validate() error
+}
+
+type StoreConfigFactory func() StoreConfig
+
+var (
+	storeTypes   = make(map[string]StoreConfigFactory)
+	storeTypesMu sync.RWMutex
+)
+
+// RegisterStoreType makes a store type available to the Stores array of the config file. It panics if a type is
+// registered twice.
+func RegisterStoreType(name string, factory StoreConfigFactory) {
+	storeTypesMu.Lock()
+	defer storeTypesMu.Unlock()
+
+	if _, ok := storeTypes[name]; ok {
+		panic(fmt.Sprintf("config: store type %s registered twice", name))
+	}
+
+	storeTypes[name] = factory
+}
+
+// StoreTypes returns the names of all registered store types.
+func StoreTypes() []string {
+	storeTypesMu.RLock()
+	defer storeTypesMu.RUnlock()
+
+	names := make([]string, 0, len(storeTypes))
+	for name := range storeTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func newStoreConfig(name string) (StoreConfig, bool) {
+	storeTypesMu.RLock()
+	factory, ok := storeTypes[name]
+	storeTypesMu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	return factory(), true
+}
+
+type StoreList []StoreConfig
+
+func (this *StoreList) UnmarshalJSON(data []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return &FieldError{"Stores", "must be an array of objects"}
+	}
+
+	stores := make(StoreList, 0, len(entries))
+
+	for i, entry := range entries {
+		prefix := fmt.Sprintf("Stores[%d]", i)
+
+		var typed struct {
+			Type string
+		}
+		if err := json.Unmarshal(entry, &typed); err != nil {
+			return &FieldError{prefix, "must be an object"}
+		}
+
+		if typed.Type == "" {
+			return &FieldError{prefix + ".Type", "is required"}
+		}
+
+		store, ok := newStoreConfig(typed.Type)
+		if !ok {
+			return &FieldError{prefix + ".Type", fmt.Sprintf("unsupported store %q, expected one of %v", typed.Type, StoreTypes())}
+		}
+
+		if err := decodeStrict(entry, store, prefix+".", "Type"); err != nil {
+			return err
+		}
+
+		stores = append(stores, store)
+	}
+
+	*this = stores
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ThumbPreset is a named thumbnail spec, with the same fields as the thumbs parameter of an upload.
+type ThumbPreset struct {
+	Width     int
+	MaxWidth  int
+	Height    int
+	MaxHeight int
+	// circle, thumb, square or custom. Empty keeps the whole image.
+	Shape       string
+	CropGravity string
+	CropWidth   int
+	CropHeight  int
+	CropRatio   string
+	Quality     int
+	Format      string
+	NoStore     bool
+	// Keep every frame of animated GIFs
+	Animated bool
+}
+
+var thumbShapes = []string{"", "circle", "thumb", "square", "custom"}
+
+func (this *ThumbPreset) Validate() error {
+	sizes := map[string]int{
+		"Width":      this.Width,
+		"MaxWidth":   this.MaxWidth,
+		"Height":     this.Height,
+		"MaxHeight":  this.MaxHeight,
+		"CropWidth":  this.CropWidth,
+		"CropHeight": this.CropHeight,
+	}
+	for field, size := range sizes {
+		if size < 0 {
+			return &FieldError{field, "can't be negative"}
+		}
+	}
+
+	if this.Quality < 0 || this.Quality > 100 {
+		return &FieldError{"Quality", "must be between 0 and 100"}
+	}
+
+	known := false
+	for _, shape := range thumbShapes {
+		known = known || shape == this.Shape
+	}
+	if !known {
+		return &FieldError{"Shape", fmt.Sprintf("unsupported shape %q, expected one of %v", this.Shape, thumbShapes[1:])}
+	}
+
+	if (this.Shape == "circle" || this.Shape == "square") && this.Width == 0 {
+		return &FieldError{"Width", "is required for " + this.Shape + " thumbnails"}
+	}
+
+	return nil
+}
+
+// ThumbPresetMap holds the ThumbPresets of the config file by name.
+type ThumbPresetMap map[string]ThumbPreset
+
+func (this *ThumbPresetMap) UnmarshalJSON(data []byte) error {
+	var presets map[string]json.RawMessage
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return &FieldError{"ThumbPresets", "must be an object of presets by name"}
+	}
+
+	decoded := make(ThumbPresetMap, len(presets))
+	for name, data := range presets {
+		var preset ThumbPreset
+		if err := decodeStrict(data, &preset, "ThumbPresets."+name+"."); err != nil {
+			return err
+		}
+		decoded[name] = preset
+	}
+
+	*this = decoded
+
+	return nil
+}
+
+func (c *Configuration) validateThumbPresets() error {
+	names := make([]string, 0, len(c.ThumbPresets))
+	for name := range c.ThumbPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		preset := c.ThumbPresets[name]
+		if err := preset.Validate(); err != nil {
+			return prefixFieldError("ThumbPresets."+name, err)
+		}
+	}
+
+	for i, name := range c.DefaultThumbPresets {
+		if _, ok := c.ThumbPresets[name]; !ok {
+			return &FieldError{fmt.Sprintf("DefaultThumbPresets[%d]", i), fmt.Sprintf("no preset named %q", name)}
+		}
+	}
+
+	return nil
+}
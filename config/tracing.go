@@ -0,0 +1,37 @@
+package config
+
+import "fmt"
+
+const (
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+// TracingConfig configures exporting of request traces. Tracing is disabled unless Exporter is set.
+type TracingConfig struct {
+	// stdout or otlp
+	Exporter string
+
+	// The OTLP/HTTP traces endpoint of the collector, i.e. http://localhost:4318/v1/traces
+	Endpoint string
+
+	// Reported as service.name, defaults to mandible
+	ServiceName string
+}
+
+func (this *TracingConfig) UnmarshalJSON(data []byte) error {
+	type plain TracingConfig
+	return decodeStrict(data, (*plain)(this), "Tracing.")
+}
+
+func (this *TracingConfig) Validate() error {
+	switch this.Exporter {
+	case "", TracingStdout:
+	case TracingOTLP:
+		return RequireString("Endpoint", this.Endpoint)
+	default:
+		return &FieldError{"Exporter", fmt.Sprintf("unsupported exporter %q, expected one of %v", this.Exporter, []string{TracingStdout, TracingOTLP})}
+	}
+
+	return nil
+}
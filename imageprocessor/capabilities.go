@@ -0,0 +1,54 @@
+package imageprocessor
+
+import (
+	"sync"
+
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+)
+
+var (
+	capabilities   processorcommand.Capabilities
+	capabilitiesMu sync.RWMutex
+)
+
+// SetCapabilities tells the strategies which external programs are available, so they can skip steps needing one
+// that isn't. Until it is called every program is assumed to be available.
+func SetCapabilities(caps processorcommand.Capabilities) {
+	capabilitiesMu.Lock()
+	capabilities = caps
+	capabilitiesMu.Unlock()
+}
+
+// GetCapabilities returns the capabilities given to SetCapabilities.
+func GetCapabilities() processorcommand.Capabilities {
+	capabilitiesMu.RLock()
+	defer capabilitiesMu.RUnlock()
+
+	return capabilities
+}
+
+// AvailableOCRStrategy is DuelOCRStratagy without the OCR tesseract can't run, or nil if it can run neither.
+func AvailableOCRStrategy() *OCRRunner {
+	return availableOCR(GetCapabilities())
+}
+
+// An OCR runner using whichever of the meme and standard OCR tesseract has the traineddata for, or nil if neither.
+func availableOCR(caps processorcommand.Capabilities) *OCRRunner {
+	if !caps.Has("tesseract") {
+		return nil
+	}
+
+	multi := processorcommand.MultiOCRCommand{}
+	if caps.HasLanguage("meme") {
+		multi = append(multi, processorcommand.NewMemeOCR())
+	}
+	if caps.HasLanguage("eng") {
+		multi = append(multi, processorcommand.NewStandardOCR())
+	}
+
+	if len(multi) == 0 {
+		return nil
+	}
+
+	return &OCRRunner{multi}
+}
@@ -1,6 +1,7 @@
 package imageprocessor
 
 import (
+	"context"
 	"errors"
 
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
@@ -9,16 +10,18 @@ import (
 
 type CompressLosslessly struct{}
 
-func (this *CompressLosslessly) Process(image *uploadedfile.UploadedFile) error {
+func (this *CompressLosslessly) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
 	if image.IsJpeg() {
-		return this.compressJpeg(image)
+		return this.compressJpeg(ctx, image)
 	}
 
 	if image.IsPng() {
-		return this.compressPng(image)
+		return this.compressPng(ctx, image)
 	}
 
-	if image.IsGif() {
+	// WebPs are compressed when they're encoded, there's nothing lossless left to do, and SVGs are text. PDFs and
+	// videos are kept as they are.
+	if image.IsGif() || image.IsWebp() || image.IsSvg() || image.IsPdf() || image.IsVideo() {
 		return nil
 	}
 
@@ -29,8 +32,8 @@ func (this *CompressLosslessly) String() string {
 	return "Lossy compressor"
 }
 
-func (this *CompressLosslessly) compressPng(image *uploadedfile.UploadedFile) error {
-	filename, err := processorcommand.Optipng(image.GetPath())
+func (this *CompressLosslessly) compressPng(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	filename, err := processorcommand.Optipng(ctx, image.GetPath())
 	if err != nil {
 		return err
 	}
@@ -40,8 +43,8 @@ func (this *CompressLosslessly) compressPng(image *uploadedfile.UploadedFile) er
 	return nil
 }
 
-func (this *CompressLosslessly) compressJpeg(image *uploadedfile.UploadedFile) error {
-	filename, err := processorcommand.Jpegtran(image.GetPath())
+func (this *CompressLosslessly) compressJpeg(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	filename, err := processorcommand.Jpegtran(ctx, image.GetPath())
 	if err != nil {
 		return err
 	}
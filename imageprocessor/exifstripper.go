@@ -1,18 +1,20 @@
 package imageprocessor
 
 import (
+	"context"
+
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/uploadedfile"
 )
 
 type ExifStripper struct{}
 
-func (this *ExifStripper) Process(image *uploadedfile.UploadedFile) error {
-	if !image.IsJpeg() {
+func (this *ExifStripper) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	if !image.IsJpeg() && !image.IsWebp() {
 		return nil
 	}
 
-	err := processorcommand.StripMetadata(image.GetPath())
+	err := processorcommand.StripMetadata(ctx, image.GetPath())
 	if err != nil {
 		return err
 	}
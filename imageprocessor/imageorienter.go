@@ -1,14 +1,20 @@
 package imageprocessor
 
 import (
+	"context"
+
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/uploadedfile"
 )
 
 type ImageOrienter struct{}
 
-func (this *ImageOrienter) Process(image *uploadedfile.UploadedFile) error {
-	filename, err := processorcommand.FixOrientation(image.GetPath())
+func (this *ImageOrienter) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	if image.IsAnimatedWebp() || image.IsSvg() || image.IsPdf() || image.IsVideo() {
+		return nil
+	}
+
+	filename, err := processorcommand.FixOrientation(ctx, image.GetPath())
 	if err != nil {
 		return err
 	}
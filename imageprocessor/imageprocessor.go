@@ -1,23 +1,44 @@
 package imageprocessor
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/tracing"
 	"github.com/Imgur/mandible/uploadedfile"
 )
 
 type ProcessType interface {
-	Process(image *uploadedfile.UploadedFile) error
+	Process(ctx context.Context, image *uploadedfile.UploadedFile) error
 	String() string
 }
 
+// Runs a single step in a span of its own. Multiple and async steps only group their children, so they aren't spans.
+func processStep(ctx context.Context, processor ProcessType, image *uploadedfile.UploadedFile) error {
+	switch processor.(type) {
+	case multiProcessType, asyncProcessType:
+		return processor.Process(ctx, image)
+	}
+
+	ctx, span := tracing.StartSpan(ctx, processName(processor))
+	span.SetAttribute("processor", processor.String())
+	defer span.End()
+
+	err := processor.Process(ctx, image)
+	span.SetError(err)
+
+	return err
+}
+
 type multiProcessType []ProcessType
 
-func (this multiProcessType) Process(image *uploadedfile.UploadedFile) error {
+func (this multiProcessType) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
 	for _, processor := range this {
-		err := processor.Process(image)
+		err := processStep(ctx, processor, image)
 		if err != nil {
 			return fmt.Errorf("Error multiprocessing on %s: %s", processor.String(), err.Error())
 		}
@@ -36,12 +57,12 @@ func (this multiProcessType) String() string {
 
 type asyncProcessType []ProcessType
 
-func (this asyncProcessType) Process(image *uploadedfile.UploadedFile) error {
+func (this asyncProcessType) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
 	errs := make(chan error, len(this))
 
 	for _, processor := range this {
 		go func(p ProcessType) {
-			err := p.Process(image)
+			err := processStep(ctx, p, image)
 			if err != nil {
 				errs <- fmt.Errorf("Error asynchronously processing on %s: %s", p.String(), err.Error())
 			} else {
@@ -74,51 +95,193 @@ type ImageProcessor struct {
 	processor ProcessType
 }
 
-func (this *ImageProcessor) Run(image *uploadedfile.UploadedFile) error {
-	return this.processor.Process(image)
+func (this *ImageProcessor) Run(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	return processStep(ctx, this.processor, image)
 }
 
-type ImageProcessorStrategy func(*config.Configuration, *uploadedfile.UploadedFile) (*ImageProcessor, error)
+// AfterOrienting runs check on the upload once it's oriented: right after the orient step, or after the normalize
+// step or before every other step if there's no orient step. When the step is in an async group, check runs after the
+// whole group. An error from check stops the processor, so the steps after it, i.e. OCR and thumbnails, aren't run
+// for uploads that are going to be rejected.
+func (this *ImageProcessor) AfterOrienting(check func(image *uploadedfile.UploadedFile) error) {
+	step := checkStep(check)
 
-// Just do nothing to the file after it's uploaded...
-var PassthroughStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
-	return &ImageProcessor{multiProcessType{}}, nil
+	for _, isTarget := range []func(ProcessType) bool{isOrienter, isNormalizer} {
+		if processor, ok := insertAfter(this.processor, isTarget, step); ok {
+			this.processor = processor
+			return
+		}
+	}
+
+	this.processor = multiProcessType{step, this.processor}
 }
 
-var ThumbnailStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
-	processor := asyncProcessType{}
-	for _, t := range file.GetThumbs() {
-		processor = append(processor, t)
+type checkStep func(image *uploadedfile.UploadedFile) error
+
+func (this checkStep) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	return this(image)
+}
+
+func (this checkStep) String() string {
+	return "Check"
+}
+
+func isOrienter(processor ProcessType) bool {
+	_, ok := unobserved(processor).(*ImageOrienter)
+	return ok
+}
+
+func isNormalizer(processor ProcessType) bool {
+	_, ok := unobserved(processor).(*Normalizer)
+	return ok
+}
+
+func unobserved(processor ProcessType) ProcessType {
+	if observed, ok := processor.(*observedProcessType); ok {
+		return observed.processor
 	}
 
-	return &ImageProcessor{processor}, nil
+	return processor
 }
 
-var EverythingStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
-	size, err := file.FileSize()
-	if err != nil {
-		return &ImageProcessor{}, err
+// Replaces the first step isTarget matches with it followed by step, reporting whether there was one. Steps in an
+// async group run alongside each other, so when the match is in one, step goes after the whole group instead.
+func insertAfter(processor ProcessType, isTarget func(ProcessType) bool, step ProcessType) (ProcessType, bool) {
+	switch p := processor.(type) {
+	case multiProcessType:
+		for i, child := range p {
+			if replaced, ok := insertAfter(child, isTarget, step); ok {
+				p[i] = replaced
+				return p, true
+			}
+		}
+
+		return p, false
+	case asyncProcessType:
+		if contains(p, isTarget) {
+			return multiProcessType{p, step}, true
+		}
+
+		return p, false
 	}
 
-	processor := multiProcessType{}
-	processor = append(processor, &ImageOrienter{})
-	processor = append(processor, &CompressLosslessly{})
-	processor = append(processor, &ExifStripper{})
+	if isTarget(processor) {
+		return multiProcessType{processor, step}, true
+	}
+
+	return processor, false
+}
+
+// Whether processor is or has a step isTarget matches.
+func contains(processor ProcessType, isTarget func(ProcessType) bool) bool {
+	var children []ProcessType
+	switch p := processor.(type) {
+	case multiProcessType:
+		children = p
+	case asyncProcessType:
+		children = p
+	default:
+		return isTarget(processor)
+	}
 
-	if size > cfg.MaxFileSize {
-		processor = append(processor, &ImageScaler{cfg.MaxFileSize})
+	for _, child := range children {
+		if contains(child, isTarget) {
+			return true
+		}
 	}
 
-	async := asyncProcessType{}
+	return false
+}
 
-	async = append(async, DuelOCRStratagy())
-	for _, t := range file.GetThumbs() {
-		async = append(async, t)
+// ProcessObserver is told the duration and result of each step an ImageProcessor runs.
+type ProcessObserver func(processor string, elapsed time.Duration, err error)
+
+// Observe reports every step of the processor to observer. Multiple and async steps are reported individually rather
+// than as a whole.
+func (this *ImageProcessor) Observe(observer ProcessObserver) {
+	if this.processor != nil {
+		this.processor = observeProcess(this.processor, observer)
+	}
+}
+
+func observeProcess(processor ProcessType, observer ProcessObserver) ProcessType {
+	switch p := processor.(type) {
+	case multiProcessType:
+		observed := make(multiProcessType, len(p))
+		for i, child := range p {
+			observed[i] = observeProcess(child, observer)
+		}
+		return observed
+	case asyncProcessType:
+		observed := make(asyncProcessType, len(p))
+		for i, child := range p {
+			observed[i] = observeProcess(child, observer)
+		}
+		return observed
+	}
+
+	return &observedProcessType{processor, observer}
+}
+
+type observedProcessType struct {
+	processor ProcessType
+	observer  ProcessObserver
+}
+
+func (this *observedProcessType) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	start := time.Now()
+	err := this.processor.Process(ctx, image)
+	this.observer(processName(this.processor), time.Since(start), err)
+
+	return err
+}
+
+func (this *observedProcessType) String() string {
+	return this.processor.String()
+}
+
+// A name for the kind of step, without details like the thumbnail name that would make it unique per request.
+func processName(processor ProcessType) string {
+	if observed, ok := processor.(*observedProcessType); ok {
+		return processName(observed.processor)
+	}
+
+	if _, ok := processor.(*uploadedfile.ThumbFile); ok {
+		return "Thumbnail"
 	}
 
-	if len(async) > 0 {
-		processor = append(processor, async)
+	return processor.String()
+}
+
+func canCompress(caps processorcommand.Capabilities, file *uploadedfile.UploadedFile) bool {
+	switch {
+	case file.IsJpeg():
+		return caps.Has("jpegtran")
+	case file.IsPng():
+		return caps.Has("optipng")
+	}
+
+	return true
+}
+
+type ImageProcessorStrategy func(*config.Configuration, *uploadedfile.UploadedFile) (*ImageProcessor, error)
+
+// Just do nothing to the file after it's uploaded...
+var PassthroughStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
+	return &ImageProcessor{multiProcessType{}}, nil
+}
+
+var ThumbnailStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
+	processor := asyncProcessType{}
+	for _, t := range file.GetThumbs() {
+		processor = append(processor, t)
 	}
 
 	return &ImageProcessor{processor}, nil
 }
+
+// Orients, compresses and strips EXIF data from the upload, scales it down if it's larger than MaxFileSize, then runs
+// OCR and creates thumbnails concurrently. Steps needing a missing program are skipped.
+var EverythingStrategy = func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
+	return everythingPipeline.Strategy()(cfg, file)
+}
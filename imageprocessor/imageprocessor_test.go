@@ -0,0 +1,403 @@
+package imageprocessor
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+type fakeProcessType struct {
+	name string
+	err  error
+}
+
+func (this *fakeProcessType) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	return this.err
+}
+
+func (this *fakeProcessType) String() string {
+	return this.name
+}
+
+func TestObserveReportsEachStep(t *testing.T) {
+	processor := &ImageProcessor{multiProcessType{
+		&fakeProcessType{"first", nil},
+		asyncProcessType{&fakeProcessType{"second", nil}, &fakeProcessType{"third", nil}},
+		&fakeProcessType{"fourth", errors.New("failed")},
+	}}
+
+	var mu sync.Mutex
+	observed := make([]string, 0)
+	processor.Observe(func(name string, elapsed time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed = append(observed, name+":"+map[bool]string{true: "ok", false: "error"}[err == nil])
+	})
+
+	if err := processor.Run(context.Background(), nil); err == nil {
+		t.Fatalf("Expected the failing step's error")
+	}
+
+	sort.Strings(observed)
+	expected := []string{"first:ok", "fourth:error", "second:ok", "third:ok"}
+	if len(observed) != len(expected) {
+		t.Fatalf("Expected %v to be observed, instead %v", expected, observed)
+	}
+	for i := range expected {
+		if observed[i] != expected[i] {
+			t.Fatalf("Expected %v to be observed, instead %v", expected, observed)
+		}
+	}
+}
+
+func TestEverythingStrategySkipsStepsWithMissingPrograms(t *testing.T) {
+	SetCapabilities(processorcommand.Capabilities{
+		"gm":        {Command: "gm", Required: true, Available: true},
+		"tesseract": {Command: "tesseract", Available: true, Languages: []string{"eng"}},
+		"optipng":   {Command: "optipng"},
+		"exiftool":  {Command: "exiftool"},
+		"jpegtran":  {Command: "jpegtran", Available: true},
+	})
+	defer SetCapabilities(nil)
+
+	upload, err := uploadedfile.NewUploadedFile("ocrtestimage.png", "testdata/ocrtestimage.png", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading test image: %s", err.Error())
+	}
+
+	processor, err := EverythingStrategy(&config.Configuration{MaxFileSize: 99999999999}, upload)
+	if err != nil {
+		t.Fatalf("Unexpected error creating processor: %s", err.Error())
+	}
+
+	expected := "Multiple processes <Image orienter, Async processes <OCR runner>>"
+	if processor.processor.String() != expected {
+		t.Fatalf("Expected %s, instead %s", expected, processor.processor.String())
+	}
+
+	ocr := processor.processor.(multiProcessType)[1].(asyncProcessType)[0].(*OCRRunner)
+	if len(ocr.Command.(processorcommand.MultiOCRCommand)) != 1 {
+		t.Fatalf("Expected only the standard OCR without the meme traineddata")
+	}
+}
+
+func TestPipelineSkipsStepsThatDontMatch(t *testing.T) {
+	pipelines, err := NewPipelines(config.PipelineMap{
+		"fast": {
+			{Step: "orient"},
+			{Step: "strip_exif", When: &config.StepCondition{Mime: []string{"image/jpeg"}}},
+			{Async: []config.PipelineStep{{Step: "ocr"}, {Step: "thumbnails"}}, When: &config.StepCondition{MinWidth: 1}},
+			{Steps: []config.PipelineStep{{Step: "compress"}}, When: &config.StepCondition{MaxBytes: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating pipelines: %s", err.Error())
+	}
+
+	upload, err := uploadedfile.NewUploadedFile("ocrtestimage.png", "testdata/ocrtestimage.png", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading test image: %s", err.Error())
+	}
+
+	processor, err := pipelines["fast"].Strategy()(&config.Configuration{MaxFileSize: 99999999999}, upload)
+	if err != nil {
+		t.Fatalf("Unexpected error creating processor: %s", err.Error())
+	}
+
+	expected := "Multiple processes <Image orienter, Async processes <OCR runner>>"
+	if processor.processor.String() != expected {
+		t.Fatalf("Expected %s, instead %s", expected, processor.processor.String())
+	}
+
+	_, err = NewPipelines(config.PipelineMap{"bad": {{Steps: []config.PipelineStep{{Step: "scale", Params: map[string]interface{}{"MaxBytes": -1.0}}}}}})
+	if err == nil || err.Error() != "Pipelines.bad[0].Steps[0].Params.MaxBytes: only MaxBytes, a positive integer, is supported" {
+		t.Fatalf("Expected an error for the invalid param, instead %v", err)
+	}
+}
+
+// Writes a GIF whose frames have delays of 10, 20, 30...
+func writeTestGif(t *testing.T, frames int) string {
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 2, 2), palette))
+		g.Delay = append(g.Delay, 10*(i+1))
+	}
+
+	f, err := ioutil.TempFile("", "animated")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+	}
+	defer f.Close()
+
+	if err := gif.EncodeAll(f, g); err != nil {
+		t.Fatalf("Unexpected error writing GIF: %s", err.Error())
+	}
+
+	return f.Name()
+}
+
+func TestDroppingGifFramesKeepsTheSpeed(t *testing.T) {
+	original := writeTestGif(t, 3)
+	defer os.Remove(original)
+
+	filename, dropped, err := dropGifFrames(original)
+	if err != nil || !dropped {
+		t.Fatalf("Expected frames to be dropped, instead %v %v", dropped, err)
+	}
+	defer os.Remove(filename)
+
+	out, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error opening result: %s", err.Error())
+	}
+	defer out.Close()
+
+	result, err := gif.DecodeAll(out)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding result: %s", err.Error())
+	}
+
+	if len(result.Image) != 2 || result.Delay[0] != 30 || result.Delay[1] != 30 {
+		t.Fatalf("Expected 2 frames of 30, instead %v", result.Delay)
+	}
+}
+
+func TestVideoStepNeedsFfmpegAndAGif(t *testing.T) {
+	pipelines, err := NewPipelines(config.PipelineMap{
+		"video": {{Step: "video", Params: map[string]interface{}{"Formats": []interface{}{"webm"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating pipelines: %s", err.Error())
+	}
+
+	filename := writeTestGif(t, 2)
+	defer os.Remove(filename)
+
+	gifUpload, err := uploadedfile.NewUploadedFile("animated.gif", filename, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading test GIF: %s", err.Error())
+	}
+
+	pngUpload, err := uploadedfile.NewUploadedFile("ocrtestimage.png", "testdata/ocrtestimage.png", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading test image: %s", err.Error())
+	}
+
+	caps := processorcommand.Capabilities{
+		"ffmpeg":  {Command: "ffmpeg", Available: true},
+		"ffprobe": {Command: "ffprobe", Available: true},
+	}
+	SetCapabilities(caps)
+	defer SetCapabilities(nil)
+
+	cfg := &config.Configuration{MaxFileSize: 99999999999}
+	processor, _ := pipelines["video"].Strategy()(cfg, gifUpload)
+	converter := processor.processor.(multiProcessType)[0].(*VideoConverter)
+	if len(converter.formats) != 1 || converter.formats[0] != thumbType.WEBM {
+		t.Fatalf("Expected a webm converter, instead %v", converter.formats)
+	}
+
+	processor, _ = pipelines["video"].Strategy()(cfg, pngUpload)
+	if len(processor.processor.(multiProcessType)) != 0 {
+		t.Fatalf("Expected PNGs to be left alone, instead %s", processor.processor.String())
+	}
+
+	caps["ffprobe"] = processorcommand.Capability{Command: "ffprobe"}
+	processor, _ = pipelines["video"].Strategy()(cfg, gifUpload)
+	if len(processor.processor.(multiProcessType)) != 0 {
+		t.Fatalf("Expected the step to be skipped without ffprobe, instead %s", processor.processor.String())
+	}
+
+	_, err = NewPipelines(config.PipelineMap{"bad": {{Step: "video", Params: map[string]interface{}{"Formats": []interface{}{"gif"}}}}})
+	if err == nil || err.Error() != "Pipelines.bad[0].Params.Formats[0]: must be mp4 or webm" {
+		t.Fatalf("Expected an error for the invalid format, instead %v", err)
+	}
+}
+
+func TestAnimatedWebpsAreLeftAloneByGm(t *testing.T) {
+	// The header of an animated 300x200 WebP
+	header := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x2b\x01\x00\xc7\x00\x00")
+
+	f, err := ioutil.TempFile("", "animated")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.Write(header)
+	f.Close()
+
+	upload, err := uploadedfile.NewUploadedFile("animated.webp", f.Name(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading test WebP: %s", err.Error())
+	}
+
+	width, height, err := upload.Dimensions()
+	if err != nil || width != 300 || height != 200 || !upload.IsAnimatedWebp() {
+		t.Fatalf("Expected an animated 300x200 WebP, instead %dx%d %v", width, height, err)
+	}
+
+	if err := (&ImageOrienter{}).Process(context.Background(), upload); err != nil {
+		t.Fatalf("Expected orienting to be skipped, instead %s", err.Error())
+	}
+
+	if err := (&ImageScaler{1}).Process(context.Background(), upload); err == nil {
+		t.Fatalf("Expected scaling an animated WebP to fail")
+	}
+}
+
+func TestChecksRunOnceTheUploadIsOriented(t *testing.T) {
+	rejected := errors.New("rejected")
+	check := func(image *uploadedfile.UploadedFile) error {
+		return rejected
+	}
+
+	processor := &ImageProcessor{multiProcessType{&ImageOrienter{}, asyncProcessType{&fakeProcessType{"thumbnail", nil}}}}
+	processor.AfterOrienting(check)
+
+	expected := "Multiple processes <Multiple processes <Image orienter, Check>, Async processes <thumbnail>>"
+	if processor.processor.String() != expected {
+		t.Fatalf("Expected %s, instead %s", expected, processor.processor.String())
+	}
+
+	// Orienting alongside other steps, the check waits for all of them
+	pipelines, err := NewPipelines(config.PipelineMap{
+		"async": {{Async: []config.PipelineStep{{Step: "orient"}, {Step: "thumbnails"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating pipelines: %s", err.Error())
+	}
+
+	upload, err := uploadedfile.NewUploadedFile("upload", "testdata/ocrtestimage.png", []*uploadedfile.ThumbFile{
+		uploadedfile.NewThumbFile(10, 10, 10, 10, "small", "thumb", "", "", 0, 0, "", 0, "", false, false),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error reading upload: %s", err.Error())
+	}
+
+	processor, err = pipelines["async"].Strategy()(&config.Configuration{}, upload)
+	if err != nil {
+		t.Fatalf("Unexpected error creating processor: %s", err.Error())
+	}
+	processor.AfterOrienting(check)
+
+	expected = "Multiple processes <Multiple processes <Async processes <Image orienter, Thumbnail of <small>>, Check>>"
+	if processor.processor.String() != expected {
+		t.Fatalf("Expected %s, instead %s", expected, processor.processor.String())
+	}
+
+	// Without an orient step the check comes first, and stops the rest
+	processor = &ImageProcessor{multiProcessType{&fakeProcessType{"thumbnail", nil}}}
+	ran := make([]string, 0)
+	processor.Observe(func(name string, elapsed time.Duration, err error) {
+		ran = append(ran, name)
+	})
+	processor.AfterOrienting(check)
+
+	if err := processor.Run(context.Background(), nil); err == nil || len(ran) != 0 {
+		t.Fatalf("Expected the check to reject the upload before the thumbnail is made, instead %v after %v", err, ran)
+	}
+}
+
+func TestPipelineConditionsSeeTheNormalizedUpload(t *testing.T) {
+	pipelines, err := NewPipelines(config.PipelineMap{
+		"convert": {
+			{Step: "normalize"},
+			{Step: "orient", When: &config.StepCondition{Mime: []string{"image/tiff"}}},
+			{Step: "scale", Params: map[string]interface{}{"MaxBytes": 1.0}, When: &config.StepCondition{Mime: []string{"image/png"}}},
+			{Step: "compress", When: &config.StepCondition{MinWidth: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating pipelines: %s", err.Error())
+	}
+
+	uploads := map[string]string{
+		"II*\x00\x08\x00\x00\x00": "Multiple processes <Normalizer, Image scaler>",
+		"%PDF-1.4\n":              "Multiple processes <>",
+	}
+
+	cfg := &config.Configuration{MaxFileSize: 99999999999, CanonicalFormat: "png"}
+
+	for header, expected := range uploads {
+		f, err := ioutil.TempFile("", "upload")
+		if err != nil {
+			t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(header + "\x00\x00\x00\x08free")
+		f.Close()
+
+		upload, err := uploadedfile.NewUploadedFile("upload", f.Name(), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error reading upload: %s", err.Error())
+		}
+
+		processor, err := pipelines["convert"].Strategy()(cfg, upload)
+		if err != nil {
+			t.Fatalf("Expected %s's unreadable dimensions not to match, instead %s", upload.GetMime(), err.Error())
+		}
+
+		if processor.processor.String() != expected {
+			t.Fatalf("Expected %s for %s, instead %s", expected, upload.GetMime(), processor.processor.String())
+		}
+	}
+}
+
+func TestUploadsNeedingConversionAreNormalizedFirst(t *testing.T) {
+	headers := map[string]string{
+		"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic":   "image/heic",
+		"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif":   "image/avif",
+		"II*\x00\x08\x00\x00\x00":                            "image/tiff",
+		"MM\x00*\x00\x00\x00\x08":                            "image/tiff",
+		"BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00": "image/bmp",
+		"\x00\x00\x01\x00\x01\x00\x10\x10":                   "image/x-icon",
+	}
+
+	cfg := &config.Configuration{MaxFileSize: 99999999999, CanonicalFormat: "png", KeepTiffPages: true}
+
+	for header, mime := range headers {
+		f, err := ioutil.TempFile("", "upload")
+		if err != nil {
+			t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(header + "\x00\x00\x00\x08free")
+		f.Close()
+
+		upload, err := uploadedfile.NewUploadedFile("upload", f.Name(), nil)
+		if err != nil || upload.GetMime() != mime {
+			t.Fatalf("Expected %s, instead %v %v", mime, upload, err)
+		}
+
+		SetCapabilities(processorcommand.Capabilities{"heif-convert": {Command: "heif-convert"}})
+		_, err = EverythingStrategy(cfg, upload)
+		if upload.IsHeif() && err == nil {
+			t.Fatalf("Expected %s to be rejected without heif-convert", mime)
+		}
+
+		SetCapabilities(nil)
+		processor, err := EverythingStrategy(cfg, upload)
+		if err != nil {
+			t.Fatalf("Unexpected error creating processor: %s", err.Error())
+		}
+
+		normalizer, ok := processor.processor.(multiProcessType)[0].(*Normalizer)
+		if !ok || normalizer.format != thumbType.PNG || !normalizer.keepPages {
+			t.Fatalf("Expected the first step to convert %s to PNG, instead %s", mime, processor.processor.String())
+		}
+	}
+}
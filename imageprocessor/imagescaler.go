@@ -1,7 +1,11 @@
 package imageprocessor
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"image/gif"
+	"os"
 
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/uploadedfile"
@@ -11,14 +15,20 @@ type ImageScaler struct {
 	targetSize int64
 }
 
-func (this *ImageScaler) Process(image *uploadedfile.UploadedFile) error {
+func (this *ImageScaler) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
 	switch image.GetMime() {
 	case "image/jpeg", "image/jpg":
-		return this.scaleJpeg(image)
+		return this.scaleJpeg(ctx, image)
 	case "image/png":
-		return this.scalePng(image)
+		return this.scalePng(ctx, image)
 	case "image/gif":
-		return this.scaleGif(image)
+		return this.scaleGif(ctx, image)
+	case "image/webp":
+		return this.scaleWebp(ctx, image)
+	case "image/svg+xml":
+		return errors.New("SVGs can't be scaled")
+	case "application/pdf":
+		return errors.New("PDFs can't be scaled")
 	}
 
 	return errors.New("Unsuported filetype")
@@ -28,19 +38,28 @@ func (this *ImageScaler) String() string {
 	return "Image scaler"
 }
 
-func (this *ImageScaler) scalePng(image *uploadedfile.UploadedFile) error {
-	filename, err := processorcommand.ConvertToJpeg(image.GetPath())
+func (this *ImageScaler) scalePng(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	filename, err := processorcommand.ConvertToJpeg(ctx, image.GetPath())
 	if err != nil {
 		return err
 	}
 
 	image.SetPath(filename)
 	image.SetMime("image/jpeg")
-	return this.scaleJpeg(image)
+	return this.scaleJpeg(ctx, image)
 }
 
-func (this *ImageScaler) scaleJpeg(image *uploadedfile.UploadedFile) error {
-	filename, err := processorcommand.Quality(image.GetPath(), 90)
+// Static WebPs are scaled like JPEGs, gm keeps the format.
+func (this *ImageScaler) scaleWebp(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	if image.IsAnimatedWebp() {
+		return errors.New("Animated WebPs can't be scaled")
+	}
+
+	return this.scaleJpeg(ctx, image)
+}
+
+func (this *ImageScaler) scaleJpeg(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	filename, err := processorcommand.Quality(ctx, image.GetPath(), 90)
 	if err != nil {
 		return err
 	}
@@ -51,7 +70,7 @@ func (this *ImageScaler) scaleJpeg(image *uploadedfile.UploadedFile) error {
 		return nil
 	}
 
-	filename, err = processorcommand.Quality(image.GetPath(), 70)
+	filename, err = processorcommand.Quality(ctx, image.GetPath(), 70)
 	if err != nil {
 		return err
 	}
@@ -72,7 +91,7 @@ func (this *ImageScaler) scaleJpeg(image *uploadedfile.UploadedFile) error {
 	}
 
 	for {
-		filename, err = processorcommand.ResizePercent(image.GetPath(), percent)
+		filename, err = processorcommand.ResizePercent(ctx, image.GetPath(), percent)
 		if err != nil {
 			return err
 		}
@@ -91,6 +110,116 @@ func (this *ImageScaler) scaleJpeg(image *uploadedfile.UploadedFile) error {
 	}
 }
 
-func (this *ImageScaler) scaleGif(image *uploadedfile.UploadedFile) error {
-	return errors.New("Unimplimented")
+// Brings GIFs under the target size keeping their animation, by reducing colors, then dropping every other frame,
+// then shrinking them.
+func (this *ImageScaler) scaleGif(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	for _, colors := range []int{128, 64} {
+		filename, err := processorcommand.ReduceColors(ctx, image.GetPath(), colors)
+		if err != nil {
+			return err
+		}
+
+		image.SetPath(filename)
+		if fits, err := this.fits(image); err != nil || fits {
+			return err
+		}
+	}
+
+	// Frames are coalesced first so each one is whole without the frames before it
+	filename, err := processorcommand.Coalesce(ctx, image.GetPath())
+	if err != nil {
+		return err
+	}
+	image.SetPath(filename)
+
+	for i := 0; i < maxGifFrameDrops; i++ {
+		filename, dropped, err := dropGifFrames(image.GetPath())
+		if err != nil {
+			return err
+		} else if !dropped {
+			break
+		}
+
+		image.SetPath(filename)
+		if fits, err := this.fits(image); err != nil || fits {
+			return err
+		}
+	}
+
+	for percent := 90; percent >= 10; percent -= 10 {
+		filename, err := processorcommand.ResizePercent(ctx, image.GetPath(), percent)
+		if err != nil {
+			return err
+		}
+
+		image.SetPath(filename)
+		if fits, err := this.fits(image); err != nil || fits {
+			return err
+		}
+	}
+
+	return errors.New("Could not scale image to desired filesize")
+}
+
+func (this *ImageScaler) fits(image *uploadedfile.UploadedFile) (bool, error) {
+	size, err := image.FileSize()
+	if err != nil {
+		return false, err
+	}
+
+	return size > 0 && size < this.targetSize, nil
+}
+
+// How many times scaling a GIF halves its frames before shrinking it
+const maxGifFrameDrops = 2
+
+// Drops every other frame of a coalesced GIF, adding their delay to the frame before so it plays at the same speed.
+// Reports false if there's only one frame.
+func dropGifFrames(filename string) (string, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(g.Image) < 2 {
+		return filename, false, nil
+	}
+
+	kept := &gif.GIF{
+		LoopCount:       g.LoopCount,
+		Config:          g.Config,
+		BackgroundIndex: g.BackgroundIndex,
+	}
+
+	for i := 0; i < len(g.Image); i += 2 {
+		delay := g.Delay[i]
+		if i+1 < len(g.Image) {
+			delay += g.Delay[i+1]
+		}
+
+		kept.Image = append(kept.Image, g.Image[i])
+		kept.Delay = append(kept.Delay, delay)
+		if len(g.Disposal) > i {
+			kept.Disposal = append(kept.Disposal, g.Disposal[i])
+		}
+	}
+
+	outfile := fmt.Sprintf("%s_df", filename)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return "", false, err
+	}
+	defer out.Close()
+
+	if err := gif.EncodeAll(out, kept); err != nil {
+		return "", false, err
+	}
+
+	return outfile, true, nil
 }
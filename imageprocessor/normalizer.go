@@ -0,0 +1,88 @@
+package imageprocessor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+// Converts HEIC, HEIF, AVIF, BMP, TIFF and ICO uploads to JPEG or PNG so the other steps can handle them. What was
+// received can be kept as a rendition for HEIC, HEIF and AVIF, and the later pages of TIFFs as renditions too.
+type Normalizer struct {
+	format       thumbType.ThumbType
+	keepOriginal bool
+	keepPages    bool
+}
+
+func (this *Normalizer) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	switch {
+	case image.IsHeif():
+		return this.convertHeif(ctx, image)
+	case image.IsLegacyRaster():
+		return this.convertPages(ctx, image)
+	}
+
+	return nil
+}
+
+func (this *Normalizer) String() string {
+	return "Normalizer"
+}
+
+func (this *Normalizer) convertHeif(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	original := image.GetPath()
+	originalMime := image.GetMime()
+
+	filename, err := processorcommand.HeifConvert(ctx, original, this.format)
+	if err != nil {
+		return err
+	}
+
+	image.SetPath(filename)
+	image.SetMime(this.format.ToMime())
+
+	if this.keepOriginal {
+		format := strings.TrimPrefix(originalMime, "image/")
+		image.AddRendition(uploadedfile.NewRendition(format, originalMime, original, 0, 0))
+	}
+
+	return nil
+}
+
+// The first page becomes the upload, the rest of a TIFF's pages become renditions named page2, page3...
+func (this *Normalizer) convertPages(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	original := image.GetPath()
+
+	pages := 1
+	if image.IsTiff() && this.keepPages {
+		var err error
+		pages, err = processorcommand.PageCount(ctx, original)
+		if err != nil {
+			return err
+		}
+	}
+
+	for page := 1; page < pages; page++ {
+		filename, err := processorcommand.ConvertPage(ctx, original, page, this.format)
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("page%d", page+1)
+		image.AddRendition(uploadedfile.NewRendition(name, this.format.ToMime(), filename, 0, 0))
+	}
+
+	filename, err := processorcommand.ConvertPage(ctx, original, 0, this.format)
+	if err != nil {
+		return err
+	}
+
+	image.SetPath(filename)
+	image.SetMime(this.format.ToMime())
+
+	return nil
+}
@@ -1,20 +1,21 @@
 package imageprocessor
 
 import (
+	"context"
+
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/logging"
 	"github.com/Imgur/mandible/uploadedfile"
-
-	"log"
 )
 
 type OCRRunner struct {
 	Command processorcommand.OCRCommand
 }
 
-func (this *OCRRunner) Process(image *uploadedfile.UploadedFile) error {
-	result, err := this.Command.Run(image.GetPath())
+func (this *OCRRunner) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	result, err := this.Command.Run(ctx, image.GetPath())
 	if err != nil {
-		log.Printf("Error running OCR: %s", err.Error())
+		logging.FromContext(ctx).Warn("Error running OCR", "error", err)
 		return err
 	}
 
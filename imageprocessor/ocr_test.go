@@ -1,6 +1,7 @@
 package imageprocessor
 
 import (
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -18,7 +19,7 @@ func TestStandardOCR(t *testing.T) {
 	defer image.Clean()
 
 	ocrStratagy := StandardOCRStratagy()
-	ocrStratagy.Process(image)
+	ocrStratagy.Process(context.Background(), image)
 
 	if image.GetOCRText() != "hello" {
 		t.Fatalf("Did not get proper standard OCR text back %s != hello", image.GetOCRText())
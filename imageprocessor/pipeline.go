@@ -0,0 +1,379 @@
+package imageprocessor
+
+import (
+	"fmt"
+
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+// StepBuilder creates a pipeline step for an upload. A nil ProcessType leaves the step out, i.e. when the program it
+// needs is missing or it doesn't apply to the upload.
+type StepBuilder func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error)
+
+// StepFactory checks the params of a step when the config is loaded, and returns the builder for it.
+type StepFactory func(params map[string]interface{}) (StepBuilder, error)
+
+var stepFactories = make(map[string]StepFactory)
+
+// RegisterStep makes a step available to the Pipelines of the config file.
+func RegisterStep(name string, factory StepFactory) {
+	stepFactories[name] = factory
+}
+
+// The steps of EverythingStrategy.
+var everythingSteps = []config.PipelineStep{
+	{Step: "normalize"},
+	{Step: "orient"},
+	{Step: "compress"},
+	{Step: "strip_exif"},
+	{Step: "scale"},
+	{Async: []config.PipelineStep{{Step: "ocr"}, {Step: "thumbnails"}}},
+}
+
+var everythingPipeline *Pipeline
+
+func init() {
+	RegisterStep("normalize", withoutParams(newNormalizer))
+	RegisterStep("orient", withoutParams(func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		return &ImageOrienter{}, nil
+	}))
+	RegisterStep("compress", withoutParams(func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		if !canCompress(GetCapabilities(), file) {
+			return nil, nil
+		}
+		return &CompressLosslessly{}, nil
+	}))
+	RegisterStep("strip_exif", withoutParams(func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		if !GetCapabilities().Has("exiftool") {
+			return nil, nil
+		}
+		return &ExifStripper{}, nil
+	}))
+	RegisterStep("scale", newScaleStep)
+	RegisterStep("video", newVideoStep)
+	RegisterStep("ocr", withoutParams(func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		// tesseract only reads rasters
+		if file.IsSvg() || file.IsPdf() || file.IsVideo() {
+			return nil, nil
+		}
+		if ocr := availableOCR(GetCapabilities()); ocr != nil {
+			return ocr, nil
+		}
+		return nil, nil
+	}))
+	RegisterStep("thumbnails", withoutParams(func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		thumbs := asyncProcessType{}
+		for _, t := range file.GetThumbs() {
+			thumbs = append(thumbs, t)
+		}
+
+		if len(thumbs) == 0 {
+			return nil, nil
+		}
+		return thumbs, nil
+	}))
+
+	var err error
+	everythingPipeline, err = NewPipeline(everythingSteps)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func withoutParams(build StepBuilder) StepFactory {
+	return func(params map[string]interface{}) (StepBuilder, error) {
+		if len(params) > 0 {
+			return nil, &config.FieldError{Field: "Params", Message: "this step takes no params"}
+		}
+
+		return build, nil
+	}
+}
+
+// Scales uploads larger than the MaxBytes param down to it, which defaults to MaxFileSize.
+func newScaleStep(params map[string]interface{}) (StepBuilder, error) {
+	var maxBytes int64
+	for key, value := range params {
+		n, ok := value.(float64)
+		if key != "MaxBytes" || !ok || n <= 0 || n != float64(int64(n)) {
+			return nil, &config.FieldError{Field: "Params." + key, Message: "only MaxBytes, a positive integer, is supported"}
+		}
+		maxBytes = int64(n)
+	}
+
+	return func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		target := maxBytes
+		if target == 0 {
+			target = cfg.MaxFileSize
+		}
+
+		// Videos are limited to MaxVideoBytes before processing instead
+		if file.IsVideo() {
+			return nil, nil
+		}
+
+		size, err := file.FileSize()
+		if err != nil {
+			return nil, err
+		}
+
+		if size <= target {
+			return nil, nil
+		}
+		return &ImageScaler{target}, nil
+	}, nil
+}
+
+// Converts HEIC, HEIF, AVIF, BMP, TIFF and ICO uploads to the CanonicalFormat, which nothing after it could handle.
+// Without heif-convert HEIC, HEIF and AVIF are rejected rather than skipped.
+func newNormalizer(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+	if !file.IsHeif() && !file.IsLegacyRaster() {
+		return nil, nil
+	}
+
+	if file.IsHeif() && !GetCapabilities().Has(processorcommand.HEIF_CONVERT_COMMAND) {
+		return nil, fmt.Errorf("Unable to decode %s without %s", file.GetMime(), processorcommand.HEIF_CONVERT_COMMAND)
+	}
+
+	format := thumbType.JPG
+	if cfg.CanonicalFormat == "png" {
+		format = thumbType.PNG
+	}
+
+	return &Normalizer{format, cfg.KeepOriginalContainer, cfg.KeepTiffPages}, nil
+}
+
+// Converts animated GIFs to the video Formats param, which defaults to mp4. Skipped without ffmpeg and ffprobe.
+func newVideoStep(params map[string]interface{}) (StepBuilder, error) {
+	formats := []thumbType.ThumbType{thumbType.MP4}
+	for key, value := range params {
+		names, ok := value.([]interface{})
+		if key != "Formats" || !ok || len(names) == 0 {
+			return nil, &config.FieldError{Field: "Params." + key, Message: "only Formats, a list of mp4 and webm, is supported"}
+		}
+
+		formats = nil
+		for i, name := range names {
+			s, _ := name.(string)
+			format := thumbType.FromString(s)
+			if !format.IsVideo() {
+				return nil, &config.FieldError{Field: fmt.Sprintf("Params.Formats[%d]", i), Message: "must be mp4 or webm"}
+			}
+			formats = append(formats, format)
+		}
+	}
+
+	return func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (ProcessType, error) {
+		caps := GetCapabilities()
+		if !file.IsGif() || !caps.Has(processorcommand.FFMPEG_COMMAND) || !caps.Has(processorcommand.FFPROBE_COMMAND) {
+			return nil, nil
+		}
+		return &VideoConverter{formats}, nil
+	}, nil
+}
+
+// Pipeline is a list of steps built for each upload from the config.
+type Pipeline struct {
+	steps []pipelineStep
+}
+
+type pipelineStep struct {
+	when  *config.StepCondition
+	build StepBuilder
+	group []pipelineStep
+	async bool
+}
+
+// NewPipeline looks up the registered steps and checks their params.
+func NewPipeline(steps []config.PipelineStep) (*Pipeline, error) {
+	compiled, err := compileSteps(steps, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pipeline{compiled}, nil
+}
+
+// NewPipelines creates each of the config's Pipelines.
+func NewPipelines(pipelines config.PipelineMap) (map[string]*Pipeline, error) {
+	compiled := make(map[string]*Pipeline, len(pipelines))
+
+	for name, steps := range pipelines {
+		steps, err := compileSteps(steps, "Pipelines."+name)
+		if err != nil {
+			return nil, err
+		}
+
+		compiled[name] = &Pipeline{steps}
+	}
+
+	return compiled, nil
+}
+
+func compileSteps(steps []config.PipelineStep, path string) ([]pipelineStep, error) {
+	compiled := make([]pipelineStep, len(steps))
+
+	for i, step := range steps {
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+		compiled[i].when = step.When
+
+		var err error
+		switch {
+		case step.Step != "":
+			factory, ok := stepFactories[step.Step]
+			if !ok {
+				return nil, &config.FieldError{Field: stepPath + ".Step", Message: fmt.Sprintf("unknown step %q", step.Step)}
+			}
+
+			compiled[i].build, err = factory(step.Params)
+			if fieldErr, ok := err.(*config.FieldError); ok {
+				return nil, &config.FieldError{Field: stepPath + "." + fieldErr.Field, Message: fieldErr.Message}
+			}
+		case step.Async != nil:
+			compiled[i].async = true
+			compiled[i].group, err = compileSteps(step.Async, stepPath+".Async")
+		default:
+			compiled[i].group, err = compileSteps(step.Steps, stepPath+".Steps")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return compiled, nil
+}
+
+// Strategy builds the pipeline's steps that apply to each upload.
+func (this *Pipeline) Strategy() ImageProcessorStrategy {
+	return func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (*ImageProcessor, error) {
+		processors, err := buildSteps(cfg, file, this.steps, false, &stepInput{mime: file.GetMime()})
+		if err != nil {
+			return &ImageProcessor{}, err
+		}
+
+		return &ImageProcessor{multiProcessType(processors)}, nil
+	}
+}
+
+// What the conditions of the next steps see: the upload as received until a normalize step converts it.
+type stepInput struct {
+	mime       string
+	normalized bool
+}
+
+func buildSteps(cfg *config.Configuration, file *uploadedfile.UploadedFile, steps []pipelineStep, async bool, input *stepInput) ([]ProcessType, error) {
+	processors := []ProcessType{}
+
+	for _, step := range steps {
+		ok, err := matches(step.when, file, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		var processor ProcessType
+		if step.build != nil {
+			processor, err = step.build(cfg, file)
+		} else {
+			processor, err = buildGroup(cfg, file, step.group, step.async, input)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if processor == nil {
+			continue
+		}
+
+		if normalizer, ok := processor.(*Normalizer); ok {
+			input.mime = normalizer.format.ToMime()
+			input.normalized = true
+		}
+
+		// Async steps inside an async group just run alongside the rest
+		if children, ok := processor.(asyncProcessType); ok && async {
+			processors = append(processors, children...)
+			continue
+		}
+
+		processors = append(processors, processor)
+	}
+
+	return processors, nil
+}
+
+// A group is left out when none of its steps apply.
+func buildGroup(cfg *config.Configuration, file *uploadedfile.UploadedFile, steps []pipelineStep, async bool, input *stepInput) (ProcessType, error) {
+	processors, err := buildSteps(cfg, file, steps, async, input)
+	if err != nil || len(processors) == 0 {
+		return nil, err
+	}
+
+	if async {
+		return asyncProcessType(processors), nil
+	}
+
+	return multiProcessType(processors), nil
+}
+
+// Dimensions are only known for the rasters the upload can be read as, so a condition on them doesn't match PDFs,
+// videos or uploads that haven't been converted yet.
+func matches(when *config.StepCondition, file *uploadedfile.UploadedFile, input *stepInput) (bool, error) {
+	if when == nil {
+		return true, nil
+	}
+
+	if len(when.Mime) > 0 {
+		found := false
+		for _, mime := range when.Mime {
+			if mime == input.mime {
+				found = true
+			}
+		}
+
+		if !found {
+			return false, nil
+		}
+	}
+
+	if when.MinBytes > 0 || when.MaxBytes > 0 {
+		size, err := file.FileSize()
+		if err != nil {
+			return false, err
+		}
+
+		if !inRange(size, when.MinBytes, when.MaxBytes) {
+			return false, nil
+		}
+	}
+
+	if when.MinWidth > 0 || when.MaxWidth > 0 || when.MinHeight > 0 || when.MaxHeight > 0 {
+		if input.normalized || file.IsSvg() || file.IsPdf() || file.IsVideo() {
+			return false, nil
+		}
+
+		width, height, err := file.Dimensions()
+		if err != nil {
+			return false, nil
+		}
+
+		if !inRange(int64(width), int64(when.MinWidth), int64(when.MaxWidth)) || !inRange(int64(height), int64(when.MinHeight), int64(when.MaxHeight)) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// A zero min or max isn't checked.
+func inRange(n, min, max int64) bool {
+	return n >= min && (max == 0 || n <= max)
+}
@@ -0,0 +1,183 @@
+package processorcommand
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Dependency is an external program the processors run, with arguments that make it print its version and exit.
+type Dependency struct {
+	Command string
+	Args    []string
+	// Uploads can't be processed without a required program. Steps needing an optional one are skipped instead.
+	Required bool
+	// What is lost without it
+	Feature string
+}
+
+// Dependencies are the programs the image processors and OCR need on PATH.
+var Dependencies = []Dependency{
+	{Command: GM_COMMAND, Args: []string{"version"}, Required: true, Feature: "image processing"},
+	{Command: "tesseract", Args: []string{"--version"}, Feature: "OCR"},
+	{Command: "exiftool", Args: []string{"-ver"}, Feature: "EXIF stripping"},
+	{Command: "optipng", Args: []string{"-version"}, Feature: "PNG compression"},
+	{Command: "jpegtran", Args: []string{"-version"}, Feature: "JPEG compression"},
+	{Command: FFMPEG_COMMAND, Args: []string{"-version"}, Feature: "GIF to video conversion"},
+	{Command: FFPROBE_COMMAND, Args: []string{"-version"}, Feature: "GIF to video conversion"},
+	{Command: HEIF_CONVERT_COMMAND, Args: []string{"--version"}, Feature: "HEIC and AVIF uploads"},
+	{Command: HEIF_ENC_COMMAND, Args: []string{"--version"}, Feature: "AVIF thumbnails"},
+	{Command: GHOSTSCRIPT_COMMAND, Args: []string{"--version"}, Feature: "PDF uploads"},
+}
+
+// TesseractLanguages are the traineddata files the OCR commands use.
+var TesseractLanguages = []string{"eng", "meme"}
+
+var versionRegex = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// Check verifies the program is on PATH and runs.
+func (this Dependency) Check(ctx context.Context) error {
+	_, err := this.run(ctx)
+	return err
+}
+
+func (this Dependency) run(ctx context.Context) (string, error) {
+	path, err := exec.LookPath(this.Command)
+	if err != nil {
+		return "", fmt.Errorf("%s not found on PATH", this.Command)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, this.Args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Unable to run %s: %s", this.Command, err.Error())
+	}
+
+	return out.String(), nil
+}
+
+// Capability is what probing a Dependency found.
+type Capability struct {
+	Command   string   `json:"command"`
+	Feature   string   `json:"feature"`
+	Required  bool     `json:"required"`
+	Available bool     `json:"available"`
+	Version   string   `json:"version,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Capabilities are the probed dependencies by command. A nil Capabilities hasn't been probed, and assumes everything
+// is available.
+type Capabilities map[string]Capability
+
+// Probe runs each dependency to find out whether it is available and its version, and which languages tesseract has.
+func Probe(ctx context.Context) Capabilities {
+	caps := make(Capabilities, len(Dependencies))
+
+	for _, dep := range Dependencies {
+		capability := Capability{
+			Command:  dep.Command,
+			Feature:  dep.Feature,
+			Required: dep.Required,
+		}
+
+		out, err := dep.run(ctx)
+		if err != nil {
+			capability.Error = err.Error()
+		} else {
+			capability.Available = true
+			capability.Version = versionRegex.FindString(out)
+		}
+
+		caps[dep.Command] = capability
+	}
+
+	if tesseract := caps["tesseract"]; tesseract.Available {
+		langs, err := tesseractLanguages(ctx)
+		if err != nil {
+			tesseract.Error = err.Error()
+		}
+		tesseract.Languages = langs
+		caps["tesseract"] = tesseract
+	}
+
+	return caps
+}
+
+func (this Capabilities) Has(command string) bool {
+	if this == nil {
+		return true
+	}
+
+	return this[command].Available
+}
+
+// HasLanguage reports whether tesseract is available with the traineddata for lang.
+func (this Capabilities) HasLanguage(lang string) bool {
+	if this == nil {
+		return true
+	}
+
+	for _, l := range this["tesseract"].Languages {
+		if l == lang {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing returns the unavailable dependencies.
+func (this Capabilities) Missing() []Capability {
+	var missing []Capability
+	for _, dep := range Dependencies {
+		if capability, ok := this[dep.Command]; ok && !capability.Available {
+			missing = append(missing, capability)
+		}
+	}
+
+	return missing
+}
+
+func tesseractLanguages(ctx context.Context) ([]string, error) {
+	// Older versions of tesseract list languages on stderr, so both are read
+	out, err := Dependency{Command: "tesseract", Args: []string{"--list-langs"}}.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var langs []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		// Skip the "List of available languages (2):" header
+		if line == "" || strings.Contains(line, " ") {
+			continue
+		}
+		langs = append(langs, line)
+	}
+
+	return langs, nil
+}
+
+// CheckTesseractLanguage verifies tesseract has the traineddata for lang installed.
+func CheckTesseractLanguage(ctx context.Context, lang string) error {
+	langs, err := tesseractLanguages(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range langs {
+		if l == lang {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("tesseract has no %s traineddata", lang)
+}
@@ -0,0 +1,161 @@
+package processorcommand
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+)
+
+const (
+	FFMPEG_COMMAND  = "ffmpeg"
+	FFPROBE_COMMAND = "ffprobe"
+)
+
+// VideoInfo is the length of an animation or video, in seconds and frames, and its first video stream's codec and
+// size.
+type VideoInfo struct {
+	Duration float64
+	Frames   int
+	Codec    string
+	Width    int
+	Height   int
+}
+
+// ProbeVideo reads every frame to count them.
+func ProbeVideo(ctx context.Context, filename string) (*VideoInfo, error) {
+	return probeVideo(ctx, filename, true)
+}
+
+// ProbeVideoHeader is ProbeVideo without the frame count, which only reads the container, so it's cheap enough to check
+// an upload with before doing anything else.
+func ProbeVideoHeader(ctx context.Context, filename string) (*VideoInfo, error) {
+	return probeVideo(ctx, filename, false)
+}
+
+func probeVideo(ctx context.Context, filename string, countFrames bool) (*VideoInfo, error) {
+	args := []string{"-v", "error"}
+	if countFrames {
+		args = append(args, "-count_frames")
+	}
+	args = append(args,
+		"-select_streams",
+		"v:0",
+		"-show_entries",
+		"stream=nb_read_frames,codec_name,width,height:format=duration",
+		"-of",
+		"json",
+		filename,
+	)
+
+	out, err := runProcessorCommandOutput(ctx, FFPROBE_COMMAND, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var probed struct {
+		Streams []struct {
+			Frames string `json:"nb_read_frames"`
+			Codec  string `json:"codec_name"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal([]byte(out), &probed); err != nil {
+		return nil, fmt.Errorf("Unable to parse ffprobe output: %s", err.Error())
+	}
+
+	if len(probed.Streams) == 0 {
+		return nil, errors.New("No video stream found")
+	}
+
+	stream := probed.Streams[0]
+	info := &VideoInfo{Codec: stream.Codec, Width: stream.Width, Height: stream.Height}
+	info.Frames, _ = strconv.Atoi(stream.Frames)
+	info.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+
+	return info, nil
+}
+
+// PosterFrame writes the frame of a video at seconds as a PNG.
+func PosterFrame(ctx context.Context, filename, name string, seconds float64) (string, error) {
+	outfile := fmt.Sprintf("%s_%s_poster", filename, name)
+
+	args := []string{
+		"-y",
+		"-v",
+		"error",
+		"-ss",
+		strconv.FormatFloat(seconds, 'f', 3, 64),
+		"-i",
+		filename,
+		"-frames:v",
+		"1",
+		"-c:v",
+		"png",
+		"-f",
+		"image2",
+		outfile,
+	}
+
+	err := runProcessorCommand(ctx, FFMPEG_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	// ffmpeg succeeds without writing anything when seconds is past the end
+	if _, err := os.Stat(outfile); err != nil {
+		return "", fmt.Errorf("No frame at %.3f seconds", seconds)
+	}
+
+	return outfile, nil
+}
+
+// ToVideo converts an animation to H.264 MP4 or VP9 WebM, fitting it inside width x height if they're given.
+func ToVideo(ctx context.Context, filename, name string, width, height int, format thumbType.ThumbType) (string, error) {
+	outfile := fmt.Sprintf("%s_%s", filename, name)
+
+	// Both codecs need even dimensions
+	filter := "scale=trunc(iw/2)*2:trunc(ih/2)*2"
+	if width > 0 && height > 0 {
+		filter = fmt.Sprintf("scale=w=%d:h=%d:force_original_aspect_ratio=decrease,%s", width, height, filter)
+	}
+
+	args := []string{
+		"-y",
+		"-v",
+		"error",
+		"-i",
+		filename,
+		"-an",
+		"-vf",
+		filter,
+		"-pix_fmt",
+		"yuv420p",
+	}
+
+	switch format {
+	case thumbType.MP4:
+		args = append(args, "-c:v", "libx264", "-movflags", "+faststart", "-f", "mp4")
+	case thumbType.WEBM:
+		args = append(args, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "41", "-f", "webm")
+	default:
+		return "", fmt.Errorf("%s isn't a video format", format.ToString())
+	}
+
+	args = append(args, outfile)
+
+	err := runProcessorCommand(ctx, FFMPEG_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
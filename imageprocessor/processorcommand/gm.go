@@ -1,14 +1,16 @@
 package processorcommand
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/Imgur/mandible/imageprocessor/thumbType"
 )
 
 const GM_COMMAND = "gm"
 
-func ConvertToJpeg(filename string) (string, error) {
+func ConvertToJpeg(ctx context.Context, filename string) (string, error) {
 	outfile := fmt.Sprintf("%s_jpg", filename)
 
 	args := []string{
@@ -18,7 +20,7 @@ func ConvertToJpeg(filename string) (string, error) {
 		"JPEG:" + outfile,
 	}
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -26,7 +28,7 @@ func ConvertToJpeg(filename string) (string, error) {
 	return outfile, nil
 }
 
-func FixOrientation(filename string) (string, error) {
+func FixOrientation(ctx context.Context, filename string) (string, error) {
 	outfile := fmt.Sprintf("%s_ort", filename)
 
 	args := []string{
@@ -36,7 +38,7 @@ func FixOrientation(filename string) (string, error) {
 		outfile,
 	}
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -44,7 +46,7 @@ func FixOrientation(filename string) (string, error) {
 	return outfile, nil
 }
 
-func Quality(filename string, quality int) (string, error) {
+func Quality(ctx context.Context, filename string, quality int) (string, error) {
 	outfile := fmt.Sprintf("%s_q", filename)
 
 	args := []string{
@@ -57,7 +59,7 @@ func Quality(filename string, quality int) (string, error) {
 		outfile,
 	}
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -65,7 +67,7 @@ func Quality(filename string, quality int) (string, error) {
 	return outfile, nil
 }
 
-func ResizePercent(filename string, percent int) (string, error) {
+func ResizePercent(ctx context.Context, filename string, percent int) (string, error) {
 	outfile := fmt.Sprintf("%s_rp", filename)
 
 	args := []string{
@@ -76,7 +78,7 @@ func ResizePercent(filename string, percent int) (string, error) {
 		outfile,
 	}
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -84,23 +86,33 @@ func ResizePercent(filename string, percent int) (string, error) {
 	return outfile, nil
 }
 
-func SquareThumb(filename, name string, size int, quality int, format thumbType.ThumbType) (string, error) {
+// The input arguments for filename: its first frame, or every frame coalesced so they can be resized and cropped
+// alone.
+func inputFrames(filename string, animated bool) []string {
+	if animated {
+		return []string{filename, "-coalesce"}
+	}
+
+	return []string{fmt.Sprintf("%s[0]", filename)}
+}
+
+func SquareThumb(ctx context.Context, filename, name string, size int, quality int, format thumbType.ThumbType, animated bool) (string, error) {
 	outfile := fmt.Sprintf("%s_%s", filename, name)
 
-	args := []string{
-		"convert",
-		fmt.Sprintf("%s[0]", filename),
+	args := append([]string{"convert"}, inputFrames(filename, animated)...)
+	args = append(args,
 		"-resize",
 		fmt.Sprintf("%dx%d^", size, size),
 		"-gravity",
 		"center",
 		"-crop",
 		fmt.Sprintf("%dx%d+0+0", size, size),
+		"+page",
 		"-density",
 		"72x72",
 		"-unsharp",
 		"0.5",
-	}
+	)
 
 	if quality >= 0 {
 		args = append(args,
@@ -111,7 +123,7 @@ func SquareThumb(filename, name string, size int, quality int, format thumbType.
 
 	args = append(args, fmt.Sprintf("%s:%s", format.ToString(), outfile))
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -119,17 +131,16 @@ func SquareThumb(filename, name string, size int, quality int, format thumbType.
 	return outfile, nil
 }
 
-func Thumb(filename, name string, width, height int, quality int, format thumbType.ThumbType) (string, error) {
+func Thumb(ctx context.Context, filename, name string, width, height int, quality int, format thumbType.ThumbType, animated bool) (string, error) {
 	outfile := fmt.Sprintf("%s_%s", filename, name)
 
-	args := []string{
-		"convert",
-		fmt.Sprintf("%s[0]", filename),
+	args := append([]string{"convert"}, inputFrames(filename, animated)...)
+	args = append(args,
 		"-resize",
 		fmt.Sprintf("%dx%d>", width, height),
 		"-density",
 		"72x72",
-	}
+	)
 
 	if quality >= 0 {
 		args = append(args,
@@ -140,7 +151,7 @@ func Thumb(filename, name string, width, height int, quality int, format thumbTy
 
 	args = append(args, fmt.Sprintf("%s:%s", format.ToString(), outfile))
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -148,10 +159,10 @@ func Thumb(filename, name string, width, height int, quality int, format thumbTy
 	return outfile, nil
 }
 
-func CircleThumb(filename, name string, width int, quality int, format thumbType.ThumbType) (string, error) {
+func CircleThumb(ctx context.Context, filename, name string, width int, quality int, format thumbType.ThumbType) (string, error) {
 	outfile := fmt.Sprintf("%s_%s", filename, name)
 
-	filename, err := SquareThumb(filename, name, width, quality, format)
+	filename, err := SquareThumb(ctx, filename, name, width, quality, format, false)
 	if err != nil {
 		return "", err
 	}
@@ -180,7 +191,7 @@ func CircleThumb(filename, name string, width int, quality int, format thumbType
 
 	args = append(args, fmt.Sprintf("PNG:%s", outfile))
 
-	err = runProcessorCommand(GM_COMMAND, args)
+	err = runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -188,17 +199,16 @@ func CircleThumb(filename, name string, width int, quality int, format thumbType
 	return outfile, nil
 }
 
-func CustomThumb(filename, name string, width, height int, cropGravity string, cropWidth, cropHeight, quality int, format thumbType.ThumbType) (string, error) {
+func CustomThumb(ctx context.Context, filename, name string, width, height int, cropGravity string, cropWidth, cropHeight, quality int, format thumbType.ThumbType, animated bool) (string, error) {
 	outfile := fmt.Sprintf("%s_%s", filename, name)
 
-	args := []string{
-		"convert",
-		fmt.Sprintf("%s[0]", filename),
+	args := append([]string{"convert"}, inputFrames(filename, animated)...)
+	args = append(args,
 		"-resize",
 		fmt.Sprintf("%dx%d^", width, height),
 		"-density",
 		"72x72",
-	}
+	)
 
 	if quality != -1 {
 		args = append(args,
@@ -213,11 +223,12 @@ func CustomThumb(filename, name string, width, height int, cropGravity string, c
 			fmt.Sprintf("%s", cropGravity),
 			"-crop",
 			fmt.Sprintf("%dx%d+0+0", cropWidth, cropHeight),
+			"+page",
 		)
 	}
 
 	args = append(args, fmt.Sprintf("%s:%s", format.ToString(), outfile))
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
@@ -225,15 +236,14 @@ func CustomThumb(filename, name string, width, height int, cropGravity string, c
 	return outfile, nil
 }
 
-func Full(filename string, name string, quality int, format thumbType.ThumbType) (string, error) {
+func Full(ctx context.Context, filename string, name string, quality int, format thumbType.ThumbType, animated bool) (string, error) {
 	outfile := fmt.Sprintf("%s_%s", filename, name)
 
-	args := []string{
-		"convert",
-		fmt.Sprintf("%s[0]", filename),
+	args := append([]string{"convert"}, inputFrames(filename, animated)...)
+	args = append(args,
 		"-density",
 		"72x72",
-	}
+	)
 
 	if quality >= 0 {
 		args = append(args,
@@ -244,7 +254,86 @@ func Full(filename string, name string, quality int, format thumbType.ThumbType)
 
 	args = append(args, fmt.Sprintf("%s:%s", format.ToString(), outfile))
 
-	err := runProcessorCommand(GM_COMMAND, args)
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
+
+// Coalesce expands every frame of an animation to the full canvas, so frames can be dropped or resized alone.
+func Coalesce(ctx context.Context, filename string) (string, error) {
+	outfile := fmt.Sprintf("%s_co", filename)
+
+	args := []string{
+		"convert",
+		filename,
+		"-coalesce",
+		outfile,
+	}
+
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
+
+func ReduceColors(ctx context.Context, filename string, colors int) (string, error) {
+	outfile := fmt.Sprintf("%s_rc", filename)
+
+	args := []string{
+		"convert",
+		filename,
+		"+dither",
+		"-colors",
+		fmt.Sprintf("%d", colors),
+		outfile,
+	}
+
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
+
+// PageCount is how many pages or frames an image has, i.e. in a multi-page TIFF.
+func PageCount(ctx context.Context, filename string) (int, error) {
+	args := []string{
+		"identify",
+		"-format",
+		"%p\n",
+		filename,
+	}
+
+	out, err := runProcessorCommandOutput(ctx, GM_COMMAND, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(strings.Fields(out)), nil
+}
+
+// ConvertPage writes one page of an image as format. JPEGs are flattened since they have no transparency.
+func ConvertPage(ctx context.Context, filename string, page int, format thumbType.ThumbType) (string, error) {
+	outfile := fmt.Sprintf("%s_p%d", filename, page)
+
+	args := []string{
+		"convert",
+		fmt.Sprintf("%s[%d]", filename, page),
+	}
+
+	if format == thumbType.JPG {
+		args = append(args, "-flatten")
+	}
+
+	args = append(args, fmt.Sprintf("%s:%s", format.ToString(), outfile))
+
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
 	if err != nil {
 		return "", err
 	}
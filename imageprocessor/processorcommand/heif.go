@@ -0,0 +1,53 @@
+package processorcommand
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+)
+
+const (
+	HEIF_CONVERT_COMMAND = "heif-convert"
+	HEIF_ENC_COMMAND     = "heif-enc"
+)
+
+// HeifConvert decodes a HEIC, HEIF or AVIF to JPEG or PNG. heif-convert picks the output format from the extension.
+func HeifConvert(ctx context.Context, filename string, format thumbType.ThumbType) (string, error) {
+	outfile := fmt.Sprintf("%s_heif.%s", filename, strings.ToLower(format.ToString()))
+
+	args := []string{}
+	if format == thumbType.JPG {
+		args = append(args, "-q", "95")
+	}
+	args = append(args, filename, outfile)
+
+	err := runProcessorCommand(ctx, HEIF_CONVERT_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
+
+// AvifEncode encodes a JPEG or PNG as AVIF.
+func AvifEncode(ctx context.Context, filename string, quality int) (string, error) {
+	outfile := fmt.Sprintf("%s_avif", filename)
+
+	args := []string{
+		"--avif",
+		"-q",
+		fmt.Sprintf("%d", quality),
+		"-o",
+		outfile,
+		filename,
+	}
+
+	err := runProcessorCommand(ctx, HEIF_ENC_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
@@ -1,10 +1,11 @@
 package processorcommand
 
 import (
+	"context"
 	"fmt"
 )
 
-func Jpegtran(filename string) (string, error) {
+func Jpegtran(ctx context.Context, filename string) (string, error) {
 	outfile := fmt.Sprintf("%s_opti", filename)
 
 	args := []string{
@@ -16,7 +17,7 @@ func Jpegtran(filename string) (string, error) {
 		filename,
 	}
 
-	err := runProcessorCommand("jpegtran", args)
+	err := runProcessorCommand(ctx, "jpegtran", args)
 	if err != nil {
 		return "", err
 	}
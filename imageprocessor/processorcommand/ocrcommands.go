@@ -1,6 +1,7 @@
 package processorcommand
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,8 @@ import (
 	"strings"
 
 	"github.com/trustmaster/go-aspell"
+
+	"github.com/Imgur/mandible/logging"
 )
 
 type OCRResult struct {
@@ -23,14 +26,14 @@ func newOCRResult(ocrType string, result string) *OCRResult {
 	}
 }
 
-func (this *OCRResult) removeNonWords() {
+func (this *OCRResult) removeNonWords(ctx context.Context) {
 	blob := this.Text
 
 	speller, err := aspell.NewSpeller(map[string]string{
 		"lang": "en_US",
 	})
 	if err != nil {
-		fmt.Printf("Error: %s", err.Error())
+		logging.FromContext(ctx).Warn("Unable to start aspell, keeping all words", "error", err)
 		return
 	}
 	defer speller.Delete()
@@ -74,13 +77,13 @@ func (this *OCRResult) wordCount(blob string) int {
 
 type MultiOCRCommand []OCRCommand
 
-func (this MultiOCRCommand) Run(image string) (*OCRResult, error) {
+func (this MultiOCRCommand) Run(ctx context.Context, image string) (*OCRResult, error) {
 	results := make(chan *OCRResult, len(this))
 	errs := make(chan error, len(this))
 
 	for _, command := range this {
 		go func(c OCRCommand) {
-			k, err := c.Run(image)
+			k, err := c.Run(ctx, image)
 			if err != nil {
 				errs <- err
 				return
@@ -95,7 +98,7 @@ func (this MultiOCRCommand) Run(image string) (*OCRResult, error) {
 	for i := 0; i < len(this); i++ {
 		select {
 		case result := <-results:
-			result.removeNonWords()
+			result.removeNonWords(ctx)
 			count := result.wordCount(result.Text)
 
 			if count > max {
@@ -113,7 +116,7 @@ func (this MultiOCRCommand) Run(image string) (*OCRResult, error) {
 }
 
 type OCRCommand interface {
-	Run(image string) (*OCRResult, error)
+	Run(ctx context.Context, image string) (*OCRResult, error)
 }
 
 type MemeOCR struct {
@@ -126,20 +129,20 @@ func NewMemeOCR() *MemeOCR {
 	}
 }
 
-func (this *MemeOCR) Run(image string) (*OCRResult, error) {
+func (this *MemeOCR) Run(ctx context.Context, image string) (*OCRResult, error) {
 	imageTif := fmt.Sprintf("%s_meme.jpg", image)
 	outText := fmt.Sprintf("%s_meme", image)
 	inImage := fmt.Sprintf("%s[0]", image)
 	preprocessingArgs := []string{"convert", inImage, "-resize", "400%", "-fill", "black", "-fuzz", "10%", "+matte", "-matte", "-transparent", "white", imageTif}
 	tesseractArgs := []string{"-l", "meme", imageTif, outText}
 
-	err := runProcessorCommand(GM_COMMAND, preprocessingArgs)
+	err := runProcessorCommand(ctx, GM_COMMAND, preprocessingArgs)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Meme preprocessing command failed with error = %v", err))
 	}
 	defer os.Remove(imageTif)
 
-	err = runProcessorCommand("tesseract", tesseractArgs)
+	err = runProcessorCommand(ctx, "tesseract", tesseractArgs)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Meme tesseract command failed with error = %v", err))
 	}
@@ -165,20 +168,20 @@ func NewStandardOCR() *StandardOCR {
 	}
 }
 
-func (this *StandardOCR) Run(image string) (*OCRResult, error) {
+func (this *StandardOCR) Run(ctx context.Context, image string) (*OCRResult, error) {
 	imageTif := fmt.Sprintf("%s_standard.jpg", image)
 	outText := fmt.Sprintf("%s_standard", image)
 	inImage := fmt.Sprintf("%s[0]", image)
 	preprocessingArgs := []string{"convert", inImage, "-resize", "400%", "-type", "Grayscale", imageTif}
 	tesseractArgs := []string{"-l", "eng", imageTif, outText}
 
-	err := runProcessorCommand(GM_COMMAND, preprocessingArgs)
+	err := runProcessorCommand(ctx, GM_COMMAND, preprocessingArgs)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Standard preprocessing command failed with error = %v", err))
 	}
 	defer os.Remove(imageTif)
 
-	err = runProcessorCommand("tesseract", tesseractArgs)
+	err = runProcessorCommand(ctx, "tesseract", tesseractArgs)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Standard tesseract command failed with error = %v", err))
 	}
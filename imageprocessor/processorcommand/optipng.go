@@ -1,10 +1,11 @@
 package processorcommand
 
 import (
+	"context"
 	"fmt"
 )
 
-func Optipng(filename string) (string, error) {
+func Optipng(ctx context.Context, filename string) (string, error) {
 	outfile := fmt.Sprintf("%s_opi", filename)
 
 	args := []string{
@@ -14,7 +15,7 @@ func Optipng(filename string) (string, error) {
 		filename,
 	}
 
-	err := runProcessorCommand("optipng", args)
+	err := runProcessorCommand(ctx, "optipng", args)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,81 @@
+package processorcommand
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// gm reads PDFs with ghostscript
+const GHOSTSCRIPT_COMMAND = "gs"
+
+// PageSize is the size in pixels of a page rasterized at some density.
+type PageSize struct {
+	Width  int
+	Height int
+}
+
+// PdfPageSizes is the size of pages first to last of a PDF, counting from 1, rasterized at density dots per inch.
+// Only those pages are read, so it's short when the PDF has fewer, and empty when it has none of them.
+func PdfPageSizes(ctx context.Context, filename string, density, first, last int) ([]PageSize, error) {
+	args := []string{
+		"identify",
+		"-density",
+		strconv.Itoa(density),
+		"-format",
+		"%w %h\n",
+		fmt.Sprintf("%s[%d-%d]", filename, first-1, last-1),
+	}
+
+	out, err := runProcessorCommandOutput(ctx, GM_COMMAND, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []PageSize
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unexpected gm identify output: %q", line)
+		}
+
+		width, werr := strconv.Atoi(fields[0])
+		height, herr := strconv.Atoi(fields[1])
+		if werr != nil || herr != nil {
+			return nil, fmt.Errorf("Unexpected gm identify output: %q", line)
+		}
+
+		pages = append(pages, PageSize{width, height})
+	}
+
+	return pages, nil
+}
+
+// RasterizePage renders page, counting from 1, of a PDF as a PNG at density dots per inch. Pages are flattened onto
+// white, PDFs are drawn on paper. name keeps the pages of thumbnails made at once apart.
+func RasterizePage(ctx context.Context, filename, name string, page, density int) (string, error) {
+	outfile := fmt.Sprintf("%s_%s_page%d", filename, name, page)
+
+	args := []string{
+		"convert",
+		"-density",
+		strconv.Itoa(density),
+		fmt.Sprintf("%s[%d]", filename, page-1),
+		"-background",
+		"white",
+		"-flatten",
+		fmt.Sprintf("PNG:%s", outfile),
+	}
+
+	err := runProcessorCommand(ctx, GM_COMMAND, args)
+	if err != nil {
+		return "", err
+	}
+
+	return outfile, nil
+}
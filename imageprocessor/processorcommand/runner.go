@@ -2,13 +2,63 @@ package processorcommand
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"log"
 	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/tracing"
+)
+
+// CommandObserver is told the duration and result of every external command that is run.
+type CommandObserver func(command string, elapsed time.Duration, err error)
+
+var (
+	commandObserver   CommandObserver
+	commandObserverMu sync.RWMutex
 )
 
-func runProcessorCommand(command string, args []string) error {
+// SetCommandObserver registers a function that is called after every command, i.e. to record timings.
+func SetCommandObserver(observer CommandObserver) {
+	commandObserverMu.Lock()
+	commandObserver = observer
+	commandObserverMu.Unlock()
+}
+
+// Runs command with a timeout, recording a span with its arguments and exit code.
+func runProcessorCommand(ctx context.Context, command string, args []string) error {
+	_, err := runProcessorCommandOutput(ctx, command, args)
+	return err
+}
+
+// runProcessorCommand, returning what the command wrote to stdout.
+func runProcessorCommandOutput(ctx context.Context, command string, args []string) (string, error) {
+	_, span := tracing.StartSpan(ctx, command)
+	span.SetAttribute("command.args", strings.Join(args, " "))
+	defer span.End()
+
+	start := time.Now()
+	code, out, err := runCommand(ctx, command, args)
+	span.SetAttribute("command.exit_code", code)
+	span.SetError(err)
+
+	commandObserverMu.RLock()
+	observer := commandObserver
+	commandObserverMu.RUnlock()
+
+	if observer != nil {
+		observer(command, time.Since(start), err)
+	}
+
+	return out, err
+}
+
+// Returns the command's exit code, or -1 if it didn't exit normally, and its stdout.
+func runCommand(ctx context.Context, command string, args []string) (int, string, error) {
 	cmd := exec.Command(command, args...)
 
 	var out bytes.Buffer
@@ -25,20 +75,32 @@ func runProcessorCommand(command string, args []string) error {
 
 	select {
 	case <-time.After(time.Duration(60) * time.Second):
-		killCmd(cmd)
+		killCmd(ctx, cmd)
 		<-cmdDone
-		return errors.New("Command timed out")
+		return -1, "", errors.New("Command timed out")
 	case err := <-cmdDone:
 		if err != nil {
-			log.Println(stderr.String())
+			logging.FromContext(ctx).Warn("Command failed", "command", command, "error", err, "stderr", stderr.String())
 		}
 
-		return err
+		return exitCode(cmd), out.String(), err
+	}
+}
+
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return -1
 	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+
+	return -1
 }
 
-func killCmd(cmd *exec.Cmd) {
+func killCmd(ctx context.Context, cmd *exec.Cmd) {
 	if err := cmd.Process.Kill(); err != nil {
-		log.Printf("Failed to kill command: %v", err)
+		logging.FromContext(ctx).Error("Failed to kill command", "command", cmd.Path, "error", err)
 	}
 }
@@ -1,6 +1,8 @@
 package processorcommand
 
-func StripMetadata(filename string) error {
+import "context"
+
+func StripMetadata(ctx context.Context, filename string) error {
 	args := []string{
 		"-all=",
 		"--icc_profile:all",
@@ -8,7 +10,7 @@ func StripMetadata(filename string) error {
 		filename,
 	}
 
-	err := runProcessorCommand("exiftool", args)
+	err := runProcessorCommand(ctx, "exiftool", args)
 	if err != nil {
 		return err
 	}
@@ -8,6 +8,9 @@ const (
 	PNG
 	GIF
 	WEBP
+	MP4
+	WEBM
+	AVIF
 )
 
 func (this ThumbType) ToString() string {
@@ -20,11 +23,43 @@ func (this ThumbType) ToString() string {
 		return "GIF"
 	case WEBP:
 		return "WEBP"
+	case MP4:
+		return "MP4"
+	case WEBM:
+		return "WEBM"
+	case AVIF:
+		return "AVIF"
 	default:
 		return "UNKNOWN"
 	}
 }
 
+func (this ThumbType) ToMime() string {
+	switch this {
+	case JPG:
+		return "image/jpeg"
+	case PNG:
+		return "image/png"
+	case GIF:
+		return "image/gif"
+	case WEBP:
+		return "image/webp"
+	case MP4:
+		return "video/mp4"
+	case WEBM:
+		return "video/webm"
+	case AVIF:
+		return "image/avif"
+	default:
+		return ""
+	}
+}
+
+// Video formats are made by ffmpeg rather than gm.
+func (this ThumbType) IsVideo() bool {
+	return this == MP4 || this == WEBM
+}
+
 func FromMime(mime string) ThumbType {
 	switch mime {
 	case "image/jpeg":
@@ -35,6 +70,12 @@ func FromMime(mime string) ThumbType {
 		return GIF
 	case "image/webp":
 		return WEBP
+	case "video/mp4":
+		return MP4
+	case "video/webm":
+		return WEBM
+	case "image/avif":
+		return AVIF
 	default:
 		return UNKNOWN
 	}
@@ -52,6 +93,12 @@ func FromString(format string) ThumbType {
 		return GIF
 	case "webp":
 		return WEBP
+	case "mp4":
+		return MP4
+	case "webm":
+		return WEBM
+	case "avif":
+		return AVIF
 	default:
 		return UNKNOWN
 	}
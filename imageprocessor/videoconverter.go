@@ -0,0 +1,48 @@
+package imageprocessor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/imageprocessor/thumbType"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+// Converts animated GIFs to each of formats, adding the videos to the upload as renditions. Still GIFs are left
+// alone.
+type VideoConverter struct {
+	formats []thumbType.ThumbType
+}
+
+func (this *VideoConverter) Process(ctx context.Context, image *uploadedfile.UploadedFile) error {
+	if !image.IsGif() {
+		return nil
+	}
+
+	info, err := processorcommand.ProbeVideo(ctx, image.GetPath())
+	if err != nil {
+		return err
+	}
+
+	if info.Frames < 2 {
+		return nil
+	}
+
+	for _, format := range this.formats {
+		name := strings.ToLower(format.ToString())
+
+		filename, err := processorcommand.ToVideo(ctx, image.GetPath(), name, 0, 0, format)
+		if err != nil {
+			return err
+		}
+
+		image.AddRendition(uploadedfile.NewRendition(name, format.ToMime(), filename, info.Duration, info.Frames))
+	}
+
+	return nil
+}
+
+func (this *VideoConverter) String() string {
+	return "Video converter"
+}
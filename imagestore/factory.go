@@ -1,8 +1,10 @@
 package imagestore
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"time"
 
 	"github.com/Imgur/mandible/config"
 	"github.com/mitchellh/goamz/aws"
@@ -14,100 +16,161 @@ import (
 	gcs "google.golang.org/cloud/storage"
 )
 
+// StoreBuilder creates an ImageStore from the typed config registered alongside it.
+type StoreBuilder func(factory *Factory, conf config.StoreConfig) (ImageStore, error)
+
+var storeBuilders = make(map[string]StoreBuilder)
+
+// RegisterStore makes a store type available in the Stores array of the config file. newConfig returns an empty
+// typed config for the JSON entry to be decoded into, and build turns the decoded config into an ImageStore.
+func RegisterStore(name string, newConfig config.StoreConfigFactory, build StoreBuilder) {
+	config.RegisterStoreType(name, newConfig)
+	storeBuilders[name] = build
+}
+
+func init() {
+	RegisterStore("s3", func() config.StoreConfig { return &S3StoreConfig{} }, func(f *Factory, c config.StoreConfig) (ImageStore, error) {
+		return f.NewS3ImageStore(c.(*S3StoreConfig))
+	})
+	RegisterStore("gcs", func() config.StoreConfig { return &GCSStoreConfig{} }, func(f *Factory, c config.StoreConfig) (ImageStore, error) {
+		return f.NewGCSImageStore(c.(*GCSStoreConfig))
+	})
+	RegisterStore("local", func() config.StoreConfig { return &LocalStoreConfig{} }, func(f *Factory, c config.StoreConfig) (ImageStore, error) {
+		return f.NewLocalImageStore(c.(*LocalStoreConfig))
+	})
+	RegisterStore("memory", func() config.StoreConfig { return &MemoryStoreConfig{} }, func(f *Factory, c config.StoreConfig) (ImageStore, error) {
+		return NewInMemoryImageStore(), nil
+	})
+}
+
+// The NamePathRegex and NamePathMap fields shared by stores that use a NamePathMapper.
+type NamePathConfig struct {
+	NamePathRegex string
+	NamePathMap   string
+}
+
+func (this NamePathConfig) validate() error {
+	if err := config.RequireString("NamePathMap", this.NamePathMap); err != nil {
+		return err
+	}
+
+	_, err := this.newMapper()
+	return err
+}
+
+func (this NamePathConfig) newMapper() (*NamePathMapper, error) {
+	return NewNamePathMapper(this.NamePathRegex, this.NamePathMap)
+}
+
 type Factory struct {
-	conf *config.Configuration
+	conf     *config.Configuration
+	observer StoreObserver
 }
 
 func NewFactory(conf *config.Configuration) *Factory {
-	return &Factory{conf}
+	return &Factory{conf: conf}
+}
+
+// SetObserver reports the timing of every operation on the stores created by NewImageStores.
+func (this *Factory) SetObserver(observer StoreObserver) {
+	this.observer = observer
 }
 
-func (this *Factory) NewImageStores() ImageStore {
+func (this *Factory) NewImageStores() (ImageStore, error) {
 	stores := MultiImageStore{}
 	var store ImageStore
 
-	for _, configWrapper := range this.conf.Stores {
-		switch configWrapper["Type"] {
-		case "s3":
-			store = this.NewS3ImageStore(configWrapper)
-			stores = append(stores, store)
-		case "gcs":
-			store = this.NewGCSImageStore(configWrapper)
-			stores = append(stores, store)
-		case "local":
-			store = this.NewLocalImageStore(configWrapper)
-			stores = append(stores, store)
-		case "memory":
-			store = NewInMemoryImageStore()
-			stores = append(stores, store)
-		default:
-			log.Fatalf("Unsupported store %s", configWrapper["Type"])
+	if len(this.conf.Stores) == 0 {
+		return nil, errors.New("No stores configured")
+	}
+
+	for i, storeConf := range this.conf.Stores {
+		build, ok := storeBuilders[storeConf.StoreType()]
+		if !ok {
+			return nil, fmt.Errorf("Stores[%d]: unsupported store %s", i, storeConf.StoreType())
+		}
+
+		var err error
+		store, err = build(this, storeConf)
+		if err != nil {
+			return nil, fmt.Errorf("Stores[%d]: error creating %s store: %s", i, storeConf.StoreType(), err.Error())
 		}
+
+		store = NewObservedImageStore(store, storeConf.StoreType(), this.observer)
+
+		stores = append(stores, store)
 	}
 
 	if len(this.conf.Stores) == 1 {
-		return store
+		return store, nil
 	}
 
 	// return a MultiImageStore type if more then 1 store was specified in the config
-	return stores
+	return stores, nil
 }
 
-func (this *Factory) NewS3ImageStore(conf map[string]string) ImageStore {
-	bucket := conf["BucketName"]
-
-	auth, err := aws.GetAuth(conf["AWSKey"], conf["AWSSecret"])
+func (this *Factory) NewS3ImageStore(conf *S3StoreConfig) (ImageStore, error) {
+	auth, err := aws.GetAuth(conf.AWSKey, conf.AWSSecret)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	client := s3.New(auth, aws.Regions[conf["Region"]])
-	mapper := NewNamePathMapper(conf["NamePathRegex"], conf["NamePathMap"])
+	client := s3.New(auth, aws.Regions[conf.Region])
+	mapper, err := conf.newMapper()
+	if err != nil {
+		return nil, err
+	}
 
 	return NewS3ImageStore(
-		bucket,
-		conf["StoreRoot"],
+		conf.BucketName,
+		conf.StoreRoot,
 		client,
 		mapper,
-	)
+	), nil
 }
 
-func (this *Factory) NewGCSImageStore(conf map[string]string) ImageStore {
-	jsonKey, err := ioutil.ReadFile(conf["KeyFile"])
+func (this *Factory) NewGCSImageStore(conf *GCSStoreConfig) (ImageStore, error) {
+	jsonKey, err := ioutil.ReadFile(conf.KeyFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	cloudConf, err := google.JWTConfigFromJSON(
 		jsonKey,
 		gcs.ScopeFullControl,
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	bucket := conf["BucketName"]
-
-	ctx := gcloud.NewContext(conf["AppID"], cloudConf.Client(oauth2.NoContext))
-	mapper := NewNamePathMapper(conf["NamePathRegex"], conf["NamePathMap"])
+	ctx := gcloud.NewContext(conf.AppID, cloudConf.Client(oauth2.NoContext))
+	mapper, err := conf.newMapper()
+	if err != nil {
+		return nil, err
+	}
 
 	return NewGCSImageStore(
 		ctx,
-		bucket,
-		conf["StoreRoot"],
+		conf.BucketName,
+		conf.StoreRoot,
 		mapper,
-	)
+	), nil
 }
 
-func (this *Factory) NewLocalImageStore(conf map[string]string) ImageStore {
-	mapper := NewNamePathMapper(conf["NamePathRegex"], conf["NamePathMap"])
-	return NewLocalImageStore(conf["StoreRoot"], mapper)
+func (this *Factory) NewLocalImageStore(conf *LocalStoreConfig) (ImageStore, error) {
+	mapper, err := conf.newMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLocalImageStore(conf.StoreRoot, mapper), nil
 }
 
 func (this *Factory) NewStoreObject(id string, mime string, size string) *StoreObject {
 	return &StoreObject{
-		Id:       id,
-		MimeType: mime,
-		Size:     size,
+		Id:        id,
+		MimeType:  mime,
+		Size:      size,
+		CreatedAt: time.Now(),
 	}
 }
 
@@ -116,6 +179,7 @@ func (this *Factory) NewHashGenerator(store ImageStore) *HashGenerator {
 		make(chan string),
 		this.conf.HashLength,
 		store,
+		make(chan struct{}),
 	}
 
 	hashGen.init()
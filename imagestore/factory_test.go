@@ -0,0 +1,30 @@
+package imagestore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Imgur/mandible/config"
+)
+
+func TestShippedConfigsLoadOnceTheirBucketsAreSet(t *testing.T) {
+	if _, err := config.LoadConfiguration("../config/default.conf.json", nil); err == nil || !strings.Contains(err.Error(), "Stores[0].BucketName") {
+		t.Fatalf("Expected the default config to need a bucket, instead %v", err)
+	}
+
+	cfg, err := config.LoadConfiguration("../config/default.conf.json", []string{"MANDIBLE_STORES_0_BUCKET_NAME=images"})
+	if err != nil {
+		t.Fatalf("Unexpected error loading the default config: %s", err.Error())
+	}
+	if len(cfg.Stores) != 1 || cfg.Stores[0].StoreType() != "s3" {
+		t.Fatalf("Expected the default config to have a single s3 store, instead %v", cfg.Stores)
+	}
+
+	cfg, err = config.LoadConfiguration("../config/example.conf.json", []string{"MANDIBLE_STORES_0_BUCKET_NAME=images", "MANDIBLE_STORES_1_BUCKET_NAME=images", "MANDIBLE_STORES_1_APP_ID=app"})
+	if err != nil {
+		t.Fatalf("Unexpected error loading the example config: %s", err.Error())
+	}
+	if len(cfg.Stores) != 3 {
+		t.Fatalf("Expected the example config to have a store of each type, instead %v", cfg.Stores)
+	}
+}
@@ -3,32 +3,105 @@ package imagestore
 import (
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/logging"
 	"golang.org/x/net/context"
 	"google.golang.org/cloud/storage"
 )
 
+type GCSStoreConfig struct {
+	BucketName string
+	StoreRoot  string
+	AppID      string
+	KeyFile    string
+	NamePathConfig
+}
+
+func (this *GCSStoreConfig) StoreType() string {
+	return "gcs"
+}
+
+func (this *GCSStoreConfig) Validate() error {
+	if err := config.RequireString("BucketName", this.BucketName); err != nil {
+		return err
+	}
+
+	if err := config.RequireString("AppID", this.AppID); err != nil {
+		return err
+	}
+
+	if err := config.RequireString("KeyFile", this.KeyFile); err != nil {
+		return err
+	}
+
+	return this.NamePathConfig.validate()
+}
+
 type GCSImageStore struct {
 	ctx            context.Context
 	bucketName     string
 	storeRoot      string
 	namePathMapper *NamePathMapper
+	index          *pathIndex
 }
 
 func NewGCSImageStore(ctx context.Context, bucket string, root string, mapper *NamePathMapper) *GCSImageStore {
-	return &GCSImageStore{
+	store := &GCSImageStore{
 		ctx:            ctx,
 		bucketName:     bucket,
 		storeRoot:      root,
 		namePathMapper: mapper,
 	}
+
+	prefix := ""
+	if root != "" {
+		prefix = root + "/"
+	}
+
+	store.index = &pathIndex{
+		mapper: mapper,
+		prefix: prefix,
+		read: func(path string) ([]byte, error) {
+			reader, err := storage.NewReader(ctx, bucket, path)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+
+			return ioutil.ReadAll(reader)
+		},
+		write: func(path string, data []byte) error {
+			wc := storage.NewWriter(ctx, bucket, path)
+			wc.ContentType = "text/plain"
+			if _, err := wc.Write(data); err != nil {
+				wc.Close()
+				return err
+			}
+
+			return wc.Close()
+		},
+		notFound: func(err error) bool {
+			return err == storage.ErrObjectNotExist
+		},
+	}
+
+	return store
 }
 
 func (this *GCSImageStore) Exists(obj *StoreObject) (bool, error) {
-	_, err := storage.StatObject(this.ctx, this.bucketName, this.toPath(obj))
-	if err != nil {
+	path, err := this.index.lookup(obj)
+	if err == errNotIndexed {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = storage.StatObject(this.ctx, this.bucketName, path)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 	return true, nil
@@ -43,29 +116,44 @@ func (this *GCSImageStore) Save(src string, obj *StoreObject) (*StoreObject, err
 
 	data, err := ioutil.ReadAll(srcFd)
 	if err != nil {
-		log.Printf("error on read file: %s", err)
+		logging.FromContext(obj.Context()).Error("GCS error on read file", "error", err)
 		return nil, err
 	}
 
-	wc := storage.NewWriter(this.ctx, this.bucketName, this.toPath(obj))
+	path := this.index.savePath(obj)
+	wc := storage.NewWriter(this.ctx, this.bucketName, path)
 	wc.ContentType = obj.MimeType
 	if _, err := wc.Write(data); err != nil {
-		log.Printf("error on write data: %s", err)
+		logging.FromContext(obj.Context()).Error("GCS error on write data", "error", err)
 		return nil, err
 	}
 	if err := wc.Close(); err != nil {
-		log.Printf("error on close writer: %s", err)
+		logging.FromContext(obj.Context()).Error("GCS error on close writer", "error", err)
 		return nil, err
 	}
 
-	obj.Url = "https://storage.googleapis.com/" + this.bucketName + "/" + this.toPath(obj)
+	if err := this.index.record(obj, path); err != nil {
+		logging.FromContext(obj.Context()).Error("GCS error on write path index", "error", err)
+		return nil, err
+	}
+
+	obj.Url = this.URL(obj)
 	return obj, nil
 }
 
+func (this *GCSImageStore) URL(obj *StoreObject) string {
+	return "https://storage.googleapis.com/" + this.bucketName + "/" + this.index.savePath(obj)
+}
+
 func (this *GCSImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
-	reader, err := storage.NewReader(this.ctx, this.bucketName, this.toPath(obj))
+	path, err := this.index.lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := storage.NewReader(this.ctx, this.bucketName, path)
 	if err != nil {
-		log.Printf("error on read file: %s", err)
+		logging.FromContext(obj.Context()).Error("GCS error on read file", "error", err)
 		return nil, err
 	}
 
@@ -75,10 +163,3 @@ func (this *GCSImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
 func (this *GCSImageStore) String() string {
 	return "GCSStore"
 }
-
-func (this *GCSImageStore) toPath(obj *StoreObject) string {
-	if this.storeRoot != "" {
-		return this.storeRoot + "/" + this.namePathMapper.mapToPath(obj)
-	}
-	return this.namePathMapper.mapToPath(obj)
-}
@@ -2,7 +2,9 @@ package imagestore
 
 import (
 	"crypto/rand"
-	"log"
+	"time"
+
+	"github.com/Imgur/mandible/logging"
 )
 
 // Provides a continuous stream of random image "hashes" of a fixed length that is unique (does not exist in the store).
@@ -10,15 +12,13 @@ type HashGenerator struct {
 	hashGetter chan string
 	length     int
 	store      ImageStore
+	quit       chan struct{}
 }
 
 func (this *HashGenerator) init() {
 	go func() {
 		storeObj := &StoreObject{
-			"",
-			"",
-			"original",
-			"",
+			Size: "original",
 		}
 
 		for {
@@ -29,7 +29,7 @@ func (this *HashGenerator) init() {
 				bArr := make([]byte, c)
 				_, err := rand.Read(bArr)
 				if err != nil {
-					log.Println("error:", err)
+					logging.Default().Error("Error reading random bytes for a hash", "error", err)
 					break
 				}
 
@@ -64,9 +64,24 @@ func (this *HashGenerator) init() {
 
 			storeObj.Id = str
 
-			exists, _ := this.store.Exists(storeObj)
+			// An ID is only handed out once the stores say it's free, not when they can't be asked
+			exists, err := this.store.Exists(storeObj)
+			if err != nil {
+				logging.Default().Error("Error checking whether a hash is taken", "hash", str, "error", err)
+				select {
+				case <-time.After(time.Second):
+				case <-this.quit:
+					return
+				}
+				continue
+			}
+
 			if !exists {
-				this.hashGetter <- str
+				select {
+				case this.hashGetter <- str:
+				case <-this.quit:
+					return
+				}
 			}
 		}
 	}()
@@ -75,3 +90,8 @@ func (this *HashGenerator) init() {
 func (this *HashGenerator) Get() string {
 	return <-this.hashGetter
 }
+
+// Stops generating hashes. Get must not be called afterwards.
+func (this *HashGenerator) Stop() {
+	close(this.quit)
+}
@@ -2,25 +2,68 @@ package imagestore
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+
+	"github.com/Imgur/mandible/config"
 )
 
+type LocalStoreConfig struct {
+	StoreRoot string
+	NamePathConfig
+}
+
+func (this *LocalStoreConfig) StoreType() string {
+	return "local"
+}
+
+func (this *LocalStoreConfig) Validate() error {
+	if err := config.RequireString("StoreRoot", this.StoreRoot); err != nil {
+		return err
+	}
+
+	return this.NamePathConfig.validate()
+}
+
 // A LocalImageStore stores images on the local disk.
 type LocalImageStore struct {
 	storeRoot      string
 	namePathMapper *NamePathMapper
+	index          *pathIndex
 }
 
 func NewLocalImageStore(root string, mapper *NamePathMapper) *LocalImageStore {
-	return &LocalImageStore{
+	store := &LocalImageStore{
 		storeRoot:      root,
 		namePathMapper: mapper,
 	}
+
+	store.index = &pathIndex{
+		mapper: mapper,
+		prefix: root + "/",
+		read:   ioutil.ReadFile,
+		write: func(path string, data []byte) error {
+			createParent(path)
+			return ioutil.WriteFile(path, data, 0666)
+		},
+		notFound: os.IsNotExist,
+	}
+
+	return store
 }
 
 func (this *LocalImageStore) Exists(obj *StoreObject) (bool, error) {
-	if _, err := os.Stat(this.toPath(obj)); os.IsNotExist(err) {
+	path, err := this.index.lookup(obj)
+	if err == errNotIndexed {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
@@ -35,8 +78,9 @@ func (this *LocalImageStore) Save(src string, obj *StoreObject) (*StoreObject, e
 	defer srcFd.Close()
 
 	// open output file
-	this.createParent(obj)
-	fo, err := os.Create(this.toPath(obj))
+	path := this.index.savePath(obj)
+	createParent(path)
+	fo, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
@@ -48,12 +92,25 @@ func (this *LocalImageStore) Save(src string, obj *StoreObject) (*StoreObject, e
 		return nil, err
 	}
 
-	obj.Url = this.toPath(obj)
+	if err := this.index.record(obj, path); err != nil {
+		return nil, err
+	}
+
+	obj.Url = this.URL(obj)
 	return obj, nil
 }
 
+func (this *LocalImageStore) URL(obj *StoreObject) string {
+	return this.index.savePath(obj)
+}
+
 func (this *LocalImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
-	reader, err := os.Open(this.toPath(obj))
+	path, err := this.index.lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -65,14 +122,10 @@ func (this *LocalImageStore) String() string {
 	return "LocalStore"
 }
 
-func (this *LocalImageStore) createParent(obj *StoreObject) {
-	path := path.Dir(this.toPath(obj))
+func createParent(file string) {
+	dir := path.Dir(file)
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.MkdirAll(path, 0777)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.MkdirAll(dir, 0777)
 	}
 }
-
-func (this *LocalImageStore) toPath(obj *StoreObject) string {
-	return this.storeRoot + "/" + this.namePathMapper.mapToPath(obj)
-}
@@ -0,0 +1,67 @@
+package imagestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalStoreFindsObjectsByIDUnderUnrecoverableTemplates(t *testing.T) {
+	root, err := ioutil.TempDir("", "mandible-store")
+	if err != nil {
+		t.Fatalf("Unexpected error creating store root: %s", err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	mapper, err := NewNamePathMapper("", "${Year}/${UserID}/${ImageSize}/${ImageName}.${Ext}")
+	if err != nil {
+		t.Fatalf("Unexpected error creating mapper: %s", err.Error())
+	}
+	store := NewLocalImageStore(root, mapper)
+
+	src := filepath.Join(root, "src")
+	ioutil.WriteFile(src, []byte("image"), 0666)
+
+	obj := &StoreObject{
+		Id:        "abcdefg",
+		MimeType:  "image/png",
+		Size:      "original",
+		UserID:    "123",
+		CreatedAt: time.Date(2015, time.June, 8, 12, 0, 0, 0, time.UTC),
+	}
+	if _, err := store.Save(src, obj); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "2015/123/original/abcdefg.png")); err != nil {
+		t.Fatalf("Expected the object at its mapped path: %s", err.Error())
+	}
+
+	// Lookups only know the ID and size, like /thumbnail and the hash generator
+	lookup := &StoreObject{Id: "abcdefg", Size: "original"}
+	if exists, _ := store.Exists(lookup); !exists {
+		t.Fatalf("Expected the object to exist when looked up by ID")
+	}
+
+	reader, err := store.Get(lookup)
+	if err != nil {
+		t.Fatalf("Unexpected error getting by ID: %s", err.Error())
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "image" {
+		t.Fatalf("Unexpected contents %q", data)
+	}
+
+	if exists, err := store.Exists(&StoreObject{Id: "missing", Size: "original"}); exists || err != nil {
+		t.Fatalf("Expected an object that was never saved not to exist")
+	}
+
+	// An index that can't be read doesn't mean the ID is free
+	os.MkdirAll(filepath.Join(root, "_index/original/unreadable"), 0777)
+	if exists, err := store.Exists(&StoreObject{Id: "unreadable", Size: "original"}); exists || err == nil {
+		t.Fatalf("Expected an error when the index can't be read")
+	}
+}
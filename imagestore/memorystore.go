@@ -9,6 +9,17 @@ import (
 	"sync"
 )
 
+// The in-memory store has no options.
+type MemoryStoreConfig struct{}
+
+func (this *MemoryStoreConfig) StoreType() string {
+	return "memory"
+}
+
+func (this *MemoryStoreConfig) Validate() error {
+	return nil
+}
+
 type InMemoryImageStore struct {
 	files map[string]string // name -> contents
 	rw    sync.Mutex
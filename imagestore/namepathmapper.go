@@ -1,30 +1,153 @@
 package imagestore
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/Imgur/mandible/config"
 )
 
+// Matches ${Name} and ${Name:Arg} template variables in a NamePathMap.
+var templateVarRegex = regexp.MustCompile(`\$\{([^}:]*)(?::([^}]*))?\}`)
+
+// The file extension used by ${Ext} for each MIME type we store.
+var mimeExtensions = map[string]string{
+	"image/jpeg":      "jpg",
+	"image/jpg":       "jpg",
+	"image/png":       "png",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+	"image/heic":      "heic",
+	"image/heif":      "heif",
+	"image/avif":      "avif",
+	"image/svg+xml":   "svg",
+	"application/pdf": "pdf",
+	"video/quicktime": "mov",
+}
+
+// ${Shard:N} is a prefix of a hex encoded SHA1, so it can't be longer than one.
+const maxShardLength = sha1.Size * 2
+
+// NamePathMapper turns a StoreObject into the path it is stored under. The mapping is a template which may contain
+// the following variables:
+//
+//	${ImageName}  the object ID
+//	${ImageSize}  the object size, i.e. original or thumbnail
+//	${Ext}        the file extension derived from the MIME type, i.e. jpg
+//	${Mime}       the MIME type, i.e. image/jpeg
+//	${Year}       the four digit year the object was uploaded
+//	${Month}      the two digit month the object was uploaded
+//	${Day}        the two digit day the object was uploaded
+//	${UserID}     the ID of the authenticated uploader, empty for anonymous uploads
+//	${Shard:N}    the first N characters of a hash of the object ID, for even key distribution
+//
+// If a regex is given it is matched against the object ID and its groups are available as ${1}, ${2}, ... or by name.
 type NamePathMapper struct {
 	regex   *regexp.Regexp
 	replace string
 }
 
-func NewNamePathMapper(expr string, mapping string) *NamePathMapper {
+func NewNamePathMapper(expr string, mapping string) (*NamePathMapper, error) {
 	var r *regexp.Regexp
 	if len(expr) > 0 {
-		r = regexp.MustCompile(expr)
+		var err error
+		r, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, &config.FieldError{Field: "NamePathRegex", Message: err.Error()}
+		}
 	}
 
-	return &NamePathMapper{
+	mapper := &NamePathMapper{
 		r,
 		mapping,
 	}
+
+	if err := mapper.validate(); err != nil {
+		return nil, &config.FieldError{Field: "NamePathMap", Message: err.Error()}
+	}
+
+	return mapper, nil
+}
+
+func (this *NamePathMapper) validate() error {
+	for _, match := range templateVarRegex.FindAllStringSubmatch(this.replace, -1) {
+		name, arg := match[1], match[2]
+		hasArg := len(match[0]) > len(name)+3
+
+		switch name {
+		case "ImageName", "ImageSize", "Ext", "Mime", "Year", "Month", "Day", "UserID":
+			if hasArg {
+				return fmt.Errorf("${%s} doesn't take an argument", name)
+			}
+		case "Shard":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > maxShardLength {
+				return fmt.Errorf("${Shard:N} requires N between 1 and %d", maxShardLength)
+			}
+		default:
+			if hasArg || !this.isRegexGroup(name) {
+				return fmt.Errorf("unknown variable %s", match[0])
+			}
+		}
+	}
+
+	return nil
+}
+
+// Recoverable is whether the template only uses variables that can be recovered from an object's ID and size, so an
+// object can be found without knowing its MIME type, uploader or upload date.
+func (this *NamePathMapper) Recoverable() bool {
+	for _, match := range templateVarRegex.FindAllStringSubmatch(this.replace, -1) {
+		switch match[1] {
+		case "Ext", "Mime", "Year", "Month", "Day", "UserID":
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *NamePathMapper) isRegexGroup(name string) bool {
+	if this.regex == nil || name == "" {
+		return false
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		return n >= 0 && n <= this.regex.NumSubexp()
+	}
+
+	for _, subexp := range this.regex.SubexpNames() {
+		if subexp == name {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (this *NamePathMapper) mapToPath(obj *StoreObject) string {
-	repl := strings.Replace(this.replace, "${ImageName}", obj.Id, -1)
-	repl = strings.Replace(repl, "${ImageSize}", obj.Size, -1)
+	repl := templateVarRegex.ReplaceAllStringFunc(this.replace, func(variable string) string {
+		match := templateVarRegex.FindStringSubmatch(variable)
+
+		value, ok := templateValue(obj, match[1], match[2])
+		if !ok {
+			// Regex groups are expanded below
+			return variable
+		}
+
+		if this.regex != nil {
+			// So a $ in a value, i.e. a user ID, isn't expanded as a regex group
+			value = strings.Replace(value, "$", "$$", -1)
+		}
+
+		return value
+	})
 
 	if this.regex != nil {
 		return this.regex.ReplaceAllString(obj.Id, repl)
@@ -32,3 +155,31 @@ func (this *NamePathMapper) mapToPath(obj *StoreObject) string {
 
 	return repl
 }
+
+// The value of the template variable name for obj, or false if it's not one of ours.
+func templateValue(obj *StoreObject, name, arg string) (string, bool) {
+	switch name {
+	case "ImageName":
+		return obj.Id, true
+	case "ImageSize":
+		return obj.Size, true
+	case "Ext":
+		return mimeExtensions[obj.MimeType], true
+	case "Mime":
+		return obj.MimeType, true
+	case "Year":
+		return fmt.Sprintf("%04d", obj.CreatedAt.Year()), true
+	case "Month":
+		return fmt.Sprintf("%02d", obj.CreatedAt.Month()), true
+	case "Day":
+		return fmt.Sprintf("%02d", obj.CreatedAt.Day()), true
+	case "UserID":
+		return obj.UserID, true
+	case "Shard":
+		n, _ := strconv.Atoi(arg)
+		sum := sha1.Sum([]byte(obj.Id))
+		return hex.EncodeToString(sum[:])[:n], true
+	}
+
+	return "", false
+}
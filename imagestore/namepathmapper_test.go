@@ -0,0 +1,73 @@
+package imagestore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamePathMapperExpandsTemplateVariables(t *testing.T) {
+	mapper, err := NewNamePathMapper("^([a-zA-Z0-9])([a-zA-Z0-9]).*", "${Year}/${Month}/${Day}/${UserID}/${ImageSize}/${1}/${2}/${ImageName}.${Ext}")
+	if err != nil {
+		t.Fatalf("Unexpected error creating mapper: %s", err.Error())
+	}
+
+	obj := &StoreObject{
+		Id:        "abcdefg",
+		MimeType:  "image/jpeg",
+		Size:      "original",
+		UserID:    "123",
+		CreatedAt: time.Date(2015, time.June, 8, 12, 0, 0, 0, time.UTC),
+	}
+
+	path := mapper.mapToPath(obj)
+	if path != "2015/06/08/123/original/a/b/abcdefg.jpg" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+}
+
+func TestNamePathMapperDoesntExpandGroupsInVariables(t *testing.T) {
+	mapper, err := NewNamePathMapper("^([a-zA-Z0-9]).*", "${UserID}/${1}/${ImageName}")
+	if err != nil {
+		t.Fatalf("Unexpected error creating mapper: %s", err.Error())
+	}
+
+	path := mapper.mapToPath(&StoreObject{Id: "abcdefg", UserID: "a$1${1}$$"})
+	if path != "a$1${1}$$/a/abcdefg" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+}
+
+func TestNamePathMapperShard(t *testing.T) {
+	mapper, err := NewNamePathMapper("", "${Shard:3}/${Mime}/${ImageName}")
+	if err != nil {
+		t.Fatalf("Unexpected error creating mapper: %s", err.Error())
+	}
+
+	// sha1("abcdefg") = 2fb5e13419fc89246865e7a324f476ec624e8740
+	path := mapper.mapToPath(&StoreObject{Id: "abcdefg", MimeType: "image/png"})
+	if path != "2fb/image/png/abcdefg" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+}
+
+func TestNamePathMapperRejectsInvalidTemplates(t *testing.T) {
+	invalid := []struct {
+		expr    string
+		mapping string
+	}{
+		{"", "${ImageNmae}"},
+		{"", "${1}/${ImageName}"},
+		{"^(a)", "${2}/${ImageName}"},
+		{"", "${Shard}/${ImageName}"},
+		{"", "${Shard:0}/${ImageName}"},
+		{"", "${Shard:41}/${ImageName}"},
+		{"", "${Year:4}/${ImageName}"},
+		{"^([a-z]", "${ImageName}"},
+	}
+
+	for _, c := range invalid {
+		if _, err := NewNamePathMapper(c.expr, c.mapping); err == nil {
+			t.Fatalf("Expected an error for regex %q and mapping %q", c.expr, c.mapping)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package imagestore
+
+import (
+	"io"
+	"time"
+
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/tracing"
+)
+
+// StoreObserver is told the duration and result of each Save, Exists and Get of a store.
+type StoreObserver func(store, operation string, elapsed time.Duration, err error)
+
+// ObservedImageStore records a span for every operation on the wrapped store, and reports its timing to an optional
+// observer, without the store knowing about it. Spans are children of the StoreObject's context.
+type ObservedImageStore struct {
+	store    ImageStore
+	name     string
+	observer StoreObserver
+}
+
+func NewObservedImageStore(store ImageStore, name string, observer StoreObserver) *ObservedImageStore {
+	return &ObservedImageStore{store, name, observer}
+}
+
+// Starts a span for operation on obj, returning a function to call with the result once it is done.
+func (this *ObservedImageStore) observe(operation string, obj *StoreObject) func(error) {
+	start := time.Now()
+
+	_, span := tracing.StartSpan(obj.Context(), "store."+operation)
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("store", this.name)
+	span.SetAttribute("store.object_id", obj.Id)
+
+	return func(err error) {
+		span.SetError(err)
+		span.End()
+
+		// Some stores report a missing object from Exists as an error, which is the usual case when generating hashes
+		if err != nil && operation != "exists" {
+			logging.FromContext(obj.Context()).Warn("Store operation failed", "store", this.name, "operation", operation, "object_id", obj.Id, "error", err)
+		}
+
+		if this.observer != nil {
+			this.observer(this.name, operation, time.Since(start), err)
+		}
+	}
+}
+
+func (this *ObservedImageStore) Save(src string, obj *StoreObject) (*StoreObject, error) {
+	done := this.observe("save", obj)
+	result, err := this.store.Save(src, obj)
+	done(err)
+
+	return result, err
+}
+
+func (this *ObservedImageStore) Exists(obj *StoreObject) (bool, error) {
+	done := this.observe("exists", obj)
+	exists, err := this.store.Exists(obj)
+	done(err)
+
+	return exists, err
+}
+
+func (this *ObservedImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
+	done := this.observe("get", obj)
+	reader, err := this.store.Get(obj)
+	done(err)
+
+	return reader, err
+}
+
+func (this *ObservedImageStore) URL(obj *StoreObject) string {
+	return URLFor(this.store, obj)
+}
+
+func (this *ObservedImageStore) String() string {
+	return this.store.String()
+}
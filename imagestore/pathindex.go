@@ -0,0 +1,57 @@
+package imagestore
+
+import (
+	"errors"
+	"strings"
+)
+
+var errNotIndexed = errors.New("Object isn't in the path index")
+
+// pathIndex records the path each object is saved under for stores whose NamePathMap uses variables that can't be
+// recovered from an object's ID and size, i.e. ${Ext} or ${Year}. /thumbnail, /ocr and the hash generator only know
+// those two, so they look the path up in the index instead of mapping it. Templates that only use recoverable
+// variables aren't indexed.
+type pathIndex struct {
+	mapper *NamePathMapper
+	// Prepended to every path, i.e. the store root and a slash
+	prefix string
+	read   func(path string) ([]byte, error)
+	write  func(path string, data []byte) error
+	// Whether an error from read means there's nothing at the path, rather than that it couldn't be read
+	notFound func(err error) bool
+}
+
+// The path obj is saved under.
+func (this *pathIndex) savePath(obj *StoreObject) string {
+	return this.prefix + this.mapper.mapToPath(obj)
+}
+
+// Records that obj was saved under path.
+func (this *pathIndex) record(obj *StoreObject, path string) error {
+	if this.mapper.Recoverable() {
+		return nil
+	}
+
+	return this.write(this.indexPath(obj), []byte(path))
+}
+
+// The path obj was saved under, or errNotIndexed if it wasn't saved. Other errors mean the index couldn't be read, and
+// say nothing about whether obj was saved.
+func (this *pathIndex) lookup(obj *StoreObject) (string, error) {
+	if this.mapper.Recoverable() {
+		return this.savePath(obj), nil
+	}
+
+	data, err := this.read(this.indexPath(obj))
+	if err != nil && this.notFound(err) {
+		return "", errNotIndexed
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (this *pathIndex) indexPath(obj *StoreObject) string {
+	return this.prefix + "_index/" + obj.Size + "/" + obj.Id
+}
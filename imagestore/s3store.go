@@ -1,32 +1,89 @@
 package imagestore
 
 import (
+	"fmt"
 	"io"
 	"os"
 
+	"github.com/Imgur/mandible/config"
+	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 )
 
+type S3StoreConfig struct {
+	BucketName string
+	AWSKey     string `secret:"true"`
+	AWSSecret  string `secret:"true"`
+	StoreRoot  string
+	Region     string
+	NamePathConfig
+}
+
+func (this *S3StoreConfig) StoreType() string {
+	return "s3"
+}
+
+func (this *S3StoreConfig) Validate() error {
+	if err := config.RequireString("BucketName", this.BucketName); err != nil {
+		return err
+	}
+
+	if _, ok := aws.Regions[this.Region]; !ok {
+		return &config.FieldError{Field: "Region", Message: fmt.Sprintf("unknown AWS region %q", this.Region)}
+	}
+
+	return this.NamePathConfig.validate()
+}
+
 type S3ImageStore struct {
 	bucketName     string
 	storeRoot      string
 	client         *s3.S3
 	namePathMapper *NamePathMapper
+	index          *pathIndex
 }
 
 func NewS3ImageStore(bucket string, root string, client *s3.S3, mapper *NamePathMapper) *S3ImageStore {
-	return &S3ImageStore{
+	store := &S3ImageStore{
 		bucketName:     bucket,
 		storeRoot:      root,
 		client:         client,
 		namePathMapper: mapper,
 	}
+
+	store.index = &pathIndex{
+		mapper: mapper,
+		prefix: root + "/",
+		read: func(path string) ([]byte, error) {
+			return client.Bucket(bucket).Get(path)
+		},
+		write: func(path string, data []byte) error {
+			return client.Bucket(bucket).Put(path, data, "text/plain", s3.BucketOwnerFull)
+		},
+		notFound: s3NotFound,
+	}
+
+	return store
+}
+
+func s3NotFound(err error) bool {
+	s3err, ok := err.(*s3.Error)
+	return ok && s3err.StatusCode == 404
 }
 
 func (this *S3ImageStore) Exists(obj *StoreObject) (bool, error) {
+	path, err := this.index.lookup(obj)
+	if err == errNotIndexed {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
 	bucket := this.client.Bucket(this.bucketName)
-	response, err := bucket.Head(this.toPath(obj))
-	if err != nil {
+	response, err := bucket.Head(path)
+	if err != nil && s3NotFound(err) {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
@@ -47,18 +104,32 @@ func (this *S3ImageStore) Save(src string, obj *StoreObject) (*StoreObject, erro
 		return nil, err
 	}
 
-	err = bucket.PutReader(this.toPath(obj), srcFd, stats.Size(), obj.MimeType, s3.BucketOwnerFull)
+	path := this.index.savePath(obj)
+	err = bucket.PutReader(path, srcFd, stats.Size(), obj.MimeType, s3.BucketOwnerFull)
 	if err != nil {
 		return nil, err
 	}
 
-	obj.Url = bucket.URL(this.toPath(obj))
+	if err := this.index.record(obj, path); err != nil {
+		return nil, err
+	}
+
+	obj.Url = bucket.URL(path)
 	return obj, nil
 }
 
+func (this *S3ImageStore) URL(obj *StoreObject) string {
+	return this.client.Bucket(this.bucketName).URL(this.index.savePath(obj))
+}
+
 func (this *S3ImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
+	path, err := this.index.lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+
 	bucket := this.client.Bucket(this.bucketName)
-	data, err := bucket.GetReader(this.toPath(obj))
+	data, err := bucket.GetReader(path)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +140,3 @@ func (this *S3ImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
 func (this *S3ImageStore) String() string {
 	return "S3Store"
 }
-
-func (this *S3ImageStore) toPath(obj *StoreObject) string {
-	return this.storeRoot + "/" + this.namePathMapper.mapToPath(obj)
-}
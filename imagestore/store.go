@@ -12,6 +12,20 @@ type ImageStore interface {
 	String() string
 }
 
+// URLResolver is implemented by stores that know the URL an object will have before it is saved.
+type URLResolver interface {
+	URL(obj *StoreObject) string
+}
+
+// URLFor returns the URL obj will have once it is saved to store, or an empty string if the store can't tell.
+func URLFor(store ImageStore, obj *StoreObject) string {
+	if resolver, ok := store.(URLResolver); ok {
+		return resolver.URL(obj)
+	}
+
+	return ""
+}
+
 type MultiImageStore []ImageStore
 
 func (this MultiImageStore) Save(src string, obj *StoreObject) (*StoreObject, error) {
@@ -105,6 +119,17 @@ func (this MultiImageStore) Get(obj *StoreObject) (io.ReadCloser, error) {
 	return nil, err
 }
 
+// The URL from the first store that knows it.
+func (this MultiImageStore) URL(obj *StoreObject) string {
+	for _, store := range this {
+		if url := URLFor(store, obj); url != "" {
+			return url
+		}
+	}
+
+	return ""
+}
+
 func (this MultiImageStore) String() string {
 	str := ""
 
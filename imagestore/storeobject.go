@@ -1,14 +1,36 @@
 package imagestore
 
+import (
+	"context"
+	"time"
+)
+
 type StorableObject interface {
 	GetPath() string
 }
 
 type StoreObject struct {
-	Id       string // Unique identifier
-	MimeType string // i.e. image/jpg
-	Size     string // i.e. thumb
-	Url      string // if publicly available
+	Id        string    // Unique identifier
+	MimeType  string    // i.e. image/jpg
+	Size      string    // i.e. thumb
+	Url       string    // if publicly available
+	UserID    string    // the uploader, if authenticated
+	CreatedAt time.Time // upload time
+
+	ctx context.Context
+}
+
+// Context returns the context of the request the object belongs to, for tracing store operations.
+func (this *StoreObject) Context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+
+	return this.ctx
+}
+
+func (this *StoreObject) SetContext(ctx context.Context) {
+	this.ctx = ctx
 }
 
 func (this *StoreObject) Store(s StorableObject, store ImageStore) error {
@@ -0,0 +1,113 @@
+// Package logging provides a leveled, structured logger. Loggers are carried in a request's context so that every
+// line logged while handling it includes the request ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (this Level) String() string {
+	if this < LevelDebug || this > LevelError {
+		return fmt.Sprintf("level(%d)", int(this))
+	}
+
+	return levelNames[this]
+}
+
+// ParseLevel parses debug, info, warn or error. An empty string is info.
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %v", s, levelNames)
+}
+
+// Logger writes leveled messages with key value pairs, i.e. logger.Info("Upload stored", "uid", hash). Implement
+// it to send logs elsewhere.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// With returns a logger that adds keyvals to every message.
+	With(keyvals ...interface{}) Logger
+}
+
+var (
+	defaultLogger Logger = NewTextLogger(stderr, LevelInfo)
+	defaultMu     sync.RWMutex
+)
+
+// Default is the logger used when a context has none.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultLogger
+}
+
+func SetDefault(logger Logger) {
+	defaultMu.Lock()
+	defaultLogger = logger
+	defaultMu.Unlock()
+}
+
+type loggerKey struct{}
+
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the context's logger, or the default logger.
+func FromContext(ctx context.Context) Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+			return logger
+		}
+	}
+
+	return Default()
+}
+
+type discardLogger struct{}
+
+// Discard drops every message.
+var Discard Logger = discardLogger{}
+
+func (discardLogger) Debug(msg string, keyvals ...interface{}) {}
+func (discardLogger) Info(msg string, keyvals ...interface{})  {}
+func (discardLogger) Warn(msg string, keyvals ...interface{})  {}
+func (discardLogger) Error(msg string, keyvals ...interface{}) {}
+func (this discardLogger) With(keyvals ...interface{}) Logger  { return this }
+
+// New creates a JSON logger, or a text logger if format is text.
+func New(format string, w io.Writer, level Level) Logger {
+	if format == "text" {
+		return NewTextLogger(w, level)
+	}
+
+	return NewJSONLogger(w, level)
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJSONLoggerFiltersLevelsAndKeepsFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LevelInfo).With("request_id", "abc")
+
+	logger.Debug("Hidden")
+	logger.Warn("Store failed", "store", "s3", "error", errors.New("Timed out"), "dangling")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, instead:\n%s", buf.String())
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("Expected JSON, instead %s: %s", err.Error(), lines[0])
+	}
+
+	expected := map[string]interface{}{
+		"level":      "warn",
+		"msg":        "Store failed",
+		"request_id": "abc",
+		"store":      "s3",
+		"error":      "Timed out",
+		"!BADKEY":    "dangling",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Fatalf("Expected %s to be %v, instead: %s", key, value, lines[0])
+		}
+	}
+}
+
+func TestFromContextFallsBackToDefault(t *testing.T) {
+	if FromContext(context.Background()) != Default() {
+		t.Fatalf("Expected the default logger for a context without one")
+	}
+
+	ctx := NewContext(context.Background(), Discard)
+	if FromContext(ctx) != Discard {
+		t.Fatalf("Expected the context's logger")
+	}
+}
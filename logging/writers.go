@@ -0,0 +1,166 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var stderr io.Writer = os.Stderr
+
+// Formats a single log line.
+type formatter func(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{})
+
+type writerLogger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  Level
+	format formatter
+	fields []interface{}
+}
+
+// NewJSONLogger writes one JSON object per line with time, level, msg and the key value pairs as fields.
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{&sync.Mutex{}, w, level, formatJSON, nil}
+}
+
+// NewTextLogger writes lines of key=value pairs, for reading in a terminal.
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{&sync.Mutex{}, w, level, formatText, nil}
+}
+
+func (this *writerLogger) Debug(msg string, keyvals ...interface{}) {
+	this.log(LevelDebug, msg, keyvals)
+}
+
+func (this *writerLogger) Info(msg string, keyvals ...interface{}) {
+	this.log(LevelInfo, msg, keyvals)
+}
+
+func (this *writerLogger) Warn(msg string, keyvals ...interface{}) {
+	this.log(LevelWarn, msg, keyvals)
+}
+
+func (this *writerLogger) Error(msg string, keyvals ...interface{}) {
+	this.log(LevelError, msg, keyvals)
+}
+
+func (this *writerLogger) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(this.fields)+len(keyvals))
+	fields = append(fields, this.fields...)
+	fields = append(fields, keyvals...)
+
+	return &writerLogger{this.mu, this.w, this.level, this.format, fields}
+}
+
+func (this *writerLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < this.level {
+		return
+	}
+
+	all := keyvals
+	if len(this.fields) > 0 {
+		all = append(append([]interface{}{}, this.fields...), keyvals...)
+	}
+
+	var buf bytes.Buffer
+	this.format(&buf, time.Now(), level, msg, all)
+	buf.WriteByte('\n')
+
+	this.mu.Lock()
+	this.w.Write(buf.Bytes())
+	this.mu.Unlock()
+}
+
+// Turns key value pairs into a map, keeping the last value of repeated keys. A trailing key without a value is
+// logged under "!BADKEY" rather than dropped.
+func fieldMap(keyvals []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(keyvals)/2)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 >= len(keyvals) {
+			fields["!BADKEY"] = keyvals[i]
+			break
+		}
+
+		fields[fmt.Sprint(keyvals[i])] = fieldValue(keyvals[i+1])
+	}
+
+	return fields
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		if value == nil {
+			return nil
+		}
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+
+	return v
+}
+
+func formatJSON(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{}) {
+	fields := fieldMap(keyvals)
+	fields["time"] = t.UTC().Format(time.RFC3339Nano)
+	fields["level"] = level.String()
+	fields["msg"] = msg
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":  fields["time"],
+			"level": fields["level"],
+			"msg":   msg,
+			"error": "unable to encode log fields: " + err.Error(),
+		})
+	}
+
+	buf.Write(data)
+}
+
+func formatText(buf *bytes.Buffer, t time.Time, level Level, msg string, keyvals []interface{}) {
+	fmt.Fprintf(buf, "%s %-5s %s", t.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), msg)
+
+	fields := fieldMap(keyvals)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value := fmt.Sprint(fields[k])
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, value)
+	}
+}
+
+// StdWriter adapts a Logger to an io.Writer, so output of the standard log package can be routed through it at info
+// level.
+func StdWriter(logger Logger) io.Writer {
+	return stdWriter{logger}
+}
+
+type stdWriter struct {
+	logger Logger
+}
+
+func (this stdWriter) Write(p []byte) (int, error) {
+	this.logger.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
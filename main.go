@@ -1,51 +1,199 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	mandibleConf "github.com/Imgur/mandible/config"
 	processors "github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/logging"
 	mandible "github.com/Imgur/mandible/server"
+	"github.com/Imgur/mandible/tracing"
 )
 
 func main() {
 	configFile := os.Getenv("MANDIBLE_CONF")
+	legacyConf := configFile == "" && os.Getenv("IMGUR_GO_CONF") != ""
+	if legacyConf {
+		configFile = os.Getenv("IMGUR_GO_CONF")
+	}
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], configFile))
+	}
 
-	config := mandibleConf.NewConfiguration(configFile)
+	config, err := mandibleConf.NewConfiguration(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger := newLogger(config)
+	logging.SetDefault(logger)
+
+	if legacyConf {
+		logger.Warn("IMGUR_GO_CONF is deprecated, use MANDIBLE_CONF")
+	}
+	for _, warning := range config.Deprecations() {
+		logger.Warn(warning)
+	}
+
+	// Route anything still using the standard log package, i.e. dependencies, through the structured logger
+	log.SetFlags(0)
+	log.SetOutput(logging.StdWriter(logger))
+
+	if !probeCapabilities(logger) {
+		os.Exit(1)
+	}
 
 	var server *mandible.Server
 	var stats mandible.RuntimeStats
 
-	if config.DatadogEnabled {
-		var err error
-		stats, err = mandible.NewDatadogStats(config.DatadogHostname)
-		if err != nil {
-			log.Printf("Invalid Datadog Hostname: %s", config.DatadogHostname)
-			os.Exit(1)
-		}
-		log.Println("Stats init success")
-	} else {
-		stats = &mandible.DiscardStats{}
+	stats, err = mandible.NewRuntimeStats(config.StatsBackends())
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if os.Getenv("AUTHENTICATION_HMAC_KEY") != "" {
-		key := []byte(os.Getenv("AUTHENTICATION_HMAC_KEY"))
-		auth := mandible.NewHMACAuthenticatorSHA256(key)
-		server = mandible.NewAuthenticatedServer(config, processors.EverythingStrategy, auth, stats)
-	} else {
-		server = mandible.NewServer(config, processors.EverythingStrategy, stats)
+	processorcommand.SetCommandObserver(func(command string, elapsed time.Duration, err error) {
+		stats.CommandTime(elapsed, command, err == nil)
+	})
+
+	server, err = mandible.NewServer(config, processors.EverythingStrategy, stats)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	server.SetLogger(logger)
+	server.SetConfigLoader(func() (*mandibleConf.Configuration, error) {
+		return mandibleConf.NewConfiguration(configFile)
+	})
+
+	// Reload the config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := server.ReloadConfig()
+			if err != nil {
+				logger.Error("Config reload failed, keeping the current config", "error", err)
+				continue
+			}
+
+			logger.Info("Config reloaded")
+		}
+	}()
+
+	tracer := tracing.NewTracerFromConfig(config.Tracing)
+	server.SetTracer(tracer)
+
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 
-	port := fmt.Sprintf(":%d", server.Config.Port)
+	port := fmt.Sprintf(":%d", server.Config().Port)
+
+	httpServer := &http.Server{
+		Addr:         port,
+		Handler:      muxer,
+		ReadTimeout:  config.ReadTimeout(),
+		WriteTimeout: config.WriteTimeout(),
+		IdleTimeout:  config.IdleTimeout(),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
 
-	log.Printf("Listening on Port: %s", port)
+	logger.Info("Listening", "port", server.Config().Port)
 
 	stats.LogStartup()
-	http.ListenAndServe(port, muxer)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-serveErr:
+		logger.Error("Unable to serve", "error", err)
+		os.Exit(1)
+	case sig := <-stop:
+		logger.Info("Shutting down", "signal", sig)
+	}
+
+	// Fail the readiness check and give load balancers a chance to notice before we stop accepting connections
+	server.Drain()
+	time.Sleep(config.DrainDelay())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error("Gave up waiting for in-flight requests", "error", err)
+	}
+
+	shutdownErr := server.Shutdown(ctx)
+
+	// Flush after background jobs finish so their spans are included
+	if err := tracer.Shutdown(ctx); err != nil {
+		logger.Error("Unable to flush traces", "error", err)
+	}
+
+	if shutdownErr != nil {
+		logger.Error("Unclean shutdown", "error", shutdownErr)
+		os.Exit(1)
+	}
+
+	logger.Info("Shutdown complete")
+}
+
+// Finds out which external programs are installed so uploads skip the optional steps that can't run. Returns false if
+// a required one is missing.
+func probeCapabilities(logger logging.Logger) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	caps := processorcommand.Probe(ctx)
+	processors.SetCapabilities(caps)
+
+	ok := true
+	for _, dep := range processorcommand.Dependencies {
+		capability := caps[dep.Command]
+		switch {
+		case capability.Available:
+			logger.Info("Found "+dep.Command, "version", capability.Version)
+		case dep.Required:
+			logger.Error("Required program unavailable", "command", dep.Command, "error", capability.Error)
+			ok = false
+		default:
+			logger.Warn("Optional program unavailable, skipping "+dep.Feature, "command", dep.Command, "error", capability.Error)
+		}
+	}
+
+	if caps.Has("tesseract") {
+		for _, lang := range processorcommand.TesseractLanguages {
+			if !caps.HasLanguage(lang) {
+				logger.Warn("Tesseract traineddata missing, skipping OCR that needs it", "language", lang)
+			}
+		}
+	}
+
+	return ok
+}
+
+// MANDIBLE_DEBUG turns on debug logging unless LogLevel says otherwise.
+func newLogger(config *mandibleConf.Configuration) logging.Logger {
+	levelName := config.LogLevel
+	if levelName == "" && os.Getenv("MANDIBLE_DEBUG") == "true" {
+		levelName = "debug"
+	}
+
+	// Validate has already checked the level
+	level, _ := logging.ParseLevel(levelName)
+
+	return logging.New(config.LogFormat, os.Stderr, level)
 }
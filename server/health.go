@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/imagestore"
+)
+
+// How long the readiness check waits for all checks before reporting the unfinished ones as failing.
+const readinessTimeout = 5 * time.Second
+
+// The object saved to each store to check it is reachable, a 1x1 GIF.
+const (
+	canaryID   = "mandiblereadinesscanary"
+	canarySize = "canary"
+	canaryGIF  = "R0lGODlhAQABAIAAAP///wAAACH5BAEAAAAALAAAAAABAAEAAAICRAEAOw=="
+)
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// The last readiness report, so probes and anyone else hitting /readyz don't each save a canary to every store and run
+// every external program. Requests arriving while the checks run wait for their report.
+type readinessCache struct {
+	mu      sync.Mutex
+	state   *serverState
+	report  healthReport
+	checked time.Time
+	running chan struct{}
+	// Defaults to readinessTimeout
+	timeout time.Duration
+}
+
+// The checks that don't depend on the configuration: the external programs and the scratch dir's free space. Optional
+// programs that weren't found at startup aren't checked, since their steps are skipped.
+func (s *Server) defaultDependencyChecks() []healthCheck {
+	var checks []healthCheck
+	caps := imageprocessor.GetCapabilities()
+
+	for _, dep := range processorcommand.Dependencies {
+		if dep.Required || caps.Has(dep.Command) {
+			checks = append(checks, healthCheck{"command:" + dep.Command, dep.Check})
+		}
+	}
+
+	for _, lang := range processorcommand.TesseractLanguages {
+		if !caps.HasLanguage(lang) {
+			continue
+		}
+
+		lang := lang
+		checks = append(checks, healthCheck{"tesseract:" + lang, func(ctx context.Context) error {
+			return processorcommand.CheckTesseractLanguage(ctx, lang)
+		}})
+	}
+
+	checks = append(checks, healthCheck{"scratch_space", s.checkScratchSpace})
+
+	return checks
+}
+
+// A store check per configured store, named after its position and type like the config errors.
+func (s *Server) storeChecks(st *serverState) []healthCheck {
+	stores := []imagestore.ImageStore{st.imageStore}
+	if multi, ok := st.imageStore.(imagestore.MultiImageStore); ok {
+		stores = multi
+	}
+
+	checks := make([]healthCheck, len(stores))
+	for i, store := range stores {
+		store := store
+		name := fmt.Sprintf("store:%d:%s", i, st.config.Stores[i].StoreType())
+		checks[i] = healthCheck{name, func(ctx context.Context) error {
+			return s.checkStore(ctx, st, store)
+		}}
+	}
+
+	return checks
+}
+
+// Saves a canary object to the store and checks it can be found again.
+func (s *Server) checkStore(ctx context.Context, st *serverState, store imagestore.ImageStore) error {
+	canary, err := ioutil.TempFile(s.lifecycle.scratchDir, "canary")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(canary.Name())
+
+	data, _ := base64.StdEncoding.DecodeString(canaryGIF)
+	_, err = canary.Write(data)
+	canary.Close()
+	if err != nil {
+		return err
+	}
+
+	obj := imagestore.NewFactory(st.config).NewStoreObject(canaryID, "image/gif", canarySize)
+	obj.SetContext(ctx)
+
+	if _, err := store.Save(canary.Name(), obj); err != nil {
+		return err
+	}
+
+	exists, err := store.Exists(obj)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return errors.New("Saved canary object not found")
+	}
+
+	return nil
+}
+
+func (s *Server) checkScratchSpace(ctx context.Context) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.lifecycle.scratchDir, &stat); err != nil {
+		return err
+	}
+
+	free := stat.Bavail * uint64(stat.Bsize)
+	min := s.Config().MinFreeScratch()
+	if free < min {
+		return fmt.Errorf("%d MB free, less than %d MB", free/1024/1024, min/1024/1024)
+	}
+
+	return nil
+}
+
+// Runs the checks concurrently. Checks still running when ctx is done are reported as failing.
+func runChecks(ctx context.Context, checks []healthCheck) healthReport {
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	for _, c := range checks {
+		report.Checks[c.name] = checkResult{Status: "failing", Error: "Timed out"}
+	}
+
+	type named struct {
+		name   string
+		result checkResult
+	}
+	results := make(chan named, len(checks))
+
+	for _, c := range checks {
+		go func(c healthCheck) {
+			start := time.Now()
+			err := c.check(ctx)
+
+			result := checkResult{Status: "ok", DurationMs: float64(time.Since(start)) / float64(time.Millisecond)}
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+			results <- named{c.name, result}
+		}(c)
+	}
+
+wait:
+	for range checks {
+		select {
+		case r := <-results:
+			report.Checks[r.name] = r.result
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	for _, result := range report.Checks {
+		if result.Status != "ok" {
+			report.Status = "failing"
+		}
+	}
+
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	body, _ := json.Marshal(report)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// Liveness only says the process is serving requests, so a broken dependency doesn't get it restarted.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, healthReport{Status: "ok"})
+}
+
+// Readiness fails while draining, or if any store, external program or the scratch space isn't usable.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Draining() {
+		writeHealthReport(w, healthReport{Status: "draining"})
+		return
+	}
+
+	writeHealthReport(w, s.readinessReport(s.requestState(r)))
+}
+
+// The readiness report of st, run again once the last one is older than ReadinessCacheSeconds or was for the state
+// before a reload.
+func (s *Server) readinessReport(st *serverState) healthReport {
+	c := &s.readiness
+
+	c.mu.Lock()
+	for {
+		if c.state == st && time.Since(c.checked) < st.config.ReadinessCache() {
+			report := c.report
+			c.mu.Unlock()
+			return report
+		}
+
+		if c.running == nil {
+			break
+		}
+
+		running := c.running
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+	}
+
+	running := make(chan struct{})
+	c.running = running
+	c.mu.Unlock()
+
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = readinessTimeout
+	}
+
+	// Not the request's context, other requests are waiting for the report
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	checks := append(s.storeChecks(st), s.dependencyChecks...)
+	report := runChecks(ctx, checks)
+	cancel()
+
+	c.mu.Lock()
+	c.state, c.report, c.checked = st, report, time.Now()
+	c.running = nil
+	close(running)
+	c.mu.Unlock()
+
+	return report
+}
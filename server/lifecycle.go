@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracks whether the server is shutting down and the work it has to wait for before it can exit.
+type lifecycle struct {
+	draining   int32
+	background sync.WaitGroup
+	scratchDir string
+}
+
+func newScratchDir(parent string) (string, error) {
+	if parent == "" {
+		parent = os.TempDir()
+	}
+
+	return ioutil.TempDir(parent, "mandible")
+}
+
+// goBackground runs f in a goroutine that Shutdown waits for.
+func (s *Server) goBackground(f func()) {
+	s.lifecycle.background.Add(1)
+	go func() {
+		defer s.lifecycle.background.Done()
+		f()
+	}()
+}
+
+// Drain fails the readiness check so load balancers stop routing requests here. Requests are still served.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.lifecycle.draining, 1)
+}
+
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.lifecycle.draining) == 1
+}
+
+// Shutdown drains the server, waits for background jobs until ctx is done, flushes buffered stats and removes the
+// scratch directory. Stop the http.Server first so no new uploads start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Drain()
+
+	done := make(chan struct{})
+	go func() {
+		s.lifecycle.background.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.log().Error("Gave up waiting for background jobs", "error", err)
+	}
+
+	closeStats(s.stats)
+
+	if rmErr := os.RemoveAll(s.lifecycle.scratchDir); rmErr != nil && err == nil {
+		err = rmErr
+	}
+
+	return err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+// How many PDFs' page sizes are kept, the oldest are forgotten first
+const pdfPageCacheSize = 1024
+
+// The page sizes of uploaded PDFs by hash and density, so /thumbnail doesn't have to read them from the PDF again.
+type pdfPageCache struct {
+	mu    sync.Mutex
+	pages map[string][]processorcommand.PageSize
+	order []string
+}
+
+func pdfPageKey(hash string, density int) string {
+	return fmt.Sprintf("%s@%d", hash, density)
+}
+
+func (this *pdfPageCache) get(hash string, density int) ([]processorcommand.PageSize, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	pages, ok := this.pages[pdfPageKey(hash, density)]
+	return pages, ok
+}
+
+func (this *pdfPageCache) add(hash string, density int, pages []processorcommand.PageSize) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.pages == nil {
+		this.pages = make(map[string][]processorcommand.PageSize)
+	}
+
+	key := pdfPageKey(hash, density)
+	if _, ok := this.pages[key]; !ok {
+		this.order = append(this.order, key)
+	}
+	this.pages[key] = pages
+
+	for len(this.order) > pdfPageCacheSize {
+		delete(this.pages, this.order[0])
+		this.order = this.order[1:]
+	}
+}
+
+// The size of each page of a PDF upload, which needs ghostscript. Only up to one page past MaxPdfPages is read, PDFs
+// with more pages than that are rejected.
+func (s *Server) pdfPages(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile) ([]processorcommand.PageSize, *ServerResponse) {
+	if resp := pdfUnsupported(); resp != nil {
+		return nil, resp
+	}
+
+	limit := st.config.PdfPageLimit()
+	pages, err := processorcommand.PdfPageSizes(ctx, upload.GetPath(), st.config.PdfDensity(), 1, limit+1)
+	if err != nil || len(pages) == 0 {
+		logging.FromContext(ctx).Warn("Error reading PDF pages", "error", err)
+		return nil, &ServerResponse{
+			Error:  "Unable to read PDF!",
+			Status: http.StatusBadRequest,
+		}
+	}
+
+	if len(pages) > limit {
+		return nil, &ServerResponse{
+			Error:  fmt.Sprintf("PDFs can't have more than %d pages!", limit),
+			Status: http.StatusRequestEntityTooLarge,
+		}
+	}
+
+	return pages, nil
+}
+
+// Checks a stored PDF has page, counting from 1. The page sizes cached when it was uploaded are used if there are
+// any, otherwise only that page is read.
+func (s *Server) checkPdfPage(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, page int) *ServerResponse {
+	if resp := pdfUnsupported(); resp != nil {
+		return resp
+	}
+
+	notFound := &ServerResponse{
+		Status: http.StatusNotFound,
+		Error:  fmt.Sprintf("Page %d not found", page),
+	}
+
+	if page > st.config.PdfPageLimit() {
+		return notFound
+	}
+
+	density := st.config.PdfDensity()
+	pages, ok := s.pdfPageSizes.get(upload.GetHash(), density)
+	if !ok {
+		var err error
+		pages, err = processorcommand.PdfPageSizes(ctx, upload.GetPath(), density, page, page)
+		if err != nil {
+			logging.FromContext(ctx).Warn("Error reading PDF page", "page", page, "error", err)
+			return &ServerResponse{
+				Error:  "Unable to read PDF!",
+				Status: http.StatusBadRequest,
+			}
+		}
+
+		// Only the requested page was read
+		if len(pages) > 0 {
+			return nil
+		}
+	}
+
+	if page > len(pages) {
+		return notFound
+	}
+
+	return nil
+}
+
+func pdfUnsupported() *ServerResponse {
+	if imageprocessor.GetCapabilities().Has(processorcommand.GHOSTSCRIPT_COMMAND) {
+		return nil
+	}
+
+	return &ServerResponse{
+		Error:  "Unable to process PDFs!",
+		Status: http.StatusNotImplemented,
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response time buckets in seconds. Uploads that run OCR or fetch a remote URL can take tens of seconds.
+var responseTimeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PrometheusStats keeps metrics in memory and serves them in the Prometheus text format. Requests and response times
+// are labelled by route template, e.g. /user/{user_id}/url, rather than the request path.
+type PrometheusStats struct {
+	mu sync.Mutex
+
+	startTime    time.Time
+	requests     *counterVec
+	uploads      *counterVec
+	thumbnails   *counterVec
+	errors       *counterVec
+	responseTime *histogramVec
+	processTime  *histogramVec
+	commandTime  *histogramVec
+	storeTime    *histogramVec
+}
+
+func NewPrometheusStats() *PrometheusStats {
+	return &PrometheusStats{
+		requests:     newCounterVec("mandible_requests_total", "Requests received.", "route"),
+		uploads:      newCounterVec("mandible_uploads_total", "Uploads received.", "source"),
+		thumbnails:   newCounterVec("mandible_thumbnails_total", "Thumbnails generated.", "name"),
+		errors:       newCounterVec("mandible_errors_total", "Error responses.", "code"),
+		responseTime: newHistogramVec("mandible_response_time_seconds", "Time to respond to a request.", responseTimeBuckets, "route"),
+		processTime:  newHistogramVec("mandible_process_duration_seconds", "Time spent in each image processor.", responseTimeBuckets, "processor", "outcome"),
+		commandTime:  newHistogramVec("mandible_command_duration_seconds", "Time spent running each external command.", responseTimeBuckets, "command", "outcome"),
+		storeTime:    newHistogramVec("mandible_store_duration_seconds", "Time spent in each store operation.", responseTimeBuckets, "store", "operation", "outcome"),
+	}
+}
+
+func (p *PrometheusStats) LogStartup() {
+	p.mu.Lock()
+	p.startTime = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) Request(route string) {
+	p.mu.Lock()
+	p.requests.inc(route)
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) ResponseTime(elapsed time.Duration, route string) {
+	p.mu.Lock()
+	p.responseTime.observe(elapsed.Seconds(), route)
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) Thumbnail(name string) {
+	p.mu.Lock()
+	p.thumbnails.inc(name)
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) Upload(source string) {
+	p.mu.Lock()
+	p.uploads.inc(source)
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) Error(code int) {
+	p.mu.Lock()
+	p.errors.inc(strconv.Itoa(code))
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) ProcessTime(elapsed time.Duration, processor string, success bool) {
+	p.mu.Lock()
+	p.processTime.observe(elapsed.Seconds(), processor, outcome(success))
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) CommandTime(elapsed time.Duration, command string, success bool) {
+	p.mu.Lock()
+	p.commandTime.observe(elapsed.Seconds(), command, outcome(success))
+	p.mu.Unlock()
+}
+
+func (p *PrometheusStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {
+	p.mu.Lock()
+	p.storeTime.observe(elapsed.Seconds(), store, operation, outcome(success))
+	p.mu.Unlock()
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (p *PrometheusStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.startTime.IsZero() {
+		fmt.Fprintf(w, "# HELP mandible_start_time_seconds Unix time the server started.\n")
+		fmt.Fprintf(w, "# TYPE mandible_start_time_seconds gauge\n")
+		fmt.Fprintf(w, "mandible_start_time_seconds %s\n", formatFloat(float64(p.startTime.UnixNano())/1e9))
+	}
+
+	p.requests.write(w)
+	p.uploads.write(w)
+	p.thumbnails.write(w)
+	p.errors.write(w)
+	p.responseTime.write(w)
+	p.processTime.write(w)
+	p.commandTime.write(w)
+	p.storeTime.write(w)
+}
+
+// Label values are joined with a byte that can't appear in UTF-8 to key the series of a vector.
+const labelSeparator = "\xff"
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name, help, labels, map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatLabels(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name, help, labels, buckets, map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		labels := formatLabels(h.labels, key)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, hist.count)
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	values := strings.Split(key, labelSeparator)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
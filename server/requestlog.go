@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Imgur/mandible/logging"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// Request IDs from clients longer than this are replaced rather than logged.
+const maxRequestIDLength = 128
+
+// Headers that are never logged.
+var secretHeaders = []string{"Authorization", "X-Authorization-HMAC", "X-Admin-Key", "Cookie"}
+
+// What handlers learn about a request that belongs in its access log line.
+type requestInfo struct {
+	route  string
+	userID string
+	uid    string
+	params map[string]string
+}
+
+type requestInfoKey struct{}
+
+// Returns the request's access log details for handlers to fill in, or a throwaway value outside of s.logged.
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+
+	return &requestInfo{}
+}
+
+// SetLogger sets the logger that request loggers are derived from. It defaults to logging.Default().
+func (s *Server) SetLogger(logger logging.Logger) {
+	s.logger = logger
+}
+
+func (s *Server) log() logging.Logger {
+	if s.logger == nil {
+		return logging.Default()
+	}
+
+	return s.logger
+}
+
+// Assigns the request an ID, honoring one sent in X-Request-ID and echoing it in the response, and puts a logger
+// that includes it in the request's context. Writes the access log line once the request is done.
+func (s *Server) logged(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := s.log().With("request_id", requestID)
+		info := &requestInfo{}
+
+		ctx := logging.NewContext(r.Context(), logger)
+		ctx = context.WithValue(ctx, requestInfoKey{}, info)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r.WithContext(ctx))
+
+		if !s.Config().AccessLog {
+			return
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		logger.Info("Request",
+			"method", r.Method,
+			"route", info.route,
+			"path", r.URL.Path,
+			"params", info.params,
+			"status", status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start))/float64(time.Millisecond),
+			"user_id", info.userID,
+			"uid", info.uid,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Form values can be whole base64 images or secrets, so only their size is logged.
+func redactValues(values url.Values) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	redacted := make(map[string]string, len(values))
+	for key, vals := range values {
+		size := 0
+		for _, v := range vals {
+			size += len(v)
+		}
+		redacted[key] = "REDACTED (" + strconv.Itoa(size) + " bytes)"
+	}
+
+	return redacted
+}
+
+func redactHeaders(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for key, vals := range header {
+		redacted[key] = vals
+	}
+
+	for _, key := range secretHeaders {
+		if redacted.Get(key) != "" {
+			redacted.Set(key, "REDACTED")
+		}
+	}
+
+	return redacted
+}
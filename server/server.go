@@ -1,35 +1,56 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/Imgur/mandible/config"
 	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/imagestore"
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/tracing"
 	"github.com/Imgur/mandible/uploadedfile"
 )
 
 type Server struct {
-	Config            *config.Configuration
-	HTTPClient        *http.Client
-	ImageStore        imagestore.ImageStore
-	hashGenerator     *imagestore.HashGenerator
-	processorStrategy imageprocessor.ImageProcessorStrategy
-	authenticator     Authenticator
-	stats             RuntimeStats
+	HTTPClient         *http.Client
+	processorStrategy  imageprocessor.ImageProcessorStrategy
+	fixedAuthenticator Authenticator
+	stats              RuntimeStats
+
+	stateMu sync.RWMutex
+	state   *serverState
+
+	reloadMu     sync.Mutex
+	configLoader func() (*config.Configuration, error)
+
+	lifecycle lifecycle
+
+	tracer *tracing.Tracer
+	logger logging.Logger
+
+	// Checked by /readyz along with the stores
+	dependencyChecks []healthCheck
+	readiness        readinessCache
+
+	pendingThumbs pendingThumbs
+	pdfPageSizes  pdfPageCache
 }
 
 type ServerResponse struct {
@@ -39,11 +60,22 @@ type ServerResponse struct {
 	Success *bool       `json:"success"` // the empty value is the nil pointer, because this is a computed property
 }
 
+// Write writes the response, logging errors with the default logger. Send logs them with the request's logger, so
+// they have its request ID.
 func (resp *ServerResponse) Write(w http.ResponseWriter, s RuntimeStats) {
+	resp.write(w, logging.Default(), s)
+}
+
+// Send writes the response to the request r.
+func (resp *ServerResponse) Send(w http.ResponseWriter, r *http.Request, s RuntimeStats) {
+	resp.write(w, logging.FromContext(r.Context()), s)
+}
+
+func (resp *ServerResponse) write(w http.ResponseWriter, logger logging.Logger, s RuntimeStats) {
 	respBytes, _ := resp.json()
 
 	if resp.Status >= http.StatusBadRequest {
-		log.Println(fmt.Sprintf("HTTP error: %d -- %s", resp.Status, resp.Error))
+		logger.Warn("HTTP error", "status", resp.Status, "error", resp.Error)
 		s.Error(resp.Status)
 	}
 
@@ -74,6 +106,32 @@ type ImageResponse struct {
 	OCRText string                 `json:"ocrtext"`
 	Thumbs  map[string]interface{} `json:"thumbs"`
 	UserID  string                 `json:"user_id"`
+	// With BackgroundThumbs, whether each of Thumbs is pending or ready
+	ThumbStatus map[string]string `json:"thumb_status,omitempty"`
+	// Other formats of the upload, i.e. mp4 and webm of animated GIFs
+	Renditions map[string]RenditionResponse `json:"renditions,omitempty"`
+	// The pages of PDFs, in pixels at PdfDPI. Width and Height are the first page's.
+	PageCount int            `json:"page_count,omitempty"`
+	Pages     []PageResponse `json:"pages,omitempty"`
+	// Video uploads' length and codec. Width and Height are its resolution.
+	Video *VideoResponse `json:"video,omitempty"`
+}
+
+type VideoResponse struct {
+	Duration float64 `json:"duration"`
+	Codec    string  `json:"codec"`
+}
+
+type PageResponse struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type RenditionResponse struct {
+	Link     string  `json:"link"`
+	Mime     string  `json:"mime"`
+	Duration float64 `json:"duration,omitempty"`
+	Frames   int     `json:"frames,omitempty"`
 }
 
 type OcrResponse struct {
@@ -86,108 +144,241 @@ type UserError struct {
 	LogMessage        error
 }
 
-func NewServer(c *config.Configuration, strategy imageprocessor.ImageProcessorStrategy, stats RuntimeStats) *Server {
-	factory := imagestore.NewFactory(c)
-	httpclient := &http.Client{}
-	stores := factory.NewImageStores()
+func (s *Server) observeProcess(processor string, elapsed time.Duration, err error) {
+	s.stats.ProcessTime(elapsed, processor, err == nil)
+}
+
+func (s *Server) observeStore(store, operation string, elapsed time.Duration, err error) {
+	s.stats.StoreTime(elapsed, store, operation, err == nil)
+}
 
-	hashGenerator := factory.NewHashGenerator(stores)
-	authenticator := &PassthroughAuthenticator{}
-	return &Server{c, httpclient, stores, hashGenerator, strategy, authenticator, stats}
+// NewServer creates a server whose authenticator is built from the configuration: HMAC authentication if
+// AuthenticationHMACKey is set, no authentication otherwise.
+func NewServer(c *config.Configuration, strategy imageprocessor.ImageProcessorStrategy, stats RuntimeStats) (*Server, error) {
+	return NewAuthenticatedServer(c, strategy, nil, stats)
 }
 
-func NewAuthenticatedServer(c *config.Configuration, strategy imageprocessor.ImageProcessorStrategy, auth Authenticator, stats RuntimeStats) *Server {
-	factory := imagestore.NewFactory(c)
-	httpclient := &http.Client{}
-	stores := factory.NewImageStores()
+// NewAuthenticatedServer creates a server that always uses auth, regardless of the configuration.
+func NewAuthenticatedServer(c *config.Configuration, strategy imageprocessor.ImageProcessorStrategy, auth Authenticator, stats RuntimeStats) (*Server, error) {
+	s := &Server{
+		HTTPClient:         &http.Client{},
+		processorStrategy:  strategy,
+		fixedAuthenticator: auth,
+		stats:              stats,
+	}
 
-	hashGenerator := factory.NewHashGenerator(stores)
-	return &Server{c, httpclient, stores, hashGenerator, strategy, auth, stats}
+	st, err := s.newState(c)
+	if err != nil {
+		return nil, err
+	}
+	s.state = st
+	s.dependencyChecks = s.defaultDependencyChecks()
+
+	s.lifecycle.scratchDir, err = newScratchDir(c.ScratchDir)
+	if err != nil {
+		st.hashGenerator.Stop()
+		return nil, err
+	}
+
+	return s, nil
 }
 
-func (s *Server) uploadFile(uploadFile io.Reader, fileName string, thumbs []*uploadedfile.ThumbFile, user *AuthenticatedUser) ServerResponse {
-	tmpFile, err := saveToTmp(uploadFile)
+func (s *Server) uploadFile(ctx context.Context, st *serverState, strategy imageprocessor.ImageProcessorStrategy, uploadFile io.Reader, fileName string, thumbs []*uploadedfile.ThumbFile, user *AuthenticatedUser) ServerResponse {
+	logger := logging.FromContext(ctx)
+
+	tmpFile, err := s.saveToTmp(uploadFile)
 	if err != nil {
+		logger.Error("Error saving upload to scratch space", "error", err)
 		return ServerResponse{
 			Error:  "Error saving to disk!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	upload, err := uploadedfile.NewUploadedFile(fileName, tmpFile, thumbs)
+	// Background thumbnails are left out of processing, and created from the processed upload once it's stored
+	background := st.config.BackgroundThumbs && len(thumbs) > 0
+	processThumbs := thumbs
+	if background {
+		processThumbs = nil
+	}
+
+	upload, err := uploadedfile.NewUploadedFile(fileName, tmpFile, processThumbs)
+	if err != nil {
+		os.Remove(tmpFile)
+		return validationResponse(ctx, err)
+	}
 	defer upload.Clean()
 
+	limits := uploadedfile.Limits{
+		MaxPixels: st.config.MaxImagePixels(),
+		MaxFrames: st.config.MaxImageFrames(),
+		MaxPages:  st.config.PdfPageLimit(),
+	}
+	if err := upload.Validate(limits); err != nil {
+		return validationResponse(ctx, err)
+	}
+
+	var userID string
+	if user != nil {
+		userID = string(user.UserID)
+	}
+
+	// The type and size of the upload are checked against its policies as it was received, its dimensions once it's
+	// oriented, before thumbnails are made and OCR is run
+	policies := st.config.PoliciesFor(getRequestInfo(ctx).route, userID)
+
+	size, err := upload.FileSize()
 	if err != nil {
 		return ServerResponse{
-			Error:  "Error detecting mime type!",
+			Error:  "Unable to fetch image metadata!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	processor, err := s.processorStrategy(s.Config, upload)
+	if resp := policyResponse(st, policies, func(name string, policy config.UploadPolicy) []config.PolicyViolation {
+		return policy.CheckFile(name, upload.GetMime(), size)
+	}); resp != nil {
+		return *resp
+	}
+
+	// PDFs are only accepted on the PdfRoutes
+	var pages []processorcommand.PageSize
+	if upload.IsPdf() {
+		if !st.config.AcceptsPdf(getRequestInfo(ctx).route) {
+			return ServerResponse{
+				Error:  "PDFs aren't accepted on this route!",
+				Status: http.StatusUnsupportedMediaType,
+			}
+		}
+
+		var resp *ServerResponse
+		pages, resp = s.pdfPages(ctx, st, upload)
+		if resp != nil {
+			return *resp
+		}
+
+		for _, t := range thumbs {
+			t.DPI = st.config.PdfDensity()
+		}
+	}
+
+	var video *processorcommand.VideoInfo
+	if upload.IsVideo() {
+		var resp *ServerResponse
+		video, resp = s.probeVideo(ctx, st, upload)
+		if resp != nil {
+			return *resp
+		}
+
+		for _, t := range thumbs {
+			t.PosterSeconds = st.config.PosterFrame(video.Duration)
+		}
+	}
+
+	processor, err := strategy(st.config, upload)
 	if err != nil {
-		log.Printf("Error creating processor factory: %s", err.Error())
+		logger.Error("Error creating processor factory", "error", err)
 		return ServerResponse{
 			Error:  "Unable to process image!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	err = processor.Run(upload)
+	processor.Observe(s.observeProcess)
+
+	var policyResp *ServerResponse
+	if len(policies) > 0 {
+		processor.AfterOrienting(func(image *uploadedfile.UploadedFile) error {
+			width, height, err := uploadDimensions(image, pages, video)
+			if err != nil {
+				return err
+			}
+
+			policyResp = policyResponse(st, policies, func(name string, policy config.UploadPolicy) []config.PolicyViolation {
+				return policy.CheckDimensions(name, width, height)
+			})
+			if policyResp != nil {
+				return errPolicyViolation
+			}
+
+			return nil
+		})
+	}
+
+	err = processor.Run(ctx, upload)
+	if policyResp != nil {
+		return *policyResp
+	}
+
 	if err != nil {
-		log.Printf("Error processing %+v: %s", upload, err.Error())
+		logger.Error("Error processing upload", "mime", upload.GetMime(), "error", err)
 		return ServerResponse{
 			Error:  "Unable to process image!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	upload.SetHash(s.hashGenerator.Get())
+	width, height, err := uploadDimensions(upload, pages, video)
+	if err != nil {
+		return ServerResponse{
+			Error:  "Error fetching upload dimensions: " + err.Error(),
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	_, hashSpan := tracing.StartSpan(ctx, "hash")
+	upload.SetHash(st.hashGenerator.Get())
+	hashSpan.SetAttribute("hash", upload.GetHash())
+	hashSpan.End()
+	getRequestInfo(ctx).uid = upload.GetHash()
 
-	factory := imagestore.NewFactory(s.Config)
+	factory := imagestore.NewFactory(st.config)
 	obj := factory.NewStoreObject(upload.GetHash(), upload.GetMime(), "original")
+	obj.UserID = userID
+	obj.SetContext(ctx)
 
 	uploadFilepath := upload.GetPath()
-	obj, err = s.ImageStore.Save(uploadFilepath, obj)
+	obj, err = st.imageStore.Save(uploadFilepath, obj)
 	if err != nil {
-		log.Printf("Error saving processed output to store: %s", err.Error())
+		logger.Error("Error saving processed output to store", "error", err)
 		return ServerResponse{
 			Error:  "Unable to save image!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	thumbsResp, err := s.buildThumbResponse(upload)
+	var thumbsResp map[string]interface{}
+	var thumbStatus map[string]string
+	if background {
+		thumbsResp, thumbStatus, err = s.backgroundThumbs(ctx, st, upload, obj, thumbs)
+	} else {
+		thumbsResp, err = s.buildThumbResponse(ctx, st, upload, obj)
+	}
 	if err != nil {
-		log.Printf("Error processing %+v: %s", upload, err.Error())
+		logger.Error("Error storing thumbnails", "error", err)
 		return ServerResponse{
 			Error:  "Unable to process thumbnail!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	size, err := upload.FileSize()
+	renditionsResp, err := s.storeRenditions(ctx, st, upload, obj)
 	if err != nil {
+		logger.Error("Error storing renditions", "error", err)
 		return ServerResponse{
-			Error:  "Unable to fetch image metadata!",
+			Error:  "Unable to save image!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	width, height, err := upload.Dimensions()
-
+	size, err = upload.FileSize()
 	if err != nil {
 		return ServerResponse{
-			Error:  "Error fetching upload dimensions: " + err.Error(),
+			Error:  "Unable to fetch image metadata!",
 			Status: http.StatusInternalServerError,
 		}
 	}
 
-	var userID string
-	if user != nil {
-		userID = string(user.UserID)
-	}
-
 	resp := ImageResponse{
 		Link:    obj.Url,
 		Mime:    obj.MimeType,
@@ -199,6 +390,22 @@ func (s *Server) uploadFile(uploadFile io.Reader, fileName string, thumbs []*upl
 		OCRText: upload.GetOCRText(),
 		Thumbs:  thumbsResp,
 		UserID:  userID,
+
+		ThumbStatus: thumbStatus,
+		Renditions:  renditionsResp,
+	}
+
+	if video != nil {
+		resp.Video = &VideoResponse{video.Duration, video.Codec}
+	}
+
+	if len(pages) > 0 {
+		s.pdfPageSizes.add(upload.GetHash(), st.config.PdfDensity(), pages)
+
+		resp.PageCount = len(pages)
+		for _, page := range pages {
+			resp.Pages = append(resp.Pages, PageResponse{page.Width, page.Height})
+		}
 	}
 
 	return ServerResponse{
@@ -207,11 +414,11 @@ func (s *Server) uploadFile(uploadFile io.Reader, fileName string, thumbs []*upl
 	}
 }
 
-type fileExtractor func(r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError)
+type fileExtractor func(ctx context.Context, r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError)
 
 func (s *Server) Configure(muxer *http.ServeMux) {
 
-	var extractorFile fileExtractor = func(r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
+	var extractorFile fileExtractor = func(ctx context.Context, r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
 		uploadFile, header, err := r.FormFile("image")
 		if err != nil {
 			return nil, "", &UserError{LogMessage: err, UserFacingMessage: errors.New("Error processing file")}
@@ -221,9 +428,9 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 		return uploadFile, header.Filename, nil
 	}
 
-	var extractorUrl fileExtractor = func(r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
+	var extractorUrl fileExtractor = func(ctx context.Context, r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
 		url := r.FormValue("image")
-		uploadFile, err := s.download(url)
+		uploadFile, err := s.download(ctx, s.requestState(r), url)
 
 		if err != nil {
 			return nil, "", &UserError{LogMessage: err, UserFacingMessage: errors.New("Error downloading URL!")}
@@ -233,7 +440,7 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 		return uploadFile, path.Base(url), nil
 	}
 
-	var extractorBase64 fileExtractor = func(r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
+	var extractorBase64 fileExtractor = func(ctx context.Context, r *http.Request) (uploadFile io.Reader, filename string, uerr *UserError) {
 		input := r.FormValue("image")
 		b64data := input[strings.IndexByte(input, ',')+1:]
 
@@ -247,28 +454,53 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 
 	var uploadHandler uploadEndpoint = func(extractor fileExtractor, user *AuthenticatedUser) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			uploadFile, filename, uerr := extractor(r)
+			ctx := r.Context()
+			st := s.requestState(r)
+
+			// A pipeline asked for by the request wins over the one configured for the route
+			pipeline := r.FormValue("pipeline")
+			if pipeline == "" {
+				pipeline = st.config.RoutePipelines[getRequestInfo(ctx).route]
+			}
+
+			strategy, err := s.strategy(st, pipeline)
+			if err != nil {
+				resp := ServerResponse{
+					Status: http.StatusBadRequest,
+					Error:  err.Error(),
+				}
+				resp.Send(w, r, s.stats)
+				return
+			}
+
+			extractCtx, extractSpan := tracing.StartSpan(ctx, "extract")
+			uploadFile, filename, uerr := extractor(extractCtx, r)
 			if uerr != nil {
-				log.Printf("Error extracting files: %s", uerr.LogMessage.Error())
+				extractSpan.SetError(uerr.LogMessage)
+			}
+			extractSpan.End()
+
+			if uerr != nil {
+				logging.FromContext(ctx).Warn("Error extracting files", "error", uerr.LogMessage)
 				resp := ServerResponse{
 					Status: http.StatusBadRequest,
 					Error:  uerr.UserFacingMessage.Error(),
 				}
-				resp.Write(w, s.stats)
+				resp.Send(w, r, s.stats)
 				return
 			}
 
-			thumbs, err := parseThumbs(r)
+			thumbs, err := requestedThumbs(st.config, r, true)
 			if err != nil {
 				resp := ServerResponse{
 					Status: http.StatusBadRequest,
-					Error:  "Error parsing thumbnails!",
+					Error:  err.Error(),
 				}
-				resp.Write(w, s.stats)
+				resp.Send(w, r, s.stats)
 				return
 			}
 
-			resp := s.uploadFile(uploadFile, filename, thumbs, user)
+			resp := s.uploadFile(ctx, st, strategy, uploadFile, filename, thumbs, user)
 
 			switch uploadFile.(type) {
 			case io.ReadCloser:
@@ -278,7 +510,7 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 				break
 			}
 
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 		}
 	}
 
@@ -294,52 +526,67 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 				return
 			}
 
-			user, err := s.authenticator.GetUser(r)
+			user, err := s.requestState(r).authenticator.GetUser(r)
 
 			// Their HMAC was invalid or they are trying to upload to someone else's account
 			if user == nil || err != nil || user.UserID != attemptedUserIdString {
 				w.WriteHeader(http.StatusUnauthorized)
-				log.Printf("Authentication error: %s", err.Error())
+				logging.FromContext(r.Context()).Warn("Authentication error", "user_id", attemptedUserIdString, "error", err)
 				return
 			}
 
+			getRequestInfo(r.Context()).userID = user.UserID
+
 			handler := endpoint(extractor, user)
 			handler(w, r)
 		}
 	}
 
 	ocrHandler := func(w http.ResponseWriter, r *http.Request) {
+		st := s.requestState(r)
 		imageID := r.FormValue("uid")
+		getRequestInfo(r.Context()).uid = imageID
 		if imageID == "" {
 			resp := ServerResponse{
 				Status: http.StatusBadRequest,
 				Error:  "Image ID must be passed as \"uid\"",
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
+			return
+		}
+
+		processor := imageprocessor.AvailableOCRStrategy()
+		if processor == nil {
+			resp := ServerResponse{
+				Error:  "OCR is unavailable",
+				Status: http.StatusNotImplemented,
+			}
+			resp.Send(w, r, s.stats)
 			return
 		}
 
-		factory := imagestore.NewFactory(s.Config)
+		factory := imagestore.NewFactory(st.config)
 		tObj := factory.NewStoreObject(imageID, "", "original")
+		tObj.SetContext(r.Context())
 
-		storeReader, err := s.ImageStore.Get(tObj)
+		storeReader, err := st.imageStore.Get(tObj)
 		if err != nil {
 			resp := ServerResponse{
 				Status: http.StatusBadRequest,
 				Error:  fmt.Sprintf("Error retrieving image with ID: %s", imageID),
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		defer storeReader.Close()
 
-		storeFile, err := saveToTmp(storeReader)
+		storeFile, err := s.saveToTmp(storeReader)
 		if err != nil {
 			resp := ServerResponse{
 				Status: http.StatusBadRequest,
 				Error:  fmt.Sprintf("Error saving original image to tmpfile: %s", imageID),
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		defer os.Remove(storeFile)
@@ -350,22 +597,20 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 				Error:  fmt.Sprintf("Unable to generate UploadedFile object: %s", imageID),
 				Status: http.StatusInternalServerError,
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		upload.SetHash(imageID)
 		defer upload.Clean()
 
-		//TODO: fix this sp error:
-		processor := imageprocessor.DuelOCRStratagy()
-		err = processor.Process(upload)
+		err = processor.Process(r.Context(), upload)
 		if err != nil {
-			log.Printf("Error runinng DuelOCRStrategy on %+v: %s", upload, err.Error())
+			logging.FromContext(r.Context()).Error("Error running DuelOCRStrategy", "uid", imageID, "error", err)
 			resp := ServerResponse{
 				Error:  "Unable to execute OCR strategy",
 				Status: http.StatusInternalServerError,
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 
@@ -379,22 +624,25 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 			Status: http.StatusOK,
 		}
 
-		resp.Write(w, s.stats)
+		resp.Send(w, r, s.stats)
 	}
 
 	thumbnailHandler := func(w http.ResponseWriter, r *http.Request) {
+		st := s.requestState(r)
 		imageID := r.FormValue("uid")
+		getRequestInfo(r.Context()).uid = imageID
 
-		factory := imagestore.NewFactory(s.Config)
+		factory := imagestore.NewFactory(st.config)
 		tObj := factory.NewStoreObject(imageID, "", "original")
+		tObj.SetContext(r.Context())
 
-		thumbs, err := parseThumbs(r)
+		thumbs, err := requestedThumbs(st.config, r, false)
 		if err != nil {
 			resp := ServerResponse{
 				Status: http.StatusBadRequest,
-				Error:  "Error parsing thumbnails!",
+				Error:  err.Error(),
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 
@@ -403,76 +651,130 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 				Status: http.StatusBadRequest,
 				Error:  "Wrong number of thumbnails, expected 1",
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 
-		storeReader, err := s.ImageStore.Get(tObj)
+		// The page of a PDF, the thumbnails of pages after the first are stored apart from the first's
+		page := 1
+		if p := r.FormValue("page"); p != "" {
+			page, err = strconv.Atoi(p)
+			if err != nil || page < 1 {
+				resp := ServerResponse{
+					Status: http.StatusBadRequest,
+					Error:  "page must be a positive integer",
+				}
+				resp.Send(w, r, s.stats)
+				return
+			}
+		}
+		if page > 1 {
+			thumbs[0].Name = fmt.Sprintf("%s_page%d", thumbs[0].Name, page)
+		}
+
+		// Presets may already be stored by the upload, unless they're still being created in the background
+		if r.FormValue("thumbs") == "" && s.serveStoredThumb(w, r, st, imageID, thumbs[0]) {
+			return
+		}
+
+		storeReader, err := st.imageStore.Get(tObj)
 		if err != nil {
 			resp := ServerResponse{
 				Status: http.StatusNotFound,
 				Error:  fmt.Sprintf("Error retrieving image with ID: %s", imageID),
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		defer storeReader.Close()
 
-		storeFile, err := saveToTmp(storeReader)
+		storeFile, err := s.saveToTmp(storeReader)
 		if err != nil {
 			resp := ServerResponse{
 				Status: http.StatusInternalServerError,
 				Error:  "Error saving original Image!",
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		defer os.Remove(storeFile)
 
 		upload, err := uploadedfile.NewUploadedFile("", storeFile, thumbs)
 		if err != nil {
-			log.Printf("Error processing %+v: %s", storeFile, err.Error())
+			logging.FromContext(r.Context()).Error("Error reading original", "uid", imageID, "error", err)
 			resp := ServerResponse{
 				Error:  "Unable to process thumbnail!",
 				Status: http.StatusInternalServerError,
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 		upload.SetHash(imageID)
 		defer upload.Clean()
 
-		processor, _ := imageprocessor.ThumbnailStrategy(s.Config, upload)
-		err = processor.Run(upload)
+		if page > 1 && !upload.IsPdf() {
+			resp := ServerResponse{
+				Status: http.StatusBadRequest,
+				Error:  "Only PDFs have pages",
+			}
+			resp.Send(w, r, s.stats)
+			return
+		}
+
+		if upload.IsPdf() {
+			if errResp := s.checkPdfPage(r.Context(), st, upload, page); errResp != nil {
+				errResp.Send(w, r, s.stats)
+				return
+			}
+
+			thumbs[0].Page = page
+			thumbs[0].DPI = st.config.PdfDensity()
+		}
+
+		if upload.IsVideo() {
+			video, errResp := s.probeVideo(r.Context(), st, upload)
+			if errResp != nil {
+				errResp.Send(w, r, s.stats)
+				return
+			}
+
+			thumbs[0].PosterSeconds = st.config.PosterFrame(video.Duration)
+		}
+
+		processor, _ := imageprocessor.ThumbnailStrategy(st.config, upload)
+		processor.Observe(s.observeProcess)
+		err = processor.Run(r.Context(), upload)
 		if err != nil {
-			log.Printf("Error processing %+v: %s", upload, err.Error())
+			logging.FromContext(r.Context()).Error("Error processing thumbnail", "uid", imageID, "error", err)
 			resp := ServerResponse{
 				Error:  "Unable to process thumbnail!",
 				Status: http.StatusInternalServerError,
 			}
-			resp.Write(w, s.stats)
+			resp.Send(w, r, s.stats)
 			return
 		}
 
 		ts := upload.GetThumbs()
 		t := ts[0]
 
-		if !t.GetNoStore() {
-			thumbName := fmt.Sprintf("%s/%s", upload.GetHash(), t.Name)
-			tObj = factory.NewStoreObject(thumbName, upload.GetMime(), "thumbnail")
-			err = tObj.Store(t, s.ImageStore)
+		// A thumbnail still being created in the background is served without storing it, the job stores it
+		thumbName := fmt.Sprintf("%s/%s", upload.GetHash(), t.Name)
+		if !t.GetNoStore() && !s.pendingThumbs.isPending(thumbName) {
+			tObj = factory.NewStoreObject(thumbName, t.GetOutputFormat(upload).ToMime(), "thumbnail")
+			tObj.SetContext(r.Context())
+			err = tObj.Store(t, st.imageStore)
 			if err != nil {
-				log.Printf("Error storing %+v: %s", t, err.Error())
+				logging.FromContext(r.Context()).Error("Error storing thumbnail", "uid", imageID, "thumbnail", t.Name, "error", err)
 				resp := ServerResponse{
 					Error:  "Unable to store thumbnail!",
 					Status: http.StatusInternalServerError,
 				}
-				resp.Write(w, s.stats)
+				resp.Send(w, r, s.stats)
 				return
 			}
 		}
 
-		s.stats.Thumbnail(t.Name)
+		s.stats.Thumbnail(thumbStatName(st.config, t.Name))
 
 		http.ServeFile(w, r, t.GetPath())
 	}
@@ -484,68 +786,307 @@ func (s *Server) Configure(muxer *http.ServeMux) {
 		fmt.Fprint(w, "</body></html>")
 	}
 
-	requestMiddleware := func(handler http.HandlerFunc) http.HandlerFunc {
+	requestMiddleware := func(route string, handler http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			s.stats.Request(r.URL.Path)
+			s.stats.Request(route)
+
+			span := tracing.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttribute("http.route", route)
+
+			info := getRequestInfo(r.Context())
+			info.route = route
 
 			if os.Getenv("MANDIBLE_DEBUG") == "true" {
 				r.ParseForm()
-				log.Printf("Request url: %s with get params: %v and Headers: %v", r.URL.Path, r.Form, r.Header)
+				logging.FromContext(r.Context()).Debug("Request", "path", r.URL.Path, "params", redactValues(r.Form), "headers", redactHeaders(r.Header))
 			}
 
 			start := time.Now()
 			handler(w, r)
 			elapsed := time.Since(start)
 
-			s.stats.ResponseTime(elapsed, r.URL.Path)
+			// Handlers parse the form themselves, the values can be whole images so only their sizes are logged
+			info.params = redactValues(r.Form)
+
+			s.stats.ResponseTime(elapsed, route)
 		}
 	}
 
 	router := mux.NewRouter()
 
-	router.HandleFunc("/file", requestMiddleware(uploadHandler(extractorFile, nil)))
-	router.HandleFunc("/url", requestMiddleware(uploadHandler(extractorUrl, nil)))
-	router.HandleFunc("/base64", requestMiddleware(uploadHandler(extractorBase64, nil)))
+	// Stats are labelled with the route template so that paths like /user/{user_id} don't explode their cardinality
+	handle := func(route string, handler http.HandlerFunc) {
+		router.HandleFunc(route, requestMiddleware(route, handler))
+	}
+
+	handle("/file", uploadHandler(extractorFile, nil))
+	handle("/url", uploadHandler(extractorUrl, nil))
+	handle("/base64", uploadHandler(extractorBase64, nil))
+
+	handle("/user/{user_id}/file", authenticatedEndpoint(uploadHandler, extractorBase64))
+	handle("/user/{user_id}/url", authenticatedEndpoint(uploadHandler, extractorUrl))
+	handle("/user/{user_id}/base64", authenticatedEndpoint(uploadHandler, extractorBase64))
+
+	handle("/thumbnail", thumbnailHandler)
+
+	handle("/ocr", ocrHandler)
+	router.HandleFunc("/healthz", s.healthHandler)
+	router.HandleFunc("/readyz", s.readyHandler)
+	handle("/admin/reload", s.adminEndpoint(s.reloadHandler))
+	handle("/admin/capabilities", s.adminEndpoint(s.capabilitiesHandler))
+
+	handle("/", rootHandler)
+
+	if s.Config().ServesMetrics() {
+		if metrics, ok := metricsHandler(s.stats); ok {
+			muxer.Handle("/metrics", metrics)
+		} else {
+			s.log().Warn("A prometheus stats backend is configured but the server wasn't given PrometheusStats, not serving /metrics")
+		}
+	}
+
+	muxer.Handle("/", s.logged(s.traced(s.withState(router))))
+}
+
+// Queues the thumbnails to be created in the background, or creates them now if the queue is full. Also returns
+// whether each is pending or ready.
+func (s *Server) backgroundThumbs(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, original *imagestore.StoreObject, thumbs []*uploadedfile.ThumbFile) (map[string]interface{}, map[string]string, error) {
+	status := ThumbPending
+	thumbsResp, err := s.queueThumbs(ctx, st, upload, original, thumbs)
+	if err == errThumbQueueFull {
+		logging.FromContext(ctx).Warn("Thumbnail queue is full, creating thumbnails before responding")
+
+		status = ThumbReady
+		upload.SetThumbs(thumbs)
+		thumbsResp, err = s.createThumbs(ctx, st, upload, original)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumbStatus := make(map[string]string, len(thumbsResp))
+	for name := range thumbsResp {
+		thumbStatus[name] = status
+	}
+
+	return thumbsResp, thumbStatus, nil
+}
+
+// Serves the stored copy of a thumbnail, reporting false if there isn't one to serve.
+func (s *Server) serveStoredThumb(w http.ResponseWriter, r *http.Request, st *serverState, imageID string, t *uploadedfile.ThumbFile) bool {
+	thumbName := fmt.Sprintf("%s/%s", imageID, t.Name)
+	if t.GetNoStore() || s.pendingThumbs.isPending(thumbName) {
+		return false
+	}
+
+	tObj := imagestore.NewFactory(st.config).NewStoreObject(thumbName, "", "thumbnail")
+	tObj.SetContext(r.Context())
+
+	reader, err := st.imageStore.Get(tObj)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Error reading stored thumbnail", "uid", imageID, "thumbnail", t.Name, "error", err)
+		return false
+	}
+
+	s.stats.Thumbnail(thumbStatName(st.config, t.Name))
+
+	http.ServeContent(w, r, t.Name, time.Time{}, bytes.NewReader(data))
+	return true
+}
+
+// The store object of a thumbnail of upload. original supplies the uploader and upload time used in store paths.
+func thumbObject(factory *imagestore.Factory, upload *uploadedfile.UploadedFile, t *uploadedfile.ThumbFile, original *imagestore.StoreObject) *imagestore.StoreObject {
+	thumbName := fmt.Sprintf("%s/%s", upload.GetHash(), t.Name)
+	tObj := factory.NewStoreObject(thumbName, t.GetOutputFormat(upload).ToMime(), "thumbnail")
+	tObj.UserID = original.UserID
+	tObj.CreatedAt = original.CreatedAt
+
+	return tObj
+}
+
+// The response to an upload failing validation: a 400 if it isn't the type it looks like, a 422 if it's truncated or
+// corrupt, and a 413 if it's too large to process.
+func validationResponse(ctx context.Context, err error) ServerResponse {
+	verr, ok := err.(*uploadedfile.ValidationError)
+	if !ok {
+		logging.FromContext(ctx).Error("Error validating upload", "error", err)
+		return ServerResponse{
+			Error:  "Unable to validate image!",
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	status := http.StatusBadRequest
+	switch verr.Reason {
+	case uploadedfile.Corrupt:
+		status = http.StatusUnprocessableEntity
+	case uploadedfile.TooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case uploadedfile.Unsupported:
+		status = http.StatusUnsupportedMediaType
+	}
+
+	return ServerResponse{
+		Error:  verr.Message,
+		Status: status,
+	}
+}
+
+// The size of an upload: its first page's for PDFs, its resolution for videos.
+func uploadDimensions(upload *uploadedfile.UploadedFile, pages []processorcommand.PageSize, video *processorcommand.VideoInfo) (int, int, error) {
+	switch {
+	case len(pages) > 0:
+		return pages[0].Width, pages[0].Height, nil
+	case video != nil:
+		return video.Width, video.Height, nil
+	}
+
+	return upload.Dimensions()
+}
+
+// Stops processing an upload that doesn't meet its policies
+var errPolicyViolation = errors.New("Upload doesn't meet the policy")
 
-	router.HandleFunc("/user/{user_id}/file", requestMiddleware(authenticatedEndpoint(uploadHandler, extractorBase64)))
-	router.HandleFunc("/user/{user_id}/url", requestMiddleware(authenticatedEndpoint(uploadHandler, extractorUrl)))
-	router.HandleFunc("/user/{user_id}/base64", requestMiddleware(authenticatedEndpoint(uploadHandler, extractorBase64)))
+// PolicyResponse is the data of an upload rejected for not meeting its policies.
+type PolicyResponse struct {
+	Violations []config.PolicyViolation `json:"violations"`
+}
 
-	router.HandleFunc("/thumbnail", requestMiddleware(thumbnailHandler))
+// A 422 listing the constraints of the named policies check finds an upload violates, or nil if it meets them all.
+func policyResponse(st *serverState, policies []string, check func(string, config.UploadPolicy) []config.PolicyViolation) *ServerResponse {
+	var violations []config.PolicyViolation
+	for _, name := range policies {
+		violations = append(violations, check(name, st.config.UploadPolicies[name])...)
+	}
 
-	router.HandleFunc("/ocr", requestMiddleware(ocrHandler))
-	router.HandleFunc("/", requestMiddleware(rootHandler))
+	if len(violations) == 0 {
+		return nil
+	}
 
-	muxer.Handle("/", router)
+	return &ServerResponse{
+		Error:  "Upload doesn't meet the policy!",
+		Data:   PolicyResponse{violations},
+		Status: http.StatusUnprocessableEntity,
+	}
 }
 
-func (s *Server) buildThumbResponse(upload *uploadedfile.UploadedFile) (map[string]interface{}, error) {
-	factory := imagestore.NewFactory(s.Config)
+// Checks a video upload against MaxVideoBytes and MaxVideoSeconds before anything else is done with it. Videos need
+// ffprobe, and ffmpeg for their poster frames.
+func (s *Server) probeVideo(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile) (*processorcommand.VideoInfo, *ServerResponse) {
+	caps := imageprocessor.GetCapabilities()
+	if !caps.Has(processorcommand.FFMPEG_COMMAND) || !caps.Has(processorcommand.FFPROBE_COMMAND) {
+		return nil, &ServerResponse{
+			Error:  "Unable to process videos!",
+			Status: http.StatusNotImplemented,
+		}
+	}
+
+	size, err := upload.FileSize()
+	if err != nil {
+		return nil, &ServerResponse{
+			Error:  "Unable to fetch image metadata!",
+			Status: http.StatusInternalServerError,
+		}
+	}
+
+	if size > st.config.MaxVideoSize() {
+		return nil, &ServerResponse{
+			Error:  fmt.Sprintf("Videos can't be larger than %d bytes!", st.config.MaxVideoSize()),
+			Status: http.StatusRequestEntityTooLarge,
+		}
+	}
+
+	info, err := processorcommand.ProbeVideoHeader(ctx, upload.GetPath())
+	if err != nil {
+		logging.FromContext(ctx).Warn("Error probing video", "error", err)
+		return nil, &ServerResponse{
+			Error:  "Unable to read video!",
+			Status: http.StatusBadRequest,
+		}
+	}
+
+	if maxDuration := st.config.MaxVideoDuration(); info.Duration > maxDuration.Seconds() {
+		return nil, &ServerResponse{
+			Error:  fmt.Sprintf("Videos can't be longer than %s!", maxDuration),
+			Status: http.StatusRequestEntityTooLarge,
+		}
+	}
+
+	return info, nil
+}
+
+// Stores each thumbnail of the upload alongside original.
+func (s *Server) buildThumbResponse(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, original *imagestore.StoreObject) (map[string]interface{}, error) {
+	factory := imagestore.NewFactory(st.config)
 	thumbsResp := map[string]interface{}{}
 
 	for _, t := range upload.GetThumbs() {
-		thumbName := fmt.Sprintf("%s/%s", upload.GetHash(), t.Name)
-		tObj := factory.NewStoreObject(thumbName, upload.GetMime(), "thumbnail")
-		err := tObj.Store(t, s.ImageStore)
+		tObj := thumbObject(factory, upload, t, original)
+		tObj.SetContext(ctx)
+		err := tObj.Store(t, st.imageStore)
 		if err != nil {
 			return nil, err
 		}
 
-		s.stats.Thumbnail(t.Name)
+		s.stats.Thumbnail(thumbStatName(st.config, t.Name))
 		thumbsResp[t.Name] = tObj.Url
 	}
 
 	return thumbsResp, nil
 }
 
-func (s *Server) download(url string) (io.ReadCloser, error) {
+// Stores each rendition of the upload beside original, as <hash>.<name>.
+func (s *Server) storeRenditions(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, original *imagestore.StoreObject) (map[string]RenditionResponse, error) {
+	renditions := upload.GetRenditions()
+	if len(renditions) == 0 {
+		return nil, nil
+	}
+
+	factory := imagestore.NewFactory(st.config)
+	renditionsResp := make(map[string]RenditionResponse, len(renditions))
+
+	for _, r := range renditions {
+		rObj := factory.NewStoreObject(fmt.Sprintf("%s.%s", upload.GetHash(), r.Name), r.Mime, "rendition")
+		rObj.UserID = original.UserID
+		rObj.CreatedAt = original.CreatedAt
+		rObj.SetContext(ctx)
+
+		if err := rObj.Store(r, st.imageStore); err != nil {
+			return nil, err
+		}
+
+		renditionsResp[r.Name] = RenditionResponse{rObj.Url, r.Mime, r.Duration, r.Frames}
+	}
+
+	return renditionsResp, nil
+}
+
+// Downloads url, continuing the request's trace on the remote server.
+func (s *Server) download(ctx context.Context, st *serverState, url string) (body io.ReadCloser, err error) {
+	ctx, span := tracing.StartSpan(ctx, "download")
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("http.url", url)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	req, err := http.NewRequest("GET", url, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("User-Agent", s.Config.UserAgent)
+	req = req.WithContext(ctx)
+	req.Header.Add("User-Agent", st.config.UserAgent)
+	tracing.Inject(ctx, req.Header)
 
 	resp, err := s.HTTPClient.Do(req)
 
@@ -554,13 +1095,17 @@ func (s *Server) download(url string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
+	span.SetAttribute("http.status_code", resp.StatusCode)
+
 	if 200 != resp.StatusCode {
+		resp.Body.Close()
 		return nil, errors.New("Non-200 status code received")
 	}
 
 	contentLength := resp.ContentLength
 
 	if contentLength == 0 {
+		resp.Body.Close()
 		return nil, errors.New("Empty file received")
 	}
 
@@ -586,12 +1131,12 @@ func parseThumbs(r *http.Request) ([]*uploadedfile.ThumbFile, error) {
 		CropRatio     string `json:"crop_ratio"`
 		DesiredFormat string `json:"format"`
 		NoStore       bool   `json:"nostore"`
+		Animated      bool   `json:"animated"`
 	}
 	var thumbRequests map[string]ThumbRequest
 	err := json.Unmarshal([]byte(thumbString), &thumbRequests)
 	if err != nil {
-		fmt.Println(err.Error())
-		return nil, errors.New("Error parsing thumbnail JSON!")
+		return nil, errors.New("Error parsing thumbnails!")
 	}
 
 	var thumbs []*uploadedfile.ThumbFile
@@ -611,6 +1156,7 @@ func parseThumbs(r *http.Request) ([]*uploadedfile.ThumbFile, error) {
 			thumbRequest.Quality,
 			thumbRequest.DesiredFormat,
 			thumbRequest.NoStore,
+			thumbRequest.Animated,
 		)
 
 		thumbs = append(thumbs, thumb)
@@ -619,11 +1165,10 @@ func parseThumbs(r *http.Request) ([]*uploadedfile.ThumbFile, error) {
 	return thumbs, nil
 }
 
-func saveToTmp(upload io.Reader) (string, error) {
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "image")
+// Scratch files live in a per-process directory that is removed on Shutdown, so nothing leaks if processing is cut off.
+func (s *Server) saveToTmp(upload io.Reader) (string, error) {
+	tmpFile, err := ioutil.TempFile(s.lifecycle.scratchDir, "image")
 	if err != nil {
-		fmt.Println(err)
-
 		return "", err
 	}
 
@@ -631,8 +1176,6 @@ func saveToTmp(upload io.Reader) (string, error) {
 
 	_, err = io.Copy(tmpFile, upload)
 	if err != nil {
-		fmt.Println(err)
-
 		return "", err
 	}
 
@@ -2,21 +2,38 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Imgur/mandible/config"
 	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/imagestore"
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/tracing"
+	"github.com/Imgur/mandible/uploadedfile"
 )
 
 func TestRequestingTheFrontPageGetsSomeHTML(t *testing.T) {
@@ -24,15 +41,15 @@ func TestRequestingTheFrontPageGetsSomeHTML(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 
 	muxer := http.NewServeMux()
 
@@ -68,15 +85,15 @@ func TestPostingBase64FilePutsTheFileInStorageAndReturnsJSON(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 
 	muxer := http.NewServeMux()
 
@@ -137,7 +154,7 @@ func TestPostingBase64FilePutsTheFileInStorageAndReturnsJSON(t *testing.T) {
 		t.Fatalf("Expected image MIME type to be image/gif, instead %s", imageResp.Mime)
 	}
 
-	immStore := server.ImageStore
+	immStore := server.ImageStore()
 	exists, err := immStore.Exists(&imagestore.StoreObject{Id: imageResp.Hash})
 	if err != nil {
 		t.Fatalf("Unexpected error checking if %s exists in in-memory image store: %s", imageResp.Hash, err.Error())
@@ -163,16 +180,16 @@ func TestAuthentication(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	authenticator := NewHMACAuthenticatorSHA256([]byte("foobar"))
 	stats := &DiscardStats{}
-	server := NewAuthenticatedServer(cfg, imageprocessor.PassthroughStrategy, authenticator, stats)
+	server, err := NewAuthenticatedServer(cfg, imageprocessor.PassthroughStrategy, authenticator, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 
 	muxer := http.NewServeMux()
 
@@ -248,15 +265,15 @@ func TestGetFullWebpThumb(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 	ts := httptest.NewServer(muxer)
@@ -310,7 +327,7 @@ func TestGetFullWebpThumb(t *testing.T) {
 		t.Fatalf("Expected webp thumb, not given")
 	}
 
-	immStore := server.ImageStore
+	immStore := server.ImageStore()
 	storeId := imageResp.Hash + "/webp"
 
 	exists, err := immStore.Exists(&imagestore.StoreObject{Id: storeId})
@@ -341,15 +358,15 @@ func TestGetSizedWebpThumb(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 	ts := httptest.NewServer(muxer)
@@ -409,7 +426,7 @@ func TestGetSizedWebpThumb(t *testing.T) {
 		t.Fatalf("Expected webp thumb, not given")
 	}
 
-	immStore := server.ImageStore
+	immStore := server.ImageStore()
 	storeId := imageResp.Hash + "/webp"
 	storeIdSmall := imageResp.Hash + "/webpthumb"
 
@@ -446,15 +463,15 @@ func TestTooLarge(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 	ts := httptest.NewServer(muxer)
@@ -504,15 +521,15 @@ func TestTooSmall(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 	ts := httptest.NewServer(muxer)
@@ -562,15 +579,15 @@ func TestGetTallThumb(t *testing.T) {
 		MaxFileSize: 99999999999,
 		HashLength:  7,
 		UserAgent:   "Foobar",
-		Stores:      make([]map[string]string, 0),
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
 		Port:        8888,
 	}
 
-	memcfg := make(map[string]string)
-	memcfg["Type"] = "memory"
-	cfg.Stores = append(cfg.Stores, memcfg)
 	stats := &DiscardStats{}
-	server := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	server, err := NewServer(cfg, imageprocessor.ThumbnailStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
 	muxer := http.NewServeMux()
 	server.Configure(muxer)
 	ts := httptest.NewServer(muxer)
@@ -627,7 +644,7 @@ func TestGetTallThumb(t *testing.T) {
 		t.Fatalf("Expected cropped thumb, not given")
 	}
 
-	immStore := server.ImageStore
+	immStore := server.ImageStore()
 	storeId := imageResp.Hash
 	storeIdSmall := imageResp.Hash + "/tallthumb"
 
@@ -659,7 +676,1187 @@ func TestGetTallThumb(t *testing.T) {
 	}
 }
 
+func TestReloadSwapsStoresAndRejectsInvalidConfig(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+		AdminKey:    "secret",
+	}
+
+	stats := &DiscardStats{}
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	oldStore := server.ImageStore()
+
+	invalid := *cfg
+	invalid.HashLength = 0
+	if err := server.Reload(&invalid); err == nil {
+		t.Fatalf("Expected reloading an invalid config to fail")
+	}
+	if server.ImageStore() != oldStore || server.Config() != cfg {
+		t.Fatalf("Expected the old config to be kept after a failed reload")
+	}
+
+	reloaded := *cfg
+	reloaded.MaxFileSize = 1024
+	reloaded.ThumbQueueSize = 3
+	server.SetConfigLoader(func() (*config.Configuration, error) {
+		return &reloaded, nil
+	})
+
+	req, _ := http.NewRequest("POST", ts.URL+"/admin/reload", nil)
+	req.Header.Set("X-Admin-Key", "wrong")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error when reloading: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected reload with the wrong admin key to be unauthorized, instead %d", res.StatusCode)
+	}
+
+	req.Header.Set("X-Admin-Key", "secret")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error when reloading: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", res.StatusCode)
+	}
+
+	if server.Config().MaxFileSize != 1024 {
+		t.Fatalf("Expected the reloaded config to be in use")
+	}
+	if server.ImageStore() == oldStore {
+		t.Fatalf("Expected the image store to be rebuilt on reload")
+	}
+
+	st := server.acquireState()
+	st.release()
+	if cap(st.thumbQueue.queued) != 3 {
+		t.Fatalf("Expected the thumbnail queue to be rebuilt with the reloaded size, instead %d", cap(st.thumbQueue.queued))
+	}
+
+	values := make(url.Values)
+	values.Add("image", b64gif)
+	res, err = http.PostForm(ts.URL+"/base64", values)
+	if err != nil {
+		t.Fatalf("Error when uploading base64 GIF: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d uploading after a reload", res.StatusCode)
+	}
+}
+
 var (
 	b64gif = "R0lGODlhAQABAIAAAAAAAP" + "/" + "/" + "/yH5BAEAAAAALAAAAAABAAEAAAIBRAA7"
 	b64dan = "iVBORw0KGgoAAAANSUhEUgAAADIAAAAyCAIAAACRXR/mAAAWAUlEQVRYw7V5eZBdV3nnd87dl/fu23tfXneru9Wtllp7y8Y2MpJtIMYTiBkYMFAZCFtqKiQMJjOkUsNUYJIKqRomhRNCGDAwsROQDHiRN2HtUktqSd3qVu/L63799v3d/d5z5g9M4mQIIn/Mr84ft26duvWr7/6+3/d956ADCbXumI6HHAwxzPgezjkucAAuSBgrLHIJbfhIlmTHtVxZ5m2L1vVEQnN1iwNbFGG9BG1BzrM9cGmZsm97+D0PffCJncN9mXTlmW/+T7c6wyP+8U89OXbgYLWqZzcKQ2GobLyUWr2Smr1dmzdOrkJ/r7RH9nMlYhRB0mDwoMBu5I0CkC4Gt/lkDfx9HeEhx8o16QUHAODxLjZS9TcNKji2KsN8wWyLQNdupdEw1SC0JyNr9fZQf2h3f9ys6cRzM47/xT/+w/GJAwAAAD2wdOr7G7Fd9/zWRz7y8zdwD9y+NvXs0yupSt2xpG4O1CCe2BOP+3nkGhtZulKC3FkPCQAMQBJAAagDjPHQF4JUHk4CWABDAKMAFACxQDzo1SB5fBfpHipnq7prarFIIBD1AvFgS7vTqNSzq+n0qsMnDk3cGwlzyWhcdZscD7NZ9Oh/+B0AeOW11774X5+8MTkFrMhFE67VCGh8F891dqgV30rNpVglxEVakd9EHbzcyZBNijlZe3skrCbEYCTou2wJy54UCoXY4bYWnuGoLAa1cHVz7vat01hCpbU1IYBFAeyMGeofNoPxeqMc0VTbIOupYjq9Fg2HRoYH3nH8Hb/5H5+8fGVq8vz5l09ffPHFF+FXIxgIaFpQo+jcqec4CRtYSqgBUWAdhuOAQwIVMQ7wgmW6hXrFcizXrqfXZ//+r34wf/H2vl2gRvHaGnGakOyBloGWConrdnmgs7Vvx0EDeOrwum5PvvoPRcx/8MOfeOmF888+/wr8W8BWrVw52/Sb1uX8FmWobdBKveJ7nqnbmWqD4aQWlW9VeFmprk5fmztfCwCEYyg2mIR4LLu5LcR1XlL29fTNr8nXbywin91/5OjSypZu1ro6drz8o0vb6392/3jfeK+6st5s/JqcWJb9vc/9yWah4NkucT1AKK5E69RByJFZrq67QVW6bywZijaLc9nMSv3h4+HMagUwyyC5a7CTC8vVdG7rVioYLFK3/vLVxrmpa3+a6A9Ijf/1F8+7oXiyNXQ1XZKFzYO7Yn0KXW6o06ncr8OMYao11vFkQjQACSDGCmGOa3i2iKGXwKG4lGypBGTXs3yGcXqGI1pbBAtSJN5HefnqhctzF1NLW87klU270HSBSRvuG9duW6u5etFbqDXzTZMCbFWs8b6OUI9/qC+6smHXbPtXc8IYM+0sGyBEABjBOIDQtGMqthHzfNd2w8Rrj1mBKAlH1Y07teK2nxyNhxN929laoVgqZtdIOe+UQAKQGcjVvYbjcQA1F3Ilmye0DEAAAEBgICDYbKh1ICZgYt3e1O9Ki816XgwgjhHBKOVTAUAAaAfYI2G2g5nMunjTTChbmRK0akg3vOzmAkeF7r62AM8FhsaU3wpIctBxvUyxsbGQqtQKOm7OXK+U6qACEAAXQKNQqdQHhdaiZQeDXkcikM7fRWZsLKTRaq1OYdXzEUAPQAeDNBnCIrOccZs+H6BQKLmqSrV2UNTWh4/e19bWHolpWjAKiAVVBlUEwwSLgmlvbiwuL90+r5wplO1s0ZxZKhUphGRoT3YDW7s+v8SaVJPVNNyFFvrvv/8H/+MvvsYCSABhgCEBNUW8YvmjAfAZJmuyySA5cF9PKBGPReOHJw51j+wBOQDIB5YDH0PTAUSBw0B4MDwwDDe3nc5texjrHj19/szZy1fEWBQLXDqzvr3myCxeb+Ca5f3qTGQ+9sQnGeKsLC/1A/SyKCzD2QbZ9uDe+ztKDXMh64wPsAce7Bkd2L97566OjnbgRfApeDYl1Pd85ANQjmIBYZG4PvI8RpRDoYgmy4FgYGjXrlhLtFYqbS4vrs05rIM8h6Ztcldt4R+/fn7i+LvG+rqbAADwsyYtEohFg70j/Rww4zK0tDEUeIFHImAgDLFdIEB9FvkMSxkAQAgwUJ/YwIPPeMQ1wPbBcp1q1a/ooz1jw8O7tIDWGcetEdrVGUGYubtB1E2fATR+YP/Jy5fuEKhSAICBHa0T/ZH1S6uEUE3zdu8Z2dk/Gg5HAFEQeRAVQCyiCAgABd/zgTIMiMhnkeMgy0KW6zu27/u1aq3eqKvxUL1p5CpbSlg5eGCwYaFMsX6XTGzt7jO4sNK5+9O/+0c3V2dyG2vLs7dc26ivlfIV4mGQAmyAESJyCHiGUh8BAkQopr7lYsogj0WOB8igPEtZFrM8YI74LkEMweBjQomjuHxPx8D06jaDLYE6CYnc3ei//tdPeTwLlh8Vgw7TzG9vPvOtb65Nff/69HwVoF+CiByIaZ3ACmA4LkJYRSzlkEsRAt8njONgDyNOIoQS8BFlwWWJ71LfIb5DiccyrOuavGAO7+lcnp2fvjabrvwa9eepr35ho5DhbSIyaslt+qwwkoh0ydyNO80GAEIwtvPQYHIMPB9cn5VkjDhKKEgClhTsM2AB8VkCPDYNxjURyxCFQxbn2k3XchiEAVOf4ZpG06OWEgnnUoV81bs7re8//fTPn/btPvy+J35zZOLYM1//+uqNCmtDfyT4zo/enxwZBs8AJQAiwhwDjoUoARcD9SHWC4FWDED9BhgqNXXADsIUOy7ne5zvc4RFxPZ9h5q0spFmFT6eDLP5Clh3YcYghGNAKUChWWcQRNq6NaM+1JiLuxbPK7/3t3/ZOfFuYCmmpJHOLy+s6RWTIWxuaev26+ezM7eM4pKMDY7nUSAASgBhhGwKCLOixFBkOMT2kNVwc8Xs1JWb2Y2iHMGZKlNtunepiQKDDEo5ANN1lheXJq9Mf2C87zOPPuz6mfmtVEB2enYOL3n84x/7428883pH745gYuDqzZWFjXy64ly9Pp1NrQ+0tahxBZwmNSiql0gh69sOViRWFBHDGq7XqJQKta0LF1ZqJdqawNcWTY/+qlARAqztEwD4x+JpV3OdIZl91/F+PdVRTw/GYvjSy0bOOHfxat/Yvg+959j01KTPu6HRZKaQQSWlYfPf+D8/vWd24eHPfgozHNQbhlVaW1xNl7KW54mSghhEVV/EIb2ByizcSUuWb91NWoT97Oe+pPKSTxESEctIgmP0D3WA0dxc26Ieam+Jy1gaC7m/f9/YkmH+5AffW5y68UalVI0mHjw0HrQLnGupQe3ET85+5+zSpz/0GG83N9cz+cz6rdVlD/k7h3clNA3zni1DgyXA8pZu8wDO/0NE5tnDY8n9XWxMtbs72llVE4DaEiOV641CIRv16uoD/ZAxSltmJJgI8xJIIXli5+fd0qnT17tHR0cP7e9YTb987dbRiXeUlBvlOzcfOjJuiotf/ObzJ55/1fHsw6Ndh3cPR3tHo4Egdt1SUV9ZmBYVyxFxT7v87B+9jzQbnIyuzpl/9t3J3h3tQcH/jaPjxw4llMEIMBY0V8EDBAAYQAAwAQCgFcHqc38jde0oVRt3rvxob3+f0jUIg+1Gc3P2J5c6kmMoIkhiq2kahfU0sYyx0eRT3/mbp3/66k9//Mrc6Rsf+MKTx963XwzHrAYNE7ZL5USB5Ot6qWzeXssFYjgZk3zbjEdV1xQuTW1/+9tf+7u//cbK6oLjmQ29qdvIMF2GBRYA4mrQsAzwPACIK5KkaSCZQkPv6UtShgDySd2SE4OD98vbc8t2gdioIIakYJBN7j9o68a5c1e+/Aefb9k/Ri7efPdI/8MPHs9W9af++sTQQGdhbWmwt3380EO+oK6ffO3UGxff+uN4gIOPfybWvtOhw65HeVHlFU6V5IAqswDgMmj/oSO3V1Yc29nVOwJCAIZ7zMKVejEb7e4E8LBDoWRobQktGKzenM+tbabXa1mwlu/c2sxkPv6pjx//d4/C2uxaPt10zI5Ix0hcaPtkhJfxjclXeAGvzC1mGm7Va4wd2LG+WtOrZUI8DqMgB8VS8dO/++jgyO5SvgCEEs8HzyHUZYMcX67VQuHQM8+enN/WtXoDqgR8UUbYwQQRDJZNbRsQCwQQFkN794YG9uzwGIdzyht39uwaTewZhfI2WIwqcpi6J5/9+wceOtaZTBBdf/s9j5ieszR/e/n6qrxD//JXDz75sdM3L3kA4BHKMQwD/lf/2xd+icuHMHYAXjj9ajafrTm0US6dDEr/6bF3huSmuCMKIADhiNFAHsKiSiUBBYMQEjBFottssSuM34D1BUpZ5EkVZD34zqNmoTlz9qIUUGReFJRg0dSNOg7JdmsyPbeUKxffNFIK4LOYgP9WH+U4FjM8L4hon6JYur78i6QVpICNpBYj/+UnDr3r/e+NYk3kBBA5pGhEkKmsMkoQmk0ztW4Uc2FZwAJQxkNaAkre6TM/K7jWIw+826zXbs3ebBiO5/g5vVi1nKWV21YyvVGEa6+96aT7x/fJUDvy4CNvf/f7zWZNZXmGUgZhiihBhI3ynOWxImA70j6b27Qd+7HH/n2Pmg/0EKteMFWecQjveZRhMYNBJ9BompmMYdVNu1reLPT2Jbkd/dC+A8SmzFzlmjbSQq0tLYrIluoNt2bnm4WN8srrb9SvTHKEYQAsAARAtjPbbSqbWl372cs/rVcrjmWahmmalmMbruewPMuSUBD52JNkFiHGd3584lsffehg575dlVI1KLW7iCLHQTWdIYyNDbNepz5Ed+3yfPu5P//qC8+f+PDn/0usZw9wTTPAeXUWAAPDUMwC4Lpj5xq6UfMV23aog3wW4M1oZXJZzo9PPfciwIu/rJ2nkNNtTRJtp8EDdAG3AG5bTBF5tlgzEgg88ASGCyqiA262USccam1JEMdgFem9v/2Jcy+8dOrET7SL19aW1y+8fu3Yex7hRR4wBpYjNp1fXCoh/ZNf+dLQg8dPfeCzlHq/0BUAAIu9Vk3J1vRfMmLsVaWZSq1umh4Q10MRIvtgPfmRhx1S3a42A1rMJS5hGTUY4hTZsu3FteWt9JamBTy9ks5vqx1dJcc7fea1wvbmYM/w0eMPd/Z02LWyrjeyuULJM8aPTnQO9/WOH1ad8sZqpqMlsjPZHlKkbLnOOSRnWL+0g0Af701c36hsU9cGMBEjU/quwzu+/7XPvXLmhcm5jaMPvFNTRODEeKK9pbPTNvQf/vhEZmWzXQtF4iEhGjYZQVKjlmcsLc3cN/a2gVgftpuOZ+X12ura+ts++qFAWC3Nzwf6h3h9izIYxdsBePCslZV8eX7x7PnL333u9Mzy+r+MVkJifFaNaEGPxUXLsoB+5XceHdw30ijU55YWDddQlCAlgDheVoJ1s9HZ0fnAvQ96q3kmaxpFo7qZpbpTadZdjrWw0tB14jc4TFMrGy3jw117j29dejE80C+EOt3SNNM+BBAFCACOR2KJjuGBex5626c/8V7Vdl69eOOf9VvbFtkwGim9WbVtAHjiyPh//sR7kdXEjHJncW4lteAQQAyrhLXtXCaf3e5p61S7Eh29nd2dgzvah2J8zMs3lq5c3rqzWKrWG77OqgjZDgjC3vd/1GimK9tbiZ1H3Nw6iMDI/ZWl2frKTcvKOnqeVwWEWeDIPRO7n3/xTCZX+qfJx6CUE/juSPjYvqHHDiR/4/j9EIuQQjHRoo3uHLn1o2kfZpouqXpOOBQhlp+PFoOtcd+upApb5YyZULt6BgYdzu1HjtARrXk1RQ7WK/W20UFAofLsq6GeAYAA6EWuqw1AWLsxOXX5tSMTD4wemADP8zzMmDqicHT/yPXpxbccJGH45p88+Z3vfuU9x0YG9yaBZYBBoKrUo6Fo9M7s1fnZUi6fohwfjsSIy2lKqLWrHTFsrlS5MnNjKrdSkJ1gT1vrQH9Xb3ssEiIeUy7WBsd3SyEuNTnZtnMYcwzZXmbaOozs9g/+/E8FzLfGu9xijkEmDcZYPgTlRqVa8DwS12KpbJYCMACQzxcef8eEsGMnNGsUiwQzIIrAcaqsdHX0TF+7klp3edV0/CamcjiktcdVJhSOtXZHRJVwAhsUtVDQMW3HbHiELK+mbl29MX7wkJpQVmbmu4eSeq30o6f+crAjKoZaL516OZXfdH2IKGLbkXEh1Is4GSHXdY1b567WGv5GMQ+EMCzLpjL57z370sTBA117HkGKDxWLADDRIPFoRI5E4m03rl5KbZoGykk8p2mBUiUXYCVZCtqOjxkuEg5zLItZdiuXX9lcn5yc+vaJM/GgenDP3q217UBIDLT3fOkzf7gwdfvY+96vBRI5veEa1eG+rpa9+4ALALDAgVmtn79w89b8FisIkUCAwRgTQhqm9e2n/4Ga+sTEvXx7D8Y+cQiOqmD7sXA83huau3F7btqvoRqhiBKlYjvlhrmRz20WNijD5HK1uZWbs6uzz710eT3V0Hlt5c7tT33wCZ7wSwtz3XsONzO5xampYxNHJCVqmH6zlu1pDSZ2DFApiEAE5CPDmLmzAASN9LfuHmx/k9bPhXbmwuUfPP1D5Dm7BncIbYPASkjlgKBEuK0/mUhtLF+eqS8v5zzL9HFjcXOjWK8rslgqlG/MzLx+9o3XLszNbzZ04LRgMJXe/Nxvf5BUGhdOvbr37Q8mRCGzMsPyvGV6iFcYzxob7pF6O5AQoiAjBAKQW9dvXbhwJSzrvlP6Z7QAoNponnrt3HeePpnf3EqIXGtvkon0SiwvMELnzphs5lcXSpObxVvTqzeXVuZX11fW1+fuTJ+5Mju9pusWAIBtm5VqyaFQS904e/LvGIru/cCHjdSm4dlSJCAqku84gtsc6u9EEY3KUYAwohS53vydhe/98PnsVnkjXflHWuitPts0zQuTU3/19A8nX59s5NMBVYy3dPa0Dyf7e6Ihm9XLhaxd0UmlbKW3aqvbes0kgMWAojmO+eYkoygWLQyNJjuTfZXZW2XbHTxyz8joztZgUK9sdUQCQS1MNA2pLQgkAIfqte18bnHxcrZhi7KEWJb1vLuN3hgf3jt634GJZLJHZJukuVxaX8wsZ5fmizeKJP3z2xeEMca+/+an9uzf87+/9bXzJ57tjgUZz9+5ZyIUaZUwlRXs17axUUcBBdp7INYPOAhWvZlLT96aOnvhnGm7iiCyv84puU/IxeszF6/PAEAsEu5oi8sigibK2GjrF3soJb7/T2JYvLOgqO3DYwdlu3zvkXvAg3pBB4GHkMhoMcBANRGAIs8CXgUPOSZwgixJmkvqDub+pbbuCsO0coXSVqa0VdKrzr86tHuud+naNcwxMUyTLWHMghgIMCKPFIHaBjCIRkLASUhQAfNgOrVaEQRhPbU9uzyPOIahlML/H2S20ucvXM2ks/eO9Ye0AIOA2Cb2bERMhAHkADAqsAryXNqoWnZTCAXqzeby4qLEi4woipRShmHwvw3MW9a/AoQIhfV8eX1zuzvZZeuG3TQdQ3dtCwPHMCJGLKKU2o5vmJwoEl40LW/hzrypm/8XZCy0eCnDy+0AAAAASUVORK5CYII="
+
+	// a 1x1 lossless WebP
+	b64webp = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
 )
+
+func TestShutdownFailsReadinessAndRemovesScratchDir(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	stats := NewBufferedStats(&DiscardStats{}, 0)
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+	// Only the store is checked, the image tools may not be installed
+	server.dependencyChecks = nil
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the server to be ready, instead %v %v", res, err)
+	}
+
+	jobDone := make(chan struct{})
+	server.goBackground(func() {
+		time.Sleep(10 * time.Millisecond)
+		close(jobDone)
+	})
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error shutting down: %s", err.Error())
+	}
+
+	select {
+	case <-jobDone:
+	default:
+		t.Fatalf("Shutdown returned before the background job finished")
+	}
+
+	select {
+	case <-stats.done:
+	default:
+		t.Fatalf("Shutdown returned without flushing buffered stats")
+	}
+
+	if _, err := os.Stat(server.lifecycle.scratchDir); !os.IsNotExist(err) {
+		t.Fatalf("Expected the scratch dir to be removed, instead %v", err)
+	}
+
+	res, err = http.Get(ts.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected readiness to fail while draining, instead %v %v", res, err)
+	}
+}
+
+func TestPrometheusMetricsAreLabelledByRoute(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize:           99999999999,
+		HashLength:            7,
+		UserAgent:             "Foobar",
+		Stores:                config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:                  8888,
+		PrometheusEnabled:     true,
+		AuthenticationHMACKey: "foobar",
+	}
+
+	stats := NewPrometheusStats()
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	http.PostForm(ts.URL+"/user/1/url", url.Values{})
+	http.PostForm(ts.URL+"/user/2/url", url.Values{})
+	http.PostForm(ts.URL+"/base64", url.Values{"image": {b64gif}})
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Unexpected error fetching metrics: %s", err.Error())
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	expected := []string{
+		`mandible_requests_total{route="/user/{user_id}/url"} 2`,
+		`mandible_response_time_seconds_count{route="/user/{user_id}/url"} 2`,
+		`mandible_response_time_seconds_bucket{route="/user/{user_id}/url",le="+Inf"} 2`,
+		`mandible_store_duration_seconds_count{store="memory",operation="save",outcome="success"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("Expected metrics to contain %q, instead:\n%s", line, body)
+		}
+	}
+}
+
+func TestStatsFanOutToBufferedBackends(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for statsd: %s", err.Error())
+	}
+	defer listener.Close()
+
+	stats, err := NewRuntimeStats(config.StatsList{
+		{Type: config.StatsStatsd, Address: listener.LocalAddr().String(), Prefix: "test"},
+		{Type: config.StatsPrometheus},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating stats: %s", err.Error())
+	}
+
+	stats.Request("/user/{user_id}/url")
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 1024)
+	n, _, err := listener.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("Expected a statsd packet: %s", err.Error())
+	}
+	if string(packet[:n]) != "test.request.user_user_id_url:1|c" {
+		t.Fatalf("Unexpected statsd packet %q", packet[:n])
+	}
+
+	metrics, ok := metricsHandler(stats)
+	if !ok {
+		t.Fatalf("Expected to find the prometheus backend")
+	}
+
+	stats.(MultiStats).Close()
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, &http.Request{})
+	if !strings.Contains(rec.Body.String(), `mandible_requests_total{route="/user/{user_id}/url"} 1`) {
+		t.Fatalf("Expected the request to reach prometheus too, instead:\n%s", rec.Body.String())
+	}
+}
+
+func TestTracingFollowsAnUploadFromURL(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	gif, _ := base64.StdEncoding.DecodeString(b64gif)
+	var downloadTraceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloadTraceparent = r.Header.Get("Traceparent")
+		w.Write(gif)
+	}))
+	defer origin.Close()
+
+	stats := &DiscardStats{}
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, stats)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	exporter := tracing.NewInMemoryExporter()
+	server.SetTracer(tracing.NewTracer(exporter))
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/url", strings.NewReader(url.Values{"image": {origin.URL + "/cat.gif"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the upload to succeed, instead %v %v", res, err)
+	}
+
+	spans := make(map[string]tracing.SpanData)
+	for _, span := range exporter.Spans() {
+		if span.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("Span %s isn't part of the incoming trace", span.Name)
+		}
+		spans[span.Name] = span
+	}
+
+	for _, name := range []string{"POST /url", "extract", "download", "hash", "store.save"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("Expected a %s span, instead %v", name, exporter.Spans())
+		}
+	}
+
+	root := spans["POST /url"]
+	if root.ParentSpanID.String() != "00f067aa0ba902b7" || root.Attribute("http.status_code") != http.StatusOK {
+		t.Fatalf("Unexpected request span %+v", root)
+	}
+
+	download := spans["download"]
+	if download.ParentSpanID != spans["extract"].SpanID {
+		t.Fatalf("Expected the download to be part of extraction")
+	}
+
+	sc, ok := tracing.ParseTraceparent(downloadTraceparent)
+	if !ok || sc.SpanID != download.SpanID {
+		t.Fatalf("Expected the download to propagate its span, instead %q", downloadTraceparent)
+	}
+
+	if spans["store.save"].Attribute("store") != "memory" {
+		t.Fatalf("Expected the store span to name the store: %+v", spans["store.save"])
+	}
+}
+
+// Lets the test read what the server's logger wrote.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (this *lockedBuffer) Write(p []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.buf.Write(p)
+}
+
+func (this *lockedBuffer) String() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.buf.String()
+}
+
+func TestAccessLogIncludesRequestIDAndRedactsForm(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+		AccessLog:   true,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	logs := &lockedBuffer{}
+	server.SetLogger(logging.NewJSONLogger(logs, logging.LevelInfo))
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/base64", strings.NewReader(url.Values{"image": {b64gif}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(RequestIDHeader, "client-id-1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error uploading: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.Header.Get(RequestIDHeader) != "client-id-1" {
+		t.Fatalf("Expected the request ID to be echoed, instead got %q", res.Header.Get(RequestIDHeader))
+	}
+
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Unexpected error fetching front page: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if len(res.Header.Get(RequestIDHeader)) != 32 {
+		t.Fatalf("Expected a generated request ID, instead got %q", res.Header.Get(RequestIDHeader))
+	}
+
+	output := logs.String()
+	if strings.Contains(output, b64gif) {
+		t.Fatalf("Expected the image to be redacted from the logs, instead:\n%s", output)
+	}
+
+	var line struct {
+		Msg       string            `json:"msg"`
+		RequestID string            `json:"request_id"`
+		Method    string            `json:"method"`
+		Route     string            `json:"route"`
+		Status    int               `json:"status"`
+		Bytes     int               `json:"bytes"`
+		UID       string            `json:"uid"`
+		Params    map[string]string `json:"params"`
+	}
+	err = json.Unmarshal([]byte(strings.SplitN(output, "\n", 2)[0]), &line)
+	if err != nil {
+		t.Fatalf("Expected a JSON access log line, instead %s:\n%s", err.Error(), output)
+	}
+
+	if line.Msg != "Request" || line.RequestID != "client-id-1" || line.Method != "POST" || line.Route != "/base64" || line.Status != http.StatusOK {
+		t.Fatalf("Unexpected access log line: %+v", line)
+	}
+
+	if line.Bytes == 0 || len(line.UID) != cfg.HashLength {
+		t.Fatalf("Expected the response size and uploaded image ID to be logged, instead: %+v", line)
+	}
+
+	if !strings.HasPrefix(line.Params["image"], "REDACTED") {
+		t.Fatalf("Expected the image param to be redacted, instead: %+v", line.Params)
+	}
+}
+
+func TestReadinessReportsEachCheck(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}, &imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+	server.dependencyChecks = []healthCheck{
+		{"command:gm", func(ctx context.Context) error { return errors.New("gm not found on PATH") }},
+		{"slow", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}
+	server.readiness.timeout = 50 * time.Millisecond
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/healthz")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the server to be live, instead %v %v", res, err)
+	}
+	res.Body.Close()
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rec := httptest.NewRecorder()
+	server.withState(http.HandlerFunc(server.readyHandler)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a failing check to fail readiness, instead %d", rec.Code)
+	}
+
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Expected a JSON report, instead %s: %s", err.Error(), rec.Body.String())
+	}
+
+	expected := map[string]string{
+		"store:0:memory": "",
+		"store:1:memory": "",
+		"command:gm":     "gm not found on PATH",
+		"slow":           "Timed out",
+	}
+	for name, message := range expected {
+		result, ok := report.Checks[name]
+		if !ok || result.Error != message || (result.Status == "ok") != (message == "") {
+			t.Fatalf("Unexpected result for %s: %+v", name, report)
+		}
+	}
+
+	// The last report is served until it's ReadinessCacheSeconds old
+	server.dependencyChecks = nil
+	res, err = http.Get(ts.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the cached report, instead %v %v", res, err)
+	}
+	res.Body.Close()
+
+	server.readiness.checked = time.Time{}
+	res, err = http.Get(ts.URL + "/readyz")
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the server to be ready once the checks pass, instead %v %v", res, err)
+	}
+	res.Body.Close()
+}
+
+func TestUploadsSelectAPipelineByParamOrRoute(t *testing.T) {
+	var mu sync.Mutex
+	var ran []string
+	imageprocessor.RegisterStep("test_record", func(params map[string]interface{}) (imageprocessor.StepBuilder, error) {
+		name := params["Name"].(string)
+		return func(cfg *config.Configuration, file *uploadedfile.UploadedFile) (imageprocessor.ProcessType, error) {
+			mu.Lock()
+			ran = append(ran, name)
+			mu.Unlock()
+			return nil, nil
+		}, nil
+	})
+
+	record := func(name string) []config.PipelineStep {
+		return []config.PipelineStep{{Step: "test_record", Params: map[string]interface{}{"Name": name}}}
+	}
+
+	cfg := &config.Configuration{
+		MaxFileSize:    99999999999,
+		HashLength:     7,
+		UserAgent:      "Foobar",
+		Stores:         config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:           8888,
+		Pipelines:      config.PipelineMap{"default": record("default"), "route": record("route"), "fast": record("fast")},
+		RoutePipelines: map[string]string{"/base64": "route"},
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	for _, pipeline := range []string{"", "fast", "missing"} {
+		res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {b64gif}, "pipeline": {pipeline}})
+		if err != nil {
+			t.Fatalf("Unexpected error uploading: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if pipeline == "missing" && res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected an unknown pipeline to be rejected, instead %d", res.StatusCode)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) != 2 || ran[0] != "route" || ran[1] != "fast" {
+		t.Fatalf("Expected the route's pipeline then the requested one, instead %v", ran)
+	}
+}
+
+func TestRequestedThumbsIncludePresets(t *testing.T) {
+	cfg := &config.Configuration{
+		ThumbPresets: config.ThumbPresetMap{
+			"small_square":  {Width: 90, Shape: "square"},
+			"avatar_circle": {Width: 200, Shape: "circle"},
+		},
+		DefaultThumbPresets: []string{"small_square"},
+	}
+
+	request := func(form url.Values) *http.Request {
+		r := httptest.NewRequest("POST", "/file", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	form := url.Values{"presets": {"avatar_circle"}, "thumbs": {`{"small_square": {"width": 10, "shape": "square"}}`}}
+	thumbs, err := requestedThumbs(cfg, request(form), true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if len(thumbs) != 2 || thumbs[0].Width != 10 || thumbs[1].Name != "avatar_circle" || thumbs[1].Width != 200 {
+		t.Fatalf("Expected the requested small_square instead of the default and the avatar_circle preset, instead %+v %+v", thumbs[0], thumbs[1])
+	}
+
+	if _, err := requestedThumbs(cfg, request(url.Values{"presets": {"huge"}}), false); err == nil {
+		t.Fatalf("Expected an unknown preset to be rejected")
+	}
+
+	cfg.StrictThumbPresets = true
+	if _, err := requestedThumbs(cfg, request(form), true); err != ErrAdHocThumbs {
+		t.Fatalf("Expected thumbs specs to be rejected in strict mode, instead %v", err)
+	}
+}
+
+func TestBackgroundThumbsArePendingThenServedFromTheStore(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize:         99999999999,
+		HashLength:          7,
+		UserAgent:           "Foobar",
+		Stores:              config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:                8888,
+		ThumbPresets:        config.ThumbPresetMap{"small": {Width: 10, Shape: "square"}},
+		DefaultThumbPresets: []string{"small"},
+		BackgroundThumbs:    true,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {b64gif}})
+	if err != nil {
+		t.Fatalf("Error when uploading base64 GIF: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var serverResp struct {
+		Data struct {
+			Hash        string            `json:"hash"`
+			Thumbs      map[string]string `json:"thumbs"`
+			ThumbStatus map[string]string `json:"thumb_status"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &serverResp); err != nil {
+		t.Fatalf("Unexpected error parsing response %s: %s", body, err.Error())
+	}
+
+	hash := serverResp.Data.Hash
+	if _, ok := serverResp.Data.Thumbs["small"]; !ok || serverResp.Data.ThumbStatus["small"] != ThumbPending {
+		t.Fatalf("Expected the link of a pending thumbnail, instead %s", body)
+	}
+
+	// Shutdown waits for the queue, however the thumbnail turned out
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error shutting down: %s", err.Error())
+	}
+
+	if server.pendingThumbs.isPending(hash + "/small") {
+		t.Fatalf("Expected the thumbnail to no longer be pending")
+	}
+
+	stored, err := ioutil.TempFile("", "thumb")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+	}
+	defer os.Remove(stored.Name())
+	stored.WriteString("stored thumbnail")
+	stored.Close()
+
+	_, err = server.ImageStore().Save(stored.Name(), &imagestore.StoreObject{Id: hash + "/small"})
+	if err != nil {
+		t.Fatalf("Unexpected error storing thumbnail: %s", err.Error())
+	}
+
+	res, err = http.Get(ts.URL + "/thumbnail?uid=" + hash + "&presets=small")
+	if err != nil {
+		t.Fatalf("Error requesting thumbnail: %s", err.Error())
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "stored thumbnail" {
+		t.Fatalf("Expected the stored thumbnail, instead %d %s", res.StatusCode, body)
+	}
+}
+
+func TestWebpUploadsAreAccepted(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {b64webp}})
+	if err != nil {
+		t.Fatalf("Error when uploading base64 WebP: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var serverResp struct {
+		Data ImageResponse `json:"data"`
+	}
+	if err := json.Unmarshal(body, &serverResp); err != nil {
+		t.Fatalf("Unexpected error parsing response %s: %s", body, err.Error())
+	}
+
+	image := serverResp.Data
+	if res.StatusCode != http.StatusOK || image.Mime != "image/webp" || image.Width != 1 || image.Height != 1 {
+		t.Fatalf("Expected a 1x1 WebP, instead %d %s", res.StatusCode, body)
+	}
+}
+
+func TestSvgUploadsAreSanitized(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	svg := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x "y">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 40 30" onload="alert(1)">
+	<script>alert(1)</script>
+	<foreignObject><iframe src="http://example.com/"></iframe></foreignObject>
+	<style>@import url(http://example.com/x.css);</style>
+	<a xlink:href="javascript:alert(1)"><rect id="r" width="40" height="30" style="fill: url(#g)"/></a>
+	<use xlink:href="#r"/>
+	<image href="http://example.com/x.png"/>
+	<rect fill="url(http://evil.example/x.svg#p)" filter="url(https://evil.example/f)" stroke="url(#g)"/>
+	<rect style="fill:\75rl(http://evil.example/s)"/>
+	<rect style="fill:u/**/rl(http://evil.example/c)"/>
+	<style>rect{background:\75rl(http://evil.example/b)}</style>
+	<style>rect{fill:u<!---->rl(http://evil.example/x)}</style>
+	<style><![CDATA[rect{fill:u]]>rl(http://evil.example/y)}</style>
+	<style>rect{stroke:red}</style>
+</svg>`
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {base64.StdEncoding.EncodeToString([]byte(svg))}})
+	if err != nil {
+		t.Fatalf("Error when uploading base64 SVG: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var serverResp struct {
+		Data ImageResponse `json:"data"`
+	}
+	if err := json.Unmarshal(body, &serverResp); err != nil {
+		t.Fatalf("Unexpected error parsing response %s: %s", body, err.Error())
+	}
+
+	image := serverResp.Data
+	if res.StatusCode != http.StatusOK || image.Mime != "image/svg+xml" || image.Width != 40 || image.Height != 30 {
+		t.Fatalf("Expected a 40x30 SVG, instead %d %s", res.StatusCode, body)
+	}
+
+	stored, err := server.ImageStore().Get(&imagestore.StoreObject{Id: image.Hash})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching %s from in-memory image store: %s", image.Hash, err.Error())
+	}
+	storedBody, _ := ioutil.ReadAll(stored)
+	stored.Close()
+
+	for _, unsafe := range []string{"onload", "script", "foreignObject", "iframe", "example.com", "evil.example", "javascript", "ENTITY"} {
+		if strings.Contains(string(storedBody), unsafe) {
+			t.Fatalf("Expected %s to be removed from the SVG, instead %s", unsafe, storedBody)
+		}
+	}
+
+	for _, safe := range []string{`xlink:href="#r"`, `style="fill: url(#g)"`, `stroke="url(#g)"`, `<style>rect{stroke:red}</style>`, `<rect id="r"`} {
+		if !strings.Contains(string(storedBody), safe) {
+			t.Fatalf("Expected %s to be kept in the SVG, instead %s", safe, storedBody)
+		}
+	}
+}
+
+func TestPdfsAreOnlyAcceptedOnPdfRoutes(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+		PdfRoutes:   []string{"/file"},
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	imageprocessor.SetCapabilities(processorcommand.Capabilities{})
+	defer imageprocessor.SetCapabilities(nil)
+
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"))
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {pdf}})
+	if err != nil {
+		t.Fatalf("Error when uploading base64 PDF: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected a PDF to be rejected on /base64, instead %d", res.StatusCode)
+	}
+
+	// /file accepts PDFs, but there's no ghostscript to read them
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("image", "doc.pdf")
+	part.Write([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"))
+	writer.Close()
+
+	res, err = http.Post(ts.URL+"/file", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error when uploading PDF: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Expected a PDF on /file to need ghostscript, instead %d", res.StatusCode)
+	}
+}
+
+func TestThumbnailPdfPagesAreCheckedWithoutReadingThePdf(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+		MaxPdfPages: 3,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	// gm isn't there either, so reading the PDF would fail
+	imageprocessor.SetCapabilities(processorcommand.Capabilities{"gs": {Command: "gs", Available: true}})
+	defer imageprocessor.SetCapabilities(nil)
+
+	f, err := ioutil.TempFile("", "pdf")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp file: %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	f.Close()
+
+	upload, err := uploadedfile.NewUploadedFile("doc.pdf", f.Name(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading PDF: %s", err.Error())
+	}
+	upload.SetHash("abc1234")
+
+	st := server.acquireState()
+	defer st.release()
+
+	if resp := server.checkPdfPage(context.Background(), st, upload, 4); resp == nil || resp.Status != http.StatusNotFound {
+		t.Fatalf("Expected a page past MaxPdfPages not to be found, instead %v", resp)
+	}
+
+	server.pdfPageSizes.add("abc1234", cfg.PdfDensity(), []processorcommand.PageSize{{Width: 10, Height: 20}, {Width: 20, Height: 10}})
+
+	if resp := server.checkPdfPage(context.Background(), st, upload, 2); resp != nil {
+		t.Fatalf("Expected the cached page to be found, instead %v", resp)
+	}
+
+	if resp := server.checkPdfPage(context.Background(), st, upload, 3); resp == nil || resp.Status != http.StatusNotFound {
+		t.Fatalf("Expected a page past the cached pages not to be found, instead %v", resp)
+	}
+}
+
+func TestVideosLargerThanMaxVideoBytesAreRejectedBeforeProbing(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize:   99999999999,
+		MaxVideoBytes: 16,
+		HashLength:    7,
+		UserAgent:     "Foobar",
+		Stores:        config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:          8888,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	// ffprobe isn't really run, the size is checked first
+	imageprocessor.SetCapabilities(processorcommand.Capabilities{
+		processorcommand.FFMPEG_COMMAND:  {Command: processorcommand.FFMPEG_COMMAND, Available: true},
+		processorcommand.FFPROBE_COMMAND: {Command: processorcommand.FFPROBE_COMMAND, Available: true},
+	})
+	defer imageprocessor.SetCapabilities(nil)
+
+	mp4 := base64.StdEncoding.EncodeToString([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom\x00\x00\x00\x08free"))
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {mp4}})
+	if err != nil {
+		t.Fatalf("Error when uploading base64 MP4: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "16 bytes") {
+		t.Fatalf("Expected the MP4 to be too large, instead %d %s", res.StatusCode, body)
+	}
+}
+
+func TestVideoPosterThumbnailsAreTheFormatTheyreStoredAs(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize:         99999999999,
+		HashLength:          7,
+		UserAgent:           "Foobar",
+		Stores:              config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:                8888,
+		ThumbPresets:        config.ThumbPresetMap{"small": {Width: 10}},
+		DefaultThumbPresets: []string{"small"},
+		Pipelines:           config.PipelineMap{"default": {{Step: "thumbnails"}}},
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	// Stand-ins for ffprobe, ffmpeg and gm: the poster frame is a PNG, and gm writes whichever format it's told to
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(bin)
+
+	frame := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	formats := map[string]func(io.Writer) error{
+		"PNG": func(w io.Writer) error { return png.Encode(w, frame) },
+		"JPG": func(w io.Writer) error { return jpeg.Encode(w, frame, nil) },
+	}
+	for name, encode := range formats {
+		f, _ := os.Create(filepath.Join(bin, name))
+		encode(f)
+		f.Close()
+	}
+
+	scripts := map[string]string{
+		"ffprobe": `echo '{"streams": [{"codec_name": "h264", "width": 64, "height": 48}], "format": {"duration": "2.5"}}'`,
+		"ffmpeg":  `for last; do :; done; cp "$BIN/PNG" "$last"`,
+		"gm":      `for last; do :; done; cp "$BIN/${last%%:*}" "${last#*:}"`,
+	}
+	for name, script := range scripts {
+		ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\nBIN="+bin+"\n"+script+"\n"), 0755)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("image", "clip.mp4")
+	part.Write([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom\x00\x00\x00\x08free"))
+	writer.Close()
+
+	res, err := http.Post(ts.URL+"/file", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Error when uploading MP4: %s", err.Error())
+	}
+	respBody, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var serverResp struct {
+		Data ImageResponse `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &serverResp); err != nil {
+		t.Fatalf("Unexpected error parsing response %s: %s", respBody, err.Error())
+	}
+
+	upload := serverResp.Data
+	if res.StatusCode != http.StatusOK || upload.Mime != "video/mp4" || upload.Width != 64 || upload.Height != 48 ||
+		upload.Video == nil || upload.Video.Duration != 2.5 || upload.Video.Codec != "h264" {
+		t.Fatalf("Expected a 64x48 2.5 second h264 MP4, instead %d %s", res.StatusCode, respBody)
+	}
+
+	if _, ok := upload.Thumbs["small"]; !ok {
+		t.Fatalf("Expected a small thumbnail, instead %s", respBody)
+	}
+
+	stored, err := server.ImageStore().Get(&imagestore.StoreObject{Id: upload.Hash + "/small"})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching the thumbnail from the in-memory image store: %s", err.Error())
+	}
+	thumb, _ := ioutil.ReadAll(stored)
+	stored.Close()
+
+	if contentType := http.DetectContentType(thumb); contentType != "image/jpeg" {
+		t.Fatalf("Expected the poster thumbnail to be stored as a JPEG, instead %s", contentType)
+	}
+
+	res, err = http.Get(ts.URL + "/thumbnail?uid=" + upload.Hash + "&thumbs=" + url.QueryEscape(`{"poster":{"width":10,"shape":"thumb","height":10}}`))
+	if err != nil {
+		t.Fatalf("Error requesting thumbnail: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected a JPEG poster thumbnail, instead %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+}
+
+func TestCorruptAndOversizedImagesAreRejectedBeforeProcessing(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	// A PNG header declaring 60000x60000 pixels
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:8], 60000)
+	binary.BigEndian.PutUint32(ihdr[8:12], 60000)
+	ihdr[12], ihdr[13] = 8, 2
+	bomb := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), ihdr...)
+	bomb = append(bomb, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(bomb[len(bomb)-4:], crc32.ChecksumIEEE(ihdr))
+
+	dan, _ := base64.StdEncoding.DecodeString(b64dan)
+	gif, _ := base64.StdEncoding.DecodeString(b64gif)
+
+	// A BMP declaring 60000x60000 pixels, stored top down
+	bmp := make([]byte, 54)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[14:18], 40)
+	binary.LittleEndian.PutUint32(bmp[18:22], 60000)
+	binary.LittleEndian.PutUint32(bmp[22:26], uint32(-60000&0xffffffff))
+
+	// A TIFF whose only page is 60000x60000
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x02\x00")
+	for _, tag := range []uint16{256, 257} {
+		entry := make([]byte, 12)
+		binary.LittleEndian.PutUint16(entry[0:2], tag)
+		binary.LittleEndian.PutUint16(entry[2:4], 4)
+		binary.LittleEndian.PutUint32(entry[4:8], 1)
+		binary.LittleEndian.PutUint32(entry[8:12], 60000)
+		tiff = append(tiff, entry...)
+	}
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	// A HEIC whose image is 60000x60000
+	box := func(name string, contents ...[]byte) []byte {
+		b := append(make([]byte, 4), name...)
+		for _, c := range contents {
+			b = append(b, c...)
+		}
+		binary.BigEndian.PutUint32(b[0:4], uint32(len(b)))
+		return b
+	}
+	ispe := make([]byte, 12)
+	binary.BigEndian.PutUint32(ispe[4:8], 60000)
+	binary.BigEndian.PutUint32(ispe[8:12], 60000)
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	heic := append(ftyp, box("meta", make([]byte, 4), box("iprp", box("ipco", box("ispe", ispe))))...)
+
+	pdf := "%PDF-1.4\n" + strings.Repeat("1 0 obj << /Type /Page >> endobj\n", 101)
+
+	cases := []struct {
+		name   string
+		image  []byte
+		status int
+	}{
+		{"oversized PNG", bomb, http.StatusRequestEntityTooLarge},
+		{"truncated PNG", dan[:len(dan)/2], http.StatusUnprocessableEntity},
+		{"truncated GIF", gif[:len(gif)-1], http.StatusUnprocessableEntity},
+		{"JPEG without a frame", []byte("\xff\xd8\xff\xd9"), http.StatusUnprocessableEntity},
+		{"oversized SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 60000 60000"/>`), http.StatusRequestEntityTooLarge},
+		{"SVG without a size", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), http.StatusUnprocessableEntity},
+		{"oversized BMP", bmp, http.StatusRequestEntityTooLarge},
+		{"ICO without images", []byte("\x00\x00\x01\x00\x00\x00"), http.StatusUnprocessableEntity},
+		{"oversized TIFF", tiff, http.StatusRequestEntityTooLarge},
+		{"oversized HEIC", heic, http.StatusRequestEntityTooLarge},
+		{"HEIC without a size", append(ftyp, box("meta", make([]byte, 4))...), http.StatusUnprocessableEntity},
+		{"PDF with too many pages", []byte(pdf), http.StatusRequestEntityTooLarge},
+		{"plain text", []byte("Not an image at all"), http.StatusUnsupportedMediaType},
+		{"malformed SVG", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect>`), http.StatusUnprocessableEntity},
+	}
+
+	for _, c := range cases {
+		res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {base64.StdEncoding.EncodeToString(c.image)}})
+		if err != nil {
+			t.Fatalf("Error when uploading %s: %s", c.name, err.Error())
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != c.status {
+			t.Fatalf("Expected %d uploading %s, instead %d %s", c.status, c.name, res.StatusCode, body)
+		}
+	}
+}
+
+func TestUploadsViolatingTheirRoutesPolicyAreRejected(t *testing.T) {
+	cfg := &config.Configuration{
+		MaxFileSize: 99999999999,
+		HashLength:  7,
+		UserAgent:   "Foobar",
+		Stores:      config.StoreList{&imagestore.MemoryStoreConfig{}},
+		Port:        8888,
+		UploadPolicies: config.UploadPolicyMap{
+			"avatar": {MinWidth: 128, AspectRatios: []string{"1:1"}, MimeTypes: []string{"image/png"}},
+		},
+		RoutePolicies:       map[string]string{"/base64": "avatar"},
+		ThumbPresets:        config.ThumbPresetMap{"small": {Width: 10}},
+		DefaultThumbPresets: []string{"small"},
+		Pipelines:           config.PipelineMap{"default": {{Step: "thumbnails"}}},
+	}
+
+	server, err := NewServer(cfg, imageprocessor.PassthroughStrategy, &DiscardStats{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %s", err.Error())
+	}
+
+	// A gm that only records it was run, to show the thumbnails aren't made for an upload that's rejected
+	bin, err := ioutil.TempDir("", "bin")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(bin)
+
+	ran := filepath.Join(bin, "ran")
+	ioutil.WriteFile(filepath.Join(bin, "gm"), []byte("#!/bin/sh\necho \"$@\" >> "+ran+"\n"), 0755)
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	muxer := http.NewServeMux()
+	server.Configure(muxer)
+	ts := httptest.NewServer(muxer)
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/base64", url.Values{"image": {b64dan}})
+	if err != nil {
+		t.Fatalf("Error when uploading: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected a 422 uploading an image smaller than the policy, instead %d", res.StatusCode)
+	}
+
+	var resp struct {
+		Data PolicyResponse `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("Error decoding response: %s", err.Error())
+	}
+
+	if len(resp.Data.Violations) != 1 || resp.Data.Violations[0].Constraint != "MinWidth" {
+		t.Fatalf("Expected only MinWidth to be violated, instead %+v", resp.Data.Violations)
+	}
+
+	if commands, _ := ioutil.ReadFile(ran); strings.Contains(string(commands), "_small") {
+		t.Fatalf("Expected the thumbnail not to be made, instead gm ran %s", commands)
+	}
+}
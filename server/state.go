@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imagestore"
+	"github.com/Imgur/mandible/logging"
+)
+
+var ErrNoConfigLoader = errors.New("No config loader was set, unable to reload.")
+
+// Everything the server builds from its configuration. Reloading the configuration builds a new serverState and swaps
+// it in; requests hold on to the state they started with until they finish.
+type serverState struct {
+	config        *config.Configuration
+	imageStore    imagestore.ImageStore
+	hashGenerator *imagestore.HashGenerator
+	authenticator Authenticator
+	pipelines     map[string]*imageprocessor.Pipeline
+	thumbQueue    *thumbQueue
+	inFlight      sync.WaitGroup
+}
+
+type stateContextKey struct{}
+
+func (s *Server) newState(c *config.Configuration) (*serverState, error) {
+	pipelines, err := imageprocessor.NewPipelines(c.Pipelines)
+	if err != nil {
+		return nil, err
+	}
+
+	factory := imagestore.NewFactory(c)
+	factory.SetObserver(s.observeStore)
+	stores, err := factory.NewImageStores()
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := s.fixedAuthenticator
+	if authenticator == nil {
+		if c.AuthenticationHMACKey != "" {
+			authenticator = NewHMACAuthenticatorSHA256([]byte(c.AuthenticationHMACKey))
+		} else {
+			authenticator = &PassthroughAuthenticator{}
+		}
+	}
+
+	return &serverState{
+		config:        c,
+		imageStore:    stores,
+		hashGenerator: factory.NewHashGenerator(stores),
+		authenticator: authenticator,
+		pipelines:     pipelines,
+		thumbQueue:    newThumbQueue(c),
+	}, nil
+}
+
+// The strategy for an upload: the named pipeline, the pipeline named default, or the server's strategy.
+func (s *Server) strategy(st *serverState, pipeline string) (imageprocessor.ImageProcessorStrategy, error) {
+	if pipeline == "" {
+		pipeline = "default"
+		if _, ok := st.pipelines[pipeline]; !ok {
+			return s.processorStrategy, nil
+		}
+	}
+
+	p, ok := st.pipelines[pipeline]
+	if !ok {
+		return nil, fmt.Errorf("Unknown pipeline %q", pipeline)
+	}
+
+	return p.Strategy(), nil
+}
+
+// Returns the current state, which must be released when the caller is done with it.
+func (s *Server) acquireState() *serverState {
+	s.stateMu.RLock()
+	st := s.state
+	st.inFlight.Add(1)
+	s.stateMu.RUnlock()
+
+	return st
+}
+
+func (st *serverState) release() {
+	st.inFlight.Done()
+}
+
+// Pins the current state for the duration of a request, so a reload can't swap stores out from under it.
+func (s *Server) withState(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.acquireState()
+		defer st.release()
+
+		ctx := context.WithValue(r.Context(), stateContextKey{}, st)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) requestState(r *http.Request) *serverState {
+	return r.Context().Value(stateContextKey{}).(*serverState)
+}
+
+// Config returns the configuration currently in use. It replaces the Config field, which went stale once the
+// configuration was reloaded.
+func (s *Server) Config() *config.Configuration {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.state.config
+}
+
+// ImageStore returns the image store currently in use. It replaces the ImageStore field for the same reason as Config.
+func (s *Server) ImageStore() imagestore.ImageStore {
+	s.stateMu.RLock()
+	defer s.stateMu.RUnlock()
+
+	return s.state.imageStore
+}
+
+// SetConfigLoader sets the function ReloadConfig uses to read the configuration again.
+func (s *Server) SetConfigLoader(loader func() (*config.Configuration, error)) {
+	s.reloadMu.Lock()
+	s.configLoader = loader
+	s.reloadMu.Unlock()
+}
+
+// ReloadConfig reads the configuration with the config loader and reloads it. On error the current configuration is
+// kept.
+func (s *Server) ReloadConfig() error {
+	s.reloadMu.Lock()
+	loader := s.configLoader
+	s.reloadMu.Unlock()
+
+	if loader == nil {
+		return ErrNoConfigLoader
+	}
+
+	c, err := loader()
+	if err != nil {
+		return err
+	}
+
+	return s.Reload(c)
+}
+
+// Reload validates c and rebuilds the stores, hash generator, authenticator and thumbnail queue from it. New requests use the new
+// instances while in-flight requests finish on the old ones. If c is invalid or the stores can't be created the
+// current configuration is kept and the error returned.
+func (s *Server) Reload(c *config.Configuration) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	st, err := s.newState(c)
+	if err != nil {
+		return err
+	}
+
+	s.stateMu.Lock()
+	old := s.state
+	s.state = st
+	s.stateMu.Unlock()
+
+	if old.config.Port != c.Port {
+		s.log().Warn("Port changed, restart to listen on the new port", "old_port", old.config.Port, "new_port", c.Port)
+	}
+
+	s.goBackground(func() {
+		old.inFlight.Wait()
+		old.hashGenerator.Stop()
+	})
+
+	return nil
+}
+
+// Admin endpoints are disabled unless AdminKey is configured, and require it in the X-Admin-Key header.
+func (s *Server) adminEndpoint(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.requestState(r).config.AdminKey
+		if key == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(key)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		resp := ServerResponse{
+			Status: http.StatusMethodNotAllowed,
+			Error:  "Reloading requires a POST",
+		}
+		resp.Send(w, r, s.stats)
+		return
+	}
+
+	err := s.ReloadConfig()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Config reload failed, keeping the current config", "error", err)
+		resp := ServerResponse{
+			Status: http.StatusUnprocessableEntity,
+			Error:  "Config reload failed: " + err.Error(),
+		}
+		resp.Send(w, r, s.stats)
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("Config reloaded")
+	resp := ServerResponse{
+		Data:   map[string]bool{"reloaded": true},
+		Status: http.StatusOK,
+	}
+	resp.Send(w, r, s.stats)
+}
+
+// Lists the external programs found at startup, with their versions.
+func (s *Server) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ServerResponse{
+		Data:   imageprocessor.GetCapabilities(),
+		Status: http.StatusOK,
+	}
+	resp.Send(w, r, s.stats)
+}
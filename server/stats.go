@@ -3,73 +3,86 @@ package server
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PagerDuty/godspeed"
+
+	"github.com/Imgur/mandible/config"
 )
 
 type RuntimeStats interface {
 	LogStartup()
 
-	Request(url string)
-	ResponseTime(elapsed time.Duration, url string)
+	// Requests are identified by their route template, e.g. /user/{user_id}/url
+	Request(route string)
+	ResponseTime(elapsed time.Duration, route string)
 	Thumbnail(name string)
 	Upload(source string)
 	Error(code int)
+
+	// Timings of the steps of handling an upload: each processor, each external command it runs and each store
+	// operation, i.e. save, exists or get, by store type.
+	ProcessTime(elapsed time.Duration, processor string, success bool)
+	CommandTime(elapsed time.Duration, command string, success bool)
+	StoreTime(elapsed time.Duration, store, operation string, success bool)
+}
+
+func outcome(success bool) string {
+	if success {
+		return "success"
+	}
+
+	return "error"
 }
 
 type DiscardStats struct{}
 
-func (d *DiscardStats) LogStartup()                                    {}
-func (d *DiscardStats) Request(url string)                             {}
-func (d *DiscardStats) ResponseTime(elapsed time.Duration, url string) {}
-func (d *DiscardStats) Thumbnail(name string)                          {}
-func (d *DiscardStats) Upload(source string)                           {}
-func (d *DiscardStats) Error(code int)                                 {}
+func (d *DiscardStats) LogStartup()                                                            {}
+func (d *DiscardStats) Request(route string)                                                   {}
+func (d *DiscardStats) ResponseTime(elapsed time.Duration, route string)                       {}
+func (d *DiscardStats) Thumbnail(name string)                                                  {}
+func (d *DiscardStats) Upload(source string)                                                   {}
+func (d *DiscardStats) Error(code int)                                                         {}
+func (d *DiscardStats) ProcessTime(elapsed time.Duration, processor string, success bool)      {}
+func (d *DiscardStats) CommandTime(elapsed time.Duration, command string, success bool)        {}
+func (d *DiscardStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {}
 
 type DatadogStats struct {
 	dog *godspeed.Godspeed
 }
 
-func NewDatadogStats(datadogHost string) (*DatadogStats, error) {
-	var ip net.IP = nil
-	var err error = nil
-
-	// Assume datadogHost is an IP and try to parse it
-	ip = net.ParseIP(datadogHost)
-
-	// Parsing failed
-	if ip == nil {
-		ips, _ := net.LookupIP(datadogHost)
-
-		if len(ips) > 0 {
-			ip = ips[0]
-		}
+// NewDatadogStats sends stats to the dogstatsd agent at datadogAddress, a host or host:port.
+func NewDatadogStats(datadogAddress string) (*DatadogStats, error) {
+	host, port, err := splitStatsdAddress(datadogAddress)
+	if err != nil {
+		return nil, err
 	}
 
-	if ip != nil {
-		gdsp, err := godspeed.New(ip.String(), godspeed.DefaultPort, false)
-		if err == nil {
-			return &DatadogStats{gdsp}, nil
-		}
+	gdsp, err := godspeed.New(host, port, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, err
+	return &DatadogStats{gdsp}, nil
 }
 
 func (d *DatadogStats) LogStartup() {
 	d.dog.Incr("mandible.startup", nil)
 }
 
-func (d *DatadogStats) Request(url string) {
-	tag := fmt.Sprintf("url:%s", url)
+func (d *DatadogStats) Request(route string) {
+	tag := fmt.Sprintf("url:%s", route)
 
 	d.dog.Incr("mandible.request", []string{tag})
 }
 
-func (d *DatadogStats) ResponseTime(elapsed time.Duration, url string) {
+func (d *DatadogStats) ResponseTime(elapsed time.Duration, route string) {
 	time := elapsed.Seconds()
-	tag := fmt.Sprintf("url:%s", url)
+	tag := fmt.Sprintf("url:%s", route)
 
 	d.dog.Timing("mandible.responseTime", time, []string{tag})
 }
@@ -90,3 +103,279 @@ func (d *DatadogStats) Error(code int) {
 	tag := fmt.Sprintf("code:%d", code)
 	d.dog.Incr("mandible.error", []string{tag})
 }
+
+func (d *DatadogStats) ProcessTime(elapsed time.Duration, processor string, success bool) {
+	tags := []string{"processor:" + processor, "outcome:" + outcome(success)}
+
+	d.dog.Timing("mandible.processTime", elapsed.Seconds(), tags)
+}
+
+func (d *DatadogStats) CommandTime(elapsed time.Duration, command string, success bool) {
+	tags := []string{"command:" + command, "outcome:" + outcome(success)}
+
+	d.dog.Timing("mandible.commandTime", elapsed.Seconds(), tags)
+}
+
+func (d *DatadogStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {
+	tags := []string{"store:" + store, "operation:" + operation, "outcome:" + outcome(success)}
+
+	d.dog.Timing("mandible.storeTime", elapsed.Seconds(), tags)
+}
+
+// Resolves a statsd host or host:port, defaulting to the standard statsd port.
+func splitStatsdAddress(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host, portStr = address, strconv.Itoa(godspeed.DefaultPort)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid statsd port in %s", address)
+	}
+
+	// Assume host is an IP and try to parse it
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return "", 0, fmt.Errorf("Unable to resolve statsd host %s", host)
+		}
+		ip = ips[0]
+	}
+
+	return ip.String(), port, nil
+}
+
+// MultiStats sends every stat to each of its backends.
+type MultiStats []RuntimeStats
+
+func (m MultiStats) LogStartup() {
+	for _, stats := range m {
+		stats.LogStartup()
+	}
+}
+
+func (m MultiStats) Request(route string) {
+	for _, stats := range m {
+		stats.Request(route)
+	}
+}
+
+func (m MultiStats) ResponseTime(elapsed time.Duration, route string) {
+	for _, stats := range m {
+		stats.ResponseTime(elapsed, route)
+	}
+}
+
+func (m MultiStats) Thumbnail(name string) {
+	for _, stats := range m {
+		stats.Thumbnail(name)
+	}
+}
+
+func (m MultiStats) Upload(source string) {
+	for _, stats := range m {
+		stats.Upload(source)
+	}
+}
+
+func (m MultiStats) Error(code int) {
+	for _, stats := range m {
+		stats.Error(code)
+	}
+}
+
+func (m MultiStats) ProcessTime(elapsed time.Duration, processor string, success bool) {
+	for _, stats := range m {
+		stats.ProcessTime(elapsed, processor, success)
+	}
+}
+
+func (m MultiStats) CommandTime(elapsed time.Duration, command string, success bool) {
+	for _, stats := range m {
+		stats.CommandTime(elapsed, command, success)
+	}
+}
+
+func (m MultiStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {
+	for _, stats := range m {
+		stats.StoreTime(elapsed, store, operation, success)
+	}
+}
+
+const defaultStatsBufferSize = 1024
+
+// BufferedStats hands stats to its backend from a separate goroutine, so a slow backend can't add latency to
+// requests. When the buffer is full, or it's closed, new stats are dropped and counted instead.
+type BufferedStats struct {
+	stats   RuntimeStats
+	events  chan func()
+	dropped uint64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewBufferedStats(stats RuntimeStats, size int) *BufferedStats {
+	if size <= 0 {
+		size = defaultStatsBufferSize
+	}
+
+	b := &BufferedStats{
+		stats:  stats,
+		events: make(chan func(), size),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(b.done)
+		for event := range b.events {
+			event()
+		}
+	}()
+
+	return b
+}
+
+func (b *BufferedStats) send(event func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		atomic.AddUint64(&b.dropped, 1)
+		return
+	}
+
+	select {
+	case b.events <- event:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// Dropped returns how many stats were discarded because the buffer was full.
+func (b *BufferedStats) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close flushes the buffer. Stats sent after Close are dropped.
+func (b *BufferedStats) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.events)
+	}
+	b.mu.Unlock()
+
+	<-b.done
+}
+
+func (b *BufferedStats) LogStartup() {
+	b.send(b.stats.LogStartup)
+}
+
+func (b *BufferedStats) Request(route string) {
+	b.send(func() { b.stats.Request(route) })
+}
+
+func (b *BufferedStats) ResponseTime(elapsed time.Duration, route string) {
+	b.send(func() { b.stats.ResponseTime(elapsed, route) })
+}
+
+func (b *BufferedStats) Thumbnail(name string) {
+	b.send(func() { b.stats.Thumbnail(name) })
+}
+
+func (b *BufferedStats) Upload(source string) {
+	b.send(func() { b.stats.Upload(source) })
+}
+
+func (b *BufferedStats) Error(code int) {
+	b.send(func() { b.stats.Error(code) })
+}
+
+func (b *BufferedStats) ProcessTime(elapsed time.Duration, processor string, success bool) {
+	b.send(func() { b.stats.ProcessTime(elapsed, processor, success) })
+}
+
+func (b *BufferedStats) CommandTime(elapsed time.Duration, command string, success bool) {
+	b.send(func() { b.stats.CommandTime(elapsed, command, success) })
+}
+
+func (b *BufferedStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {
+	b.send(func() { b.stats.StoreTime(elapsed, store, operation, success) })
+}
+
+// NewRuntimeStats builds the configured stats backends. Those sending over the network are each behind their own
+// buffer, prometheus only keeps stats in memory so it isn't.
+func NewRuntimeStats(backends config.StatsList) (RuntimeStats, error) {
+	multi := make(MultiStats, 0, len(backends))
+
+	for i, backend := range backends {
+		var stats RuntimeStats
+		var err error
+
+		switch backend.Type {
+		case config.StatsDatadog:
+			stats, err = NewDatadogStats(backend.Address)
+		case config.StatsStatsd:
+			stats, err = NewStatsdStats(backend.Address, backend.Prefix)
+		case config.StatsPrometheus:
+			multi = append(multi, NewPrometheusStats())
+			continue
+		default:
+			err = fmt.Errorf("unsupported stats backend %q", backend.Type)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Stats[%d]: %s", i, err.Error())
+		}
+
+		multi = append(multi, NewBufferedStats(stats, backend.BufferSize))
+	}
+
+	switch len(multi) {
+	case 0:
+		return &DiscardStats{}, nil
+	case 1:
+		return multi[0], nil
+	}
+
+	return multi, nil
+}
+
+// Close flushes the buffered backends.
+func (m MultiStats) Close() {
+	for _, stats := range m {
+		closeStats(stats)
+	}
+}
+
+// Flushes stats if they're buffered.
+func closeStats(stats RuntimeStats) {
+	if closer, ok := stats.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
+}
+
+// Finds the backend serving /metrics, looking inside MultiStats and BufferedStats.
+func metricsHandler(stats RuntimeStats) (http.Handler, bool) {
+	switch s := stats.(type) {
+	case *PrometheusStats:
+		return s, true
+	case *BufferedStats:
+		return metricsHandler(s.stats)
+	case MultiStats:
+		for _, backend := range s {
+			if handler, ok := metricsHandler(backend); ok {
+				return handler, true
+			}
+		}
+	}
+
+	return nil, false
+}
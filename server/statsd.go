@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var statsdUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// StatsdStats sends stats to a plain statsd server, which has no tags, so labels become part of the metric name:
+// mandible.request.user_user_id_url
+type StatsdStats struct {
+	conn   net.Conn
+	prefix string
+}
+
+func NewStatsdStats(address, prefix string) (*StatsdStats, error) {
+	host, port, err := splitStatsdAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
+		prefix = "mandible"
+	}
+
+	return &StatsdStats{conn, strings.TrimSuffix(prefix, ".")}, nil
+}
+
+func (s *StatsdStats) send(name, value, kind string) {
+	// Dropped packets are fine, statsd is best effort
+	fmt.Fprintf(s.conn, "%s.%s:%s|%s", s.prefix, name, value, kind)
+}
+
+func (s *StatsdStats) LogStartup() {
+	s.send("startup", "1", "c")
+}
+
+func (s *StatsdStats) Request(route string) {
+	s.send("request."+statsdName(route), "1", "c")
+}
+
+func (s *StatsdStats) ResponseTime(elapsed time.Duration, route string) {
+	s.timing("response_time."+statsdName(route), elapsed)
+}
+
+func (s *StatsdStats) timing(name string, elapsed time.Duration) {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	s.send(name, fmt.Sprintf("%g", ms), "ms")
+}
+
+func (s *StatsdStats) Thumbnail(name string) {
+	s.send("thumbnail."+statsdName(name), "1", "c")
+}
+
+func (s *StatsdStats) Upload(source string) {
+	s.send("upload."+statsdName(source), "1", "c")
+}
+
+func (s *StatsdStats) Error(code int) {
+	s.send(fmt.Sprintf("error.%d", code), "1", "c")
+}
+
+func (s *StatsdStats) ProcessTime(elapsed time.Duration, processor string, success bool) {
+	s.timing("process."+statsdName(processor)+"."+outcome(success), elapsed)
+}
+
+func (s *StatsdStats) CommandTime(elapsed time.Duration, command string, success bool) {
+	s.timing("command."+statsdName(command)+"."+outcome(success), elapsed)
+}
+
+func (s *StatsdStats) StoreTime(elapsed time.Duration, store, operation string, success bool) {
+	s.timing("store."+statsdName(store)+"."+operation+"."+outcome(success), elapsed)
+}
+
+// Turns a route or label into a single metric name segment, i.e. /user/{user_id}/url is user_user_id_url.
+func statsdName(label string) string {
+	name := strings.Trim(statsdUnsafeChars.ReplaceAllString(label, "_"), "_")
+	if name == "" {
+		return "root"
+	}
+
+	return name
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+var ErrAdHocThumbs = errors.New("Only thumbnail presets are allowed!")
+
+// The thumbnails a request asks for: the specs in its thumbs parameter and the presets named in its presets
+// parameter, plus the default presets for uploads. A thumbnail asked for by name isn't created twice.
+func requestedThumbs(c *config.Configuration, r *http.Request, withDefaults bool) ([]*uploadedfile.ThumbFile, error) {
+	thumbs, err := parseThumbs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(thumbs) > 0 && c.StrictThumbPresets {
+		return nil, ErrAdHocThumbs
+	}
+
+	var names []string
+	for _, name := range strings.Split(r.FormValue("presets"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if withDefaults {
+		names = append(names, c.DefaultThumbPresets...)
+	}
+
+	requested := make(map[string]bool)
+	for _, t := range thumbs {
+		requested[t.Name] = true
+	}
+
+	for _, name := range names {
+		if requested[name] {
+			continue
+		}
+
+		preset, ok := c.ThumbPresets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown thumbnail preset %q!", name)
+		}
+
+		thumbs = append(thumbs, presetThumb(name, preset))
+		requested[name] = true
+	}
+
+	return thumbs, nil
+}
+
+func presetThumb(name string, preset config.ThumbPreset) *uploadedfile.ThumbFile {
+	return uploadedfile.NewThumbFile(
+		preset.Width,
+		preset.MaxWidth,
+		preset.Height,
+		preset.MaxHeight,
+		name,
+		preset.Shape,
+		"", // path
+		preset.CropGravity,
+		preset.CropWidth,
+		preset.CropHeight,
+		preset.CropRatio,
+		preset.Quality,
+		preset.Format,
+		preset.NoStore,
+		preset.Animated,
+	)
+}
+
+// The name thumbnails are counted under in stats: presets by name, and every ad-hoc thumbnail as custom, so clients
+// can't create a series per name.
+func thumbStatName(c *config.Configuration, name string) string {
+	if _, ok := c.ThumbPresets[name]; ok {
+		return name
+	}
+
+	return "custom"
+}
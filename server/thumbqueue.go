@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/Imgur/mandible/config"
+	"github.com/Imgur/mandible/imageprocessor"
+	"github.com/Imgur/mandible/imagestore"
+	"github.com/Imgur/mandible/logging"
+	"github.com/Imgur/mandible/tracing"
+	"github.com/Imgur/mandible/uploadedfile"
+)
+
+const (
+	ThumbPending = "pending"
+	ThumbReady   = "ready"
+)
+
+var errThumbQueueFull = errors.New("Thumbnail queue is full")
+
+// Limits how many uploads' thumbnails wait and are created at once. Each serverState has its own, sized by its config.
+type thumbQueue struct {
+	queued  chan struct{}
+	workers chan struct{}
+}
+
+func newThumbQueue(c *config.Configuration) *thumbQueue {
+	return &thumbQueue{
+		queued:  make(chan struct{}, c.ThumbQueueLength()),
+		workers: make(chan struct{}, c.ThumbWorkerCount()),
+	}
+}
+
+// The thumbnails still being created in the background, by store ID. They're tracked by the server rather than the
+// queue so they stay pending across reloads.
+type pendingThumbs struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (this *pendingThumbs) isPending(id string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.ids[id]
+}
+
+func (this *pendingThumbs) set(ids []string, pending bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.ids == nil {
+		this.ids = make(map[string]bool)
+	}
+
+	for _, id := range ids {
+		if pending {
+			this.ids[id] = true
+		} else {
+			delete(this.ids, id)
+		}
+	}
+}
+
+// Queues creating thumbs of upload in the background, returning their URLs as known before they're stored. upload is
+// copied since the request cleans it up once it responds.
+func (s *Server) queueThumbs(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, original *imagestore.StoreObject, thumbs []*uploadedfile.ThumbFile) (map[string]interface{}, error) {
+	select {
+	case st.thumbQueue.queued <- struct{}{}:
+	default:
+		return nil, errThumbQueueFull
+	}
+
+	jobUpload, err := s.copyUpload(upload, thumbs)
+	if err != nil {
+		<-st.thumbQueue.queued
+		return nil, err
+	}
+
+	factory := imagestore.NewFactory(st.config)
+	thumbsResp := map[string]interface{}{}
+	ids := make([]string, 0, len(thumbs))
+
+	for _, t := range thumbs {
+		tObj := thumbObject(factory, upload, t, original)
+		thumbsResp[t.Name] = imagestore.URLFor(st.imageStore, tObj)
+		ids = append(ids, tObj.Id)
+	}
+	s.pendingThumbs.set(ids, true)
+
+	// The job keeps the request's logger and trace, and its state like a request would
+	jobCtx := logging.NewContext(context.Background(), logging.FromContext(ctx))
+	jobCtx = tracing.ContextWithRemoteSpanContext(jobCtx, tracing.SpanFromContext(ctx).SpanContext())
+	st.inFlight.Add(1)
+
+	s.goBackground(func() {
+		defer func() { <-st.thumbQueue.queued }()
+		defer st.release()
+		defer jobUpload.Clean()
+		defer s.pendingThumbs.set(ids, false)
+
+		st.thumbQueue.workers <- struct{}{}
+		defer func() { <-st.thumbQueue.workers }()
+
+		jobCtx, span := s.tracer.Start(jobCtx, "background thumbnails")
+		span.SetAttribute("uid", upload.GetHash())
+		defer span.End()
+
+		_, err := s.createThumbs(jobCtx, st, jobUpload, original)
+		span.SetError(err)
+		if err != nil {
+			logging.FromContext(jobCtx).Error("Error creating thumbnails in the background", "uid", upload.GetHash(), "error", err)
+		}
+	})
+
+	return thumbsResp, nil
+}
+
+// Creates and stores the thumbnails of an upload that weren't made by its processor.
+func (s *Server) createThumbs(ctx context.Context, st *serverState, upload *uploadedfile.UploadedFile, original *imagestore.StoreObject) (map[string]interface{}, error) {
+	processor, err := imageprocessor.ThumbnailStrategy(st.config, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	processor.Observe(s.observeProcess)
+	if err := processor.Run(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return s.buildThumbResponse(ctx, st, upload, original)
+}
+
+func (s *Server) copyUpload(upload *uploadedfile.UploadedFile, thumbs []*uploadedfile.ThumbFile) (*uploadedfile.UploadedFile, error) {
+	f, err := os.Open(upload.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	path, err := s.saveToTmp(f)
+	if err != nil {
+		return nil, err
+	}
+
+	copied, err := uploadedfile.NewUploadedFile(upload.GetFilename(), path, thumbs)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	copied.SetHash(upload.GetHash())
+
+	return copied, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/Imgur/mandible/tracing"
+)
+
+// SetTracer enables tracing of requests. A nil tracer disables it.
+func (s *Server) SetTracer(tracer *tracing.Tracer) {
+	s.tracer = tracer
+}
+
+// Records the response status and size for logging and tracing.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (this *statusRecorder) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *statusRecorder) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(b)
+	this.bytes += n
+	return n, err
+}
+
+// Starts the request's span, continuing the caller's trace if it sent a traceparent header. The span is renamed to
+// the route once the router has matched one.
+func (s *Server) traced(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if parent, ok := tracing.Extract(r.Header); ok {
+			ctx = tracing.ContextWithRemoteSpanContext(ctx, parent)
+		}
+
+		ctx, span := s.tracer.Start(ctx, r.Method)
+		span.SetKind(tracing.KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		if requestID := w.Header().Get(RequestIDHeader); requestID != "" {
+			span.SetAttribute("request_id", requestID)
+		}
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", rec.status)
+	})
+}
@@ -0,0 +1,25 @@
+package tracing
+
+import (
+	"os"
+
+	"github.com/Imgur/mandible/config"
+)
+
+// NewTracerFromConfig builds the configured exporter. It returns a nil Tracer, which records nothing, if tracing is
+// disabled.
+func NewTracerFromConfig(c config.TracingConfig) *Tracer {
+	service := c.ServiceName
+	if service == "" {
+		service = "mandible"
+	}
+
+	switch c.Exporter {
+	case config.TracingStdout:
+		return NewTracer(NewStdoutExporter(os.Stdout, service))
+	case config.TracingOTLP:
+		return NewTracer(NewOTLPExporter(c.Endpoint, service))
+	}
+
+	return nil
+}
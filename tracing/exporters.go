@@ -0,0 +1,271 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporter receives finished spans. Export must not block the caller for long.
+type Exporter interface {
+	Export(span SpanData)
+	Shutdown(ctx context.Context) error
+}
+
+// InMemoryExporter keeps spans for tests to inspect.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+func (this *InMemoryExporter) Export(span SpanData) {
+	this.mu.Lock()
+	this.spans = append(this.spans, span)
+	this.mu.Unlock()
+}
+
+func (this *InMemoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (this *InMemoryExporter) Spans() []SpanData {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]SpanData{}, this.spans...)
+}
+
+func (this *InMemoryExporter) Reset() {
+	this.mu.Lock()
+	this.spans = nil
+	this.mu.Unlock()
+}
+
+// StdoutExporter writes each span as a line of OTLP JSON, for development or log based collection.
+type StdoutExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	service string
+}
+
+func NewStdoutExporter(w io.Writer, service string) *StdoutExporter {
+	return &StdoutExporter{w: w, service: service}
+}
+
+func (this *StdoutExporter) Export(span SpanData) {
+	data, err := json.Marshal(otlpRequest(this.service, []SpanData{span}))
+	if err != nil {
+		log.Printf("Error encoding span: %s", err.Error())
+		return
+	}
+
+	this.mu.Lock()
+	this.w.Write(append(data, '\n'))
+	this.mu.Unlock()
+}
+
+func (this *StdoutExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter sends batches of spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding. Spans are
+// queued and dropped if the queue is full, so a slow collector doesn't slow down requests.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	queue    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOTLPExporter exports to endpoint, the full URL of the collector's traces endpoint, i.e.
+// http://localhost:4318/v1/traces.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	this := &OTLPExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan SpanData, otlpQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go this.run()
+
+	return this
+}
+
+func (this *OTLPExporter) Export(span SpanData) {
+	select {
+	case this.queue <- span:
+	default:
+	}
+}
+
+// Shutdown sends the queued spans and stops the exporter.
+func (this *OTLPExporter) Shutdown(ctx context.Context) error {
+	flushed := make(chan struct{})
+
+	this.stopOnce.Do(func() {
+		select {
+		case this.flush <- flushed:
+		case <-ctx.Done():
+		}
+	})
+
+	select {
+	case <-flushed:
+		return nil
+	case <-this.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *OTLPExporter) run() {
+	defer close(this.done)
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, otlpBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			this.send(batch)
+			batch = make([]SpanData, 0, otlpBatchSize)
+		}
+	}
+
+	for {
+		select {
+		case span := <-this.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-this.flush:
+			for len(this.queue) > 0 {
+				batch = append(batch, <-this.queue)
+			}
+			send()
+			close(flushed)
+			return
+		}
+	}
+}
+
+func (this *OTLPExporter) send(spans []SpanData) {
+	body, err := json.Marshal(otlpRequest(this.service, spans))
+	if err != nil {
+		log.Printf("Error encoding spans: %s", err.Error())
+		return
+	}
+
+	resp, err := this.client.Post(this.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error exporting %d spans: %s", len(spans), err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Error exporting %d spans: collector responded %s", len(spans), resp.Status)
+	}
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest.
+func otlpRequest(service string, spans []SpanData) map[string]interface{} {
+	encoded := make([]interface{}, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan(span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]Attribute{{"service.name", service}}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/Imgur/mandible/tracing"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpSpan(span SpanData) map[string]interface{} {
+	encoded := map[string]interface{}{
+		"traceId":           span.TraceID.String(),
+		"spanId":            span.SpanID.String(),
+		"name":              span.Name,
+		"kind":              int(span.Kind) + 1, // OTLP numbers SPAN_KIND_INTERNAL as 1
+		"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.Attributes),
+	}
+
+	if span.ParentSpanID.IsValid() {
+		encoded["parentSpanId"] = span.ParentSpanID.String()
+	}
+
+	if span.Error != "" {
+		encoded["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+	}
+
+	return encoded
+}
+
+func otlpAttributes(attrs []Attribute) []interface{} {
+	encoded := make([]interface{}, 0, len(attrs))
+
+	for _, attr := range attrs {
+		var value map[string]interface{}
+
+		switch v := attr.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		encoded = append(encoded, map[string]interface{}{"key": attr.Key, "value": value})
+	}
+
+	return encoded
+}
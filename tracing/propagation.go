@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The W3C trace context header, https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "Traceparent"
+
+// Extract parses the traceparent header of an incoming request.
+func Extract(header http.Header) (SpanContext, bool) {
+	return ParseTraceparent(header.Get(TraceparentHeader))
+}
+
+// Inject sets the traceparent header for an outgoing request to continue the trace of the span in ctx.
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := parentSpanContext(ctx)
+	if !ok {
+		return
+	}
+
+	header.Set(TraceparentHeader, FormatTraceparent(sc))
+}
+
+func FormatTraceparent(sc SpanContext) string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a version-traceid-parentid-flags header value. Versions other than 00 are read the same
+// way, as the spec requires, as long as the first four fields are well formed.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	if !decodeLowerHex(version, make([]byte, 1)) ||
+		!decodeLowerHex(traceID, sc.TraceID[:]) ||
+		!decodeLowerHex(spanID, sc.SpanID[:]) {
+		return sc, false
+	}
+
+	flagBytes := make([]byte, 1)
+	if !decodeLowerHex(flags, flagBytes) {
+		return sc, false
+	}
+	sc.Sampled = flagBytes[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+func decodeLowerHex(s string, dst []byte) bool {
+	if len(s) != len(dst)*2 || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
@@ -0,0 +1,265 @@
+// Package tracing records spans for distributed traces, propagated with W3C trace context headers and exported to
+// stdout, an OpenTelemetry collector over OTLP/HTTP or memory.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (this TraceID) String() string { return hex.EncodeToString(this[:]) }
+func (this SpanID) String() string  { return hex.EncodeToString(this[:]) }
+
+func (this TraceID) IsValid() bool { return this != TraceID{} }
+func (this SpanID) IsValid() bool  { return this != SpanID{} }
+
+// SpanContext identifies a span, either one of ours or the caller's from a traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (this SpanContext) IsValid() bool {
+	return this.TraceID.IsValid() && this.SpanID.IsValid()
+}
+
+type SpanKind int
+
+const (
+	KindInternal SpanKind = iota
+	KindServer
+	KindClient
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	Error        string
+}
+
+// Attribute returns the value of the attribute key, or nil.
+func (this SpanData) Attribute(key string) interface{} {
+	for _, attr := range this.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+
+	return nil
+}
+
+// Span is an operation in progress. All methods are safe to call on a nil *Span, which is what StartSpan returns
+// when tracing is disabled, so callers don't need to check.
+type Span struct {
+	tracer  *Tracer
+	sampled bool
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (this *Span) SpanContext() SpanContext {
+	if this == nil {
+		return SpanContext{}
+	}
+
+	return SpanContext{this.data.TraceID, this.data.SpanID, this.sampled}
+}
+
+func (this *Span) SetName(name string) {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	this.data.Name = name
+	this.mu.Unlock()
+}
+
+func (this *Span) SetKind(kind SpanKind) {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	this.data.Kind = kind
+	this.mu.Unlock()
+}
+
+// SetAttribute records a string, bool, integer or float value on the span, replacing an earlier value of key.
+func (this *Span) SetAttribute(key string, value interface{}) {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i, attr := range this.data.Attributes {
+		if attr.Key == key {
+			this.data.Attributes[i].Value = value
+			return
+		}
+	}
+
+	this.data.Attributes = append(this.data.Attributes, Attribute{key, value})
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (this *Span) SetError(err error) {
+	if this == nil || err == nil {
+		return
+	}
+
+	this.mu.Lock()
+	this.data.Error = err.Error()
+	this.mu.Unlock()
+}
+
+// End finishes the span and exports it if it is sampled. Calls after the first are ignored.
+func (this *Span) End() {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	if this.ended {
+		this.mu.Unlock()
+		return
+	}
+	this.ended = true
+	this.data.End = time.Now()
+	data := this.data
+	data.Attributes = append([]Attribute{}, this.data.Attributes...)
+	this.mu.Unlock()
+
+	if this.sampled {
+		this.tracer.exporter.Export(data)
+	}
+}
+
+// Tracer starts root spans. Spans started from a context carrying a span use that span's Tracer.
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter}
+}
+
+// Start begins a span that is a child of the span or remote span context in ctx, or a new trace if there is none. A
+// nil Tracer falls back to StartSpan.
+func (this *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if this == nil {
+		return StartSpan(ctx, name)
+	}
+
+	return this.start(ctx, name)
+}
+
+// Shutdown flushes spans that haven't been exported yet.
+func (this *Tracer) Shutdown(ctx context.Context) error {
+	if this == nil {
+		return nil
+	}
+
+	return this.exporter.Shutdown(ctx)
+}
+
+func (this *Tracer) start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{tracer: this, sampled: true}
+	span.data.Name = name
+	span.data.Start = time.Now()
+	span.data.SpanID = newSpanID()
+
+	parent, ok := parentSpanContext(ctx)
+	if ok {
+		span.data.TraceID = parent.TraceID
+		span.data.ParentSpanID = parent.SpanID
+		span.sampled = parent.Sampled
+	} else {
+		span.data.TraceID = newTraceID()
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// StartSpan begins a child of the span in ctx. If ctx has no span tracing is disabled for the request and a nil
+// *Span is returned.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.start(ctx, name)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext makes sc, i.e. from an incoming traceparent header, the parent of the next span.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func parentSpanContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext(), true
+	}
+
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+
+	return id
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := ParseTraceparent(header)
+	if !ok {
+		t.Fatalf("Expected %s to parse", header)
+	}
+
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("Unexpected span context %+v", sc)
+	}
+
+	if FormatTraceparent(sc) != header {
+		t.Fatalf("Expected %s, instead %s", header, FormatTraceparent(sc))
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, value := range invalid {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Fatalf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestChildSpansShareTheTrace(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+
+	ctx, root := tracer.Start(ctx, "root")
+	_, child := StartSpan(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, instead %d", len(spans))
+	}
+
+	if spans[1].TraceID != remote.TraceID || spans[1].ParentSpanID != remote.SpanID {
+		t.Fatalf("Expected the root span to continue the remote trace: %+v", spans[1])
+	}
+
+	if spans[0].TraceID != remote.TraceID || spans[0].ParentSpanID != spans[1].SpanID || spans[0].Error != "failed" {
+		t.Fatalf("Expected the child span to be a failed child of the root: %+v", spans[0])
+	}
+
+	// Without a span in the context nothing is recorded
+	_, span := StartSpan(context.Background(), "untraced")
+	span.SetAttribute("key", "value")
+	span.End()
+	if span != nil || len(exporter.Spans()) != 2 {
+		t.Fatalf("Expected no span without a parent")
+	}
+}
+
+func TestOTLPExporterFlushesOnShutdown(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOTLPExporter(collector.URL+"/v1/traces", "mandible"))
+	_, span := tracer.Start(context.Background(), "upload")
+	span.SetAttribute("size", 42)
+	span.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error shutting down: %s", err.Error())
+	}
+
+	select {
+	case body := <-bodies:
+		for _, expected := range []string{`"name":"upload"`, `"stringValue":"mandible"`, `"intValue":"42"`} {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("Expected the export to contain %s, instead %s", expected, body)
+			}
+		}
+	default:
+		t.Fatalf("Expected the span to be exported on shutdown")
+	}
+}
@@ -0,0 +1,27 @@
+package uploadedfile
+
+// Rendition is another version of the upload stored beside the original, i.e. an animated GIF as video or the other
+// pages of a TIFF. It's stored as <hash>.<name>.
+type Rendition struct {
+	localPath string
+
+	Name     string
+	Mime     string
+	Duration float64
+	Frames   int
+}
+
+func NewRendition(name, mime, path string, duration float64, frames int) *Rendition {
+	return &Rendition{
+		localPath: path,
+
+		Name:     name,
+		Mime:     mime,
+		Duration: duration,
+		Frames:   frames,
+	}
+}
+
+func (this *Rendition) GetPath() string {
+	return this.localPath
+}
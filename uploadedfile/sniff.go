@@ -0,0 +1,98 @@
+package uploadedfile
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Detects an upload's type from its first bytes. http.DetectContentType doesn't know TIFF, SVG, QuickTime or the ISO-BMFF
+// image brands, and BMP and ICO are checked more strictly than it does.
+func sniffImageType(buff []byte) string {
+	if mime := sniffBrand(buff); mime != "" {
+		return mime
+	}
+
+	if isSvg(buff) {
+		return "image/svg+xml"
+	}
+
+	switch {
+	case bytes.HasPrefix(buff, []byte("II*\x00")), bytes.HasPrefix(buff, []byte("MM\x00*")):
+		return "image/tiff"
+	case len(buff) >= 14 && bytes.HasPrefix(buff, []byte("BM")) && bytes.Equal(buff[6:10], []byte{0, 0, 0, 0}):
+		// The file header's reserved fields are always zero
+		return "image/bmp"
+	case len(buff) >= 6 && bytes.HasPrefix(buff, []byte{0, 0, 1, 0}) && (buff[4] != 0 || buff[5] != 0):
+		// Followed by a non-zero image count
+		return "image/x-icon"
+	}
+
+	return http.DetectContentType(buff)
+}
+
+// The MIME types of the ISO-BMFF image brands, which http.DetectContentType doesn't know.
+var imageBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+// The MIME types of the ISO-BMFF video brands. Image brands win over these, HEIFs can be isom compatible too.
+var videoBrands = map[string]string{
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"iso4": "video/mp4",
+	"iso5": "video/mp4",
+	"iso6": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"M4V ": "video/mp4",
+	"qt  ": "video/quicktime",
+}
+
+// Returns the type of an ISO-BMFF file from its ftyp box, or an empty string if it isn't an image or video. A more
+// specific compatible brand wins over the generic mif1, i.e. AVIFs are often mif1 with avif compatibility.
+func sniffBrand(buff []byte) string {
+	if len(buff) < 16 || string(buff[4:8]) != "ftyp" {
+		return ""
+	}
+
+	size := int(buff[0])<<24 | int(buff[1])<<16 | int(buff[2])<<8 | int(buff[3])
+	if size < 16 || size > len(buff) {
+		size = len(buff)
+	}
+
+	mime := imageBrands[string(buff[8:12])]
+
+	// Compatible brands follow the major brand and minor version
+	for i := 16; i+4 <= size; i += 4 {
+		brand, ok := imageBrands[string(buff[i:i+4])]
+		if ok && (mime == "" || mime == "image/heif") {
+			mime = brand
+		}
+	}
+
+	if mime != "" {
+		return mime
+	}
+
+	if mime, ok := videoBrands[string(buff[8:12])]; ok {
+		return mime
+	}
+
+	for i := 16; i+4 <= size; i += 4 {
+		if mime, ok := videoBrands[string(buff[i:i+4])]; ok {
+			return mime
+		}
+	}
+
+	return ""
+}
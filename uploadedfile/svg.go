@@ -0,0 +1,384 @@
+package uploadedfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var errInvalidSvg = errors.New("Invalid SVG file")
+
+// Elements dropped along with everything inside them
+var unsafeSvgElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+}
+
+var cssURLRegex = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+
+var cssCommentRegex = regexp.MustCompile(`(?s)/\*.*?(\*/|$)`)
+
+// A CSS escape: up to six hex digits and the whitespace that ends them, an escaped newline, or any other character
+var cssEscapeRegex = regexp.MustCompile(`\\(?:([0-9a-fA-F]{1,6})(?:\r\n|[ \t\r\n\f])?|(\r\n|[\n\r\f])|(.))`)
+
+// Whether the first bytes of an upload are an SVG: an svg root element, possibly after an XML declaration, comments or
+// a doctype.
+func isSvg(buff []byte) bool {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(buff, []byte("\xef\xbb\xbf")), " \t\r\n")
+
+	if bytes.HasPrefix(trimmed, []byte("<svg")) {
+		return true
+	}
+
+	prolog := bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<!--")) ||
+		bytes.HasPrefix(trimmed, []byte("<!DOCTYPE svg"))
+
+	return prolog && bytes.Contains(trimmed, []byte("<svg"))
+}
+
+// Rewrites the SVG at path without scripts, event handlers, references to anything outside the document or
+// foreignObject, returning the path of the sanitized copy. Comments, doctypes and processing instructions other than
+// the XML declaration are dropped too.
+func sanitizeSvg(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	outfile := fmt.Sprintf("%s_svg", path)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if err := writeSanitizedSvg(in, w); err != nil {
+		os.Remove(outfile)
+		return "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		os.Remove(outfile)
+		return "", err
+	}
+
+	return outfile, nil
+}
+
+func writeSanitizedSvg(r io.Reader, w io.Writer) error {
+	// RawToken keeps namespace prefixes as written, so the document can be written back out as it was
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = true
+
+	// Depth inside a dropped element, and the text of the open style sheet. Style sheets are checked whole once they
+	// end, since comments and CDATA sections split their text into several tokens.
+	skipping := 0
+	inStyle := false
+	var style bytes.Buffer
+	sawRoot := false
+
+	// RawToken doesn't match end elements to start elements, so the open ones are kept to check the document is whole
+	var open []xml.Name
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errInvalidSvg
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if sawRoot && len(open) == 0 {
+				return errInvalidSvg
+			}
+			open = append(open, t.Name)
+
+			if skipping > 0 {
+				skipping++
+				continue
+			}
+
+			if !sawRoot && strings.ToLower(t.Name.Local) != "svg" {
+				return errInvalidSvg
+			}
+			sawRoot = true
+
+			// Style sheets only have text
+			if !safeSvgElement(t) || inStyle {
+				skipping = 1
+				continue
+			}
+
+			inStyle = strings.ToLower(t.Name.Local) == "style"
+			style.Reset()
+
+			var attrs []xml.Attr
+			for _, attr := range t.Attr {
+				if safeSvgAttr(attr) {
+					attrs = append(attrs, attr)
+				}
+			}
+			t.Attr = attrs
+			writeSvgToken(w, t)
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return errInvalidSvg
+			}
+			open = open[:len(open)-1]
+
+			if skipping > 0 {
+				skipping--
+				continue
+			}
+
+			if inStyle && !hasExternalCSS(style.String()) {
+				writeSvgToken(w, xml.CharData(style.Bytes()))
+			}
+
+			inStyle = false
+			writeSvgToken(w, t)
+		case xml.CharData:
+			if skipping > 0 {
+				continue
+			}
+
+			if inStyle {
+				style.Write(t)
+				continue
+			}
+			writeSvgToken(w, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && !sawRoot {
+				writeSvgToken(w, t)
+			}
+		}
+	}
+
+	if !sawRoot || len(open) > 0 {
+		return errInvalidSvg
+	}
+
+	return nil
+}
+
+// Writes a token from RawToken back out. Comments and directives are never written.
+func writeSvgToken(w io.Writer, token xml.Token) {
+	switch t := token.(type) {
+	case xml.StartElement:
+		fmt.Fprintf(w, "<%s", rawName(t.Name))
+		for _, attr := range t.Attr {
+			fmt.Fprintf(w, " %s=\"", rawName(attr.Name))
+			xml.EscapeText(w, []byte(attr.Value))
+			io.WriteString(w, "\"")
+		}
+		io.WriteString(w, ">")
+	case xml.EndElement:
+		fmt.Fprintf(w, "</%s>", rawName(t.Name))
+	case xml.CharData:
+		xml.EscapeText(w, t)
+	case xml.ProcInst:
+		fmt.Fprintf(w, "<?%s %s?>", t.Target, t.Inst)
+	}
+}
+
+func rawName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
+
+func safeSvgElement(t xml.StartElement) bool {
+	local := strings.ToLower(t.Name.Local)
+	if unsafeSvgElements[local] {
+		return false
+	}
+
+	// Animations can set an event handler or link that isn't in the document
+	if local == "set" || local == "animate" {
+		for _, attr := range t.Attr {
+			if attr.Name.Local == "attributeName" {
+				target := strings.ToLower(attr.Value)
+				if strings.HasPrefix(target, "on") || strings.HasSuffix(target, "href") {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// Attributes can't be event handlers, link outside the document or have scripts or external style sheets. Any
+// attribute can hold a url(), i.e. fill and filter, so they're all checked as CSS.
+func safeSvgAttr(attr xml.Attr) bool {
+	local := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+
+	switch {
+	case strings.HasPrefix(local, "on"):
+		return false
+	case local == "href" || local == "src":
+		return strings.HasPrefix(value, "#")
+	case strings.Contains(value, "javascript:"):
+		return false
+	case hasExternalCSS(attr.Value):
+		return false
+	}
+
+	return true
+}
+
+// Whether CSS imports a style sheet or has a url() that isn't a fragment of the document. Comments and escapes are
+// decoded first, since \75rl( is also url(.
+func hasExternalCSS(css string) bool {
+	css = decodeCSS(css)
+	if strings.Contains(strings.ToLower(css), "@import") {
+		return true
+	}
+
+	for _, match := range cssURLRegex.FindAllStringSubmatch(css, -1) {
+		if !strings.HasPrefix(match[1], "#") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CSS with its comments removed and escapes replaced by the characters they stand for.
+func decodeCSS(css string) string {
+	css = cssCommentRegex.ReplaceAllString(css, "")
+
+	return cssEscapeRegex.ReplaceAllStringFunc(css, func(escape string) string {
+		match := cssEscapeRegex.FindStringSubmatch(escape)
+		switch {
+		case match[1] != "":
+			code, _ := strconv.ParseInt(match[1], 16, 32)
+			if code == 0 || code > unicode.MaxRune {
+				return string(unicode.ReplacementChar)
+			}
+			return string(rune(code))
+		case match[2] != "":
+			return ""
+		}
+
+		return match[3]
+	})
+}
+
+// The size of an SVG, from the viewBox of its root element, or its width and height if it has no viewBox.
+func svgSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	decoder := xml.NewDecoder(f)
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return 0, 0, errInvalidSvg
+		}
+
+		root, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for _, attr := range root.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+
+		if box := strings.Fields(strings.Replace(attrs["viewBox"], ",", " ", -1)); len(box) == 4 {
+			width, werr := strconv.ParseFloat(box[2], 64)
+			height, herr := strconv.ParseFloat(box[3], 64)
+			if werr == nil && herr == nil && width > 0 && height > 0 {
+				return int(math.Ceil(width)), int(math.Ceil(height)), nil
+			}
+		}
+
+		width, werr := strconv.ParseFloat(strings.TrimSuffix(attrs["width"], "px"), 64)
+		height, herr := strconv.ParseFloat(strings.TrimSuffix(attrs["height"], "px"), 64)
+		if werr != nil || herr != nil || width <= 0 || height <= 0 {
+			return 0, 0, errors.New("SVG has no viewBox or size")
+		}
+
+		return int(math.Ceil(width)), int(math.Ceil(height)), nil
+	}
+}
+
+// Copies a sanitized SVG with the width and height of its root element set to the given size, so gm rasterizes it at
+// the size of its viewBox rather than a default or a percentage.
+func sizedSvg(path, name string, width, height int) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	outfile := fmt.Sprintf("%s_%s_sized", path, name)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	decoder := xml.NewDecoder(in)
+	sawRoot := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			os.Remove(outfile)
+			return "", errInvalidSvg
+		}
+
+		if root, ok := token.(xml.StartElement); ok && !sawRoot {
+			sawRoot = true
+
+			attrs := []xml.Attr{
+				{Name: xml.Name{Local: "width"}, Value: strconv.Itoa(width)},
+				{Name: xml.Name{Local: "height"}, Value: strconv.Itoa(height)},
+			}
+			for _, attr := range root.Attr {
+				if attr.Name.Space != "" || (attr.Name.Local != "width" && attr.Name.Local != "height") {
+					attrs = append(attrs, attr)
+				}
+			}
+			root.Attr = attrs
+			token = root
+		}
+
+		writeSvgToken(w, token)
+	}
+
+	if err := w.Flush(); err != nil {
+		os.Remove(outfile)
+		return "", err
+	}
+
+	return outfile, nil
+}
@@ -0,0 +1,156 @@
+package uploadedfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSanitizedSvgsHaveNoExternalReferences(t *testing.T) {
+	cases := []struct {
+		name    string
+		svg     string
+		removed []string
+		kept    []string
+	}{
+		{
+			"escaped url in a style attribute",
+			`<svg><rect style="fill:\75rl(http://evil.example/s)"/></svg>`,
+			[]string{"evil.example"},
+			[]string{"<rect>"},
+		},
+		{
+			"escaped url with trailing whitespace",
+			`<svg><rect style="fill:\000075 rl(http://evil.example/s)"/></svg>`,
+			[]string{"evil.example"},
+			nil,
+		},
+		{
+			"url split by a comment",
+			`<svg><rect style="fill:u/**/rl(http://evil.example/c)"/></svg>`,
+			[]string{"evil.example"},
+			nil,
+		},
+		{
+			"url in a presentation attribute",
+			`<svg><rect fill="url(http://evil.example/f)" filter="URL( 'https://evil.example/g' )" stroke="url(#g)"/></svg>`,
+			[]string{"evil.example"},
+			[]string{`stroke="url(#g)"`},
+		},
+		{
+			"import in a style sheet",
+			`<svg><style>@import url(http://evil.example/x.css);</style><style>rect{stroke:red}</style></svg>`,
+			[]string{"evil.example", "@import"},
+			[]string{"<style>rect{stroke:red}</style>"},
+		},
+		{
+			"escaped import in a style sheet",
+			`<svg><style>@\69mport "http://evil.example/x.css";</style></svg>`,
+			[]string{"evil.example"},
+			nil,
+		},
+		{
+			"url split across CDATA",
+			`<svg><style><![CDATA[rect{fill:u]]>rl(http://evil.example/y)}</style></svg>`,
+			[]string{"evil.example"},
+			nil,
+		},
+		{
+			"element inside a style sheet",
+			`<svg><style>rect{}<script>alert(1)</script></style></svg>`,
+			[]string{"script", "alert"},
+			nil,
+		},
+		{
+			"animation setting a link",
+			`<svg><a><set attributeName="xlink:href" to="javascript:alert(1)"/></a></svg>`,
+			[]string{"set", "javascript"},
+			[]string{"<a></a>"},
+		},
+		{
+			"animation setting an event handler",
+			`<svg><rect><animate attributeName="onclick" values="alert(1)"/></rect></svg>`,
+			[]string{"animate", "alert"},
+			nil,
+		},
+		{
+			"links outside the document",
+			`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image href="http://evil.example/x.png"/><use xlink:href="#r"/><feImage src="//evil.example/y"/></svg>`,
+			[]string{"evil.example"},
+			[]string{`<use xlink:href="#r">`},
+		},
+		{
+			"javascript on any attribute",
+			`<svg><a data-link="Java Script:alert(1)" title="safe"/></svg>`,
+			[]string{"alert"},
+			[]string{`title="safe"`},
+		},
+		{
+			"event handlers",
+			`<svg onload="alert(1)"><rect OnClick="alert(2)"/></svg>`,
+			[]string{"alert"},
+			nil,
+		},
+		{
+			"unsafe elements",
+			`<svg><foreignObject><iframe src="http://evil.example/"/></foreignObject><script>alert(1)</script><rect/></svg>`,
+			[]string{"evil.example", "alert", "foreignObject", "iframe"},
+			[]string{"<rect>"},
+		},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		if err := writeSanitizedSvg(strings.NewReader(c.svg), &out); err != nil {
+			t.Fatalf("Unexpected error sanitizing %s: %s", c.name, err.Error())
+		}
+
+		for _, unsafe := range c.removed {
+			if strings.Contains(out.String(), unsafe) {
+				t.Fatalf("Expected %s to be removed for %s, instead %s", unsafe, c.name, out.String())
+			}
+		}
+
+		for _, safe := range c.kept {
+			if !strings.Contains(out.String(), safe) {
+				t.Fatalf("Expected %s to be kept for %s, instead %s", safe, c.name, out.String())
+			}
+		}
+	}
+}
+
+func TestMalformedSvgsAreRejected(t *testing.T) {
+	svgs := map[string]string{
+		"unclosed root":       `<svg viewBox="0 0 10 10"><rect/>`,
+		"unclosed child":      `<svg><g><rect/></svg>`,
+		"mismatched end":      `<svg><g></rect></svg>`,
+		"second root":         `<svg></svg><svg></svg>`,
+		"other root":          `<html><svg></svg></html>`,
+		"no elements":         `<?xml version="1.0"?>`,
+		"unterminated markup": `<svg><rect`,
+	}
+
+	for name, svg := range svgs {
+		var out bytes.Buffer
+		if err := writeSanitizedSvg(strings.NewReader(svg), &out); err != errInvalidSvg {
+			t.Fatalf("Expected the %s SVG to be invalid, instead %v", name, err)
+		}
+	}
+}
+
+func TestSvgsAreSniffed(t *testing.T) {
+	uploads := map[string]string{
+		`<svg xmlns="http://www.w3.org/2000/svg"/>`:                         "image/svg+xml",
+		"\xef\xbb\xbf\n<?xml version=\"1.0\"?>\n<svg/>":                     "image/svg+xml",
+		`<!-- drawn by hand --><svg/>`:                                      "image/svg+xml",
+		`<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "svg11.dtd"><svg/>`: "image/svg+xml",
+		`<?xml version="1.0"?><rss/>`:                                       "text/xml; charset=utf-8",
+		`<html><svg/></html>`:                                               "text/html; charset=utf-8",
+	}
+
+	for upload, expected := range uploads {
+		if mime := sniffImageType([]byte(upload)); mime != expected {
+			t.Fatalf("Expected %q to be %s, instead %s", upload, expected, mime)
+		}
+	}
+}
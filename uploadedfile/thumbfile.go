@@ -1,12 +1,14 @@
 package uploadedfile
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/Imgur/mandible/imageprocessor/processorcommand"
 	"github.com/Imgur/mandible/imageprocessor/thumbType"
@@ -35,9 +37,17 @@ type ThumbFile struct {
 	StoreURI      string
 	DesiredFormat string
 	NoStore       bool
+	Animated      bool
+
+	// The page of a PDF to thumbnail, counting from 1, and the dots per inch it's rasterized at. Zero means the first
+	// page at gm's default density.
+	Page int
+	DPI  int
+	// Where in a video the poster frame is taken from
+	PosterSeconds float64
 }
 
-func NewThumbFile(width, maxWidth, height, maxHeight int, name, shape, path, cropGravity string, cropWidth, cropHeight int, cropRatio string, quality int, desiredFormat string, noStore bool) *ThumbFile {
+func NewThumbFile(width, maxWidth, height, maxHeight int, name, shape, path, cropGravity string, cropWidth, cropHeight int, cropRatio string, quality int, desiredFormat string, noStore, animated bool) *ThumbFile {
 	if quality == 0 {
 		quality = defaultQuality
 	}
@@ -60,6 +70,7 @@ func NewThumbFile(width, maxWidth, height, maxHeight int, name, shape, path, cro
 		StoreURI:      "",
 		DesiredFormat: desiredFormat,
 		NoStore:       noStore,
+		Animated:      animated,
 	}
 }
 
@@ -86,9 +97,33 @@ func (this *ThumbFile) GetOutputFormat(original *UploadedFile) thumbType.ThumbTy
 		return thumbType.FromString(this.DesiredFormat)
 	}
 
+	// SVGs and PDFs are rasterized
+	if original.IsSvg() || original.IsPdf() {
+		return thumbType.PNG
+	}
+
+	if original.IsVideo() {
+		return thumbType.JPG
+	}
+
 	return thumbType.FromMime(original.GetMime())
 }
 
+// The format gm writes the thumbnail in. gm can't write AVIF, so those are made from a PNG.
+func (this *ThumbFile) gmOutputFormat(original *UploadedFile) thumbType.ThumbType {
+	format := this.GetOutputFormat(original)
+	if format == thumbType.AVIF {
+		return thumbType.PNG
+	}
+
+	return format
+}
+
+// Animated thumbnails keep every frame of an animated GIF, when they're GIFs too.
+func (this *ThumbFile) IsAnimated(original *UploadedFile, format thumbType.ThumbType) bool {
+	return this.Animated && original.GetMime() == "image/gif" && format == thumbType.GIF
+}
+
 func (this *ThumbFile) ComputeWidth(original *UploadedFile) int {
 	width := this.Width
 
@@ -149,26 +184,121 @@ func (this *ThumbFile) ComputeCrop(original *UploadedFile) (int, int, error) {
 	return int(cropWidth), int(cropHeight), nil
 }
 
-func (this *ThumbFile) Process(original *UploadedFile) error {
+func (this *ThumbFile) Process(ctx context.Context, original *UploadedFile) error {
+	format := this.GetOutputFormat(original)
+	if format.IsVideo() {
+		return this.processVideo(ctx, original, format)
+	}
+
+	var err error
+	switch {
+	case original.IsSvg():
+		err = this.processSvg(ctx, original)
+	case original.IsPdf():
+		err = this.processPdf(ctx, original)
+	case original.IsVideo():
+		err = this.processPoster(ctx, original)
+	default:
+		err = this.processShape(ctx, original)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Circles are always PNGs
+	if format == thumbType.AVIF && this.Shape != "circle" {
+		return this.encodeAvif(ctx)
+	}
+
+	return nil
+}
+
+func (this *ThumbFile) processShape(ctx context.Context, original *UploadedFile) error {
 	switch this.Shape {
 	case "circle":
-		return this.processCircle(original)
+		return this.processCircle(ctx, original)
 	case "thumb":
-		return this.processThumb(original)
+		return this.processThumb(ctx, original)
 	case "square":
-		return this.processSquare(original)
+		return this.processSquare(ctx, original)
 	case "custom":
-		return this.processCustom(original)
+		return this.processCustom(ctx, original)
 	default:
-		return this.processFull(original)
+		return this.processFull(ctx, original)
+	}
+}
+
+// SVGs are rasterized by gm from a copy sized to their viewBox.
+func (this *ThumbFile) processSvg(ctx context.Context, original *UploadedFile) error {
+	width, height, err := original.Dimensions()
+	if err != nil {
+		return err
+	}
+
+	path, err := sizedSvg(original.GetPath(), this.Name, width, height)
+	if err != nil {
+		return err
 	}
+	defer os.Remove(path)
+
+	sized := *original
+	sized.path = path
+
+	return this.processShape(ctx, &sized)
+}
+
+// PDFs are thumbnailed from a PNG of the page.
+func (this *ThumbFile) processPdf(ctx context.Context, original *UploadedFile) error {
+	page := this.Page
+	if page == 0 {
+		page = 1
+	}
+
+	density := this.DPI
+	if density == 0 {
+		density = 72
+	}
+
+	path, err := processorcommand.RasterizePage(ctx, original.GetPath(), this.Name, page, density)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	rasterized := *original
+	rasterized.path = path
+	rasterized.mime = "image/png"
+
+	return this.processShape(ctx, &rasterized)
+}
+
+// Videos are thumbnailed from a PNG of their poster frame.
+func (this *ThumbFile) processPoster(ctx context.Context, original *UploadedFile) error {
+	path, err := processorcommand.PosterFrame(ctx, original.GetPath(), this.Name, this.PosterSeconds)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	poster := *original
+	poster.path = path
+	poster.mime = "image/png"
+
+	// The frame is a PNG, the thumbnail is still written in the format GetOutputFormat gives for the video
+	thumb := *this
+	thumb.DesiredFormat = strings.ToLower(this.GetOutputFormat(original).ToString())
+	if err := thumb.processShape(ctx, &poster); err != nil {
+		return err
+	}
+
+	return this.SetPath(thumb.GetPath())
 }
 
 func (this *ThumbFile) String() string {
 	return fmt.Sprintf("Thumbnail of <%s>", this.Name)
 }
 
-func (this *ThumbFile) processSquare(original *UploadedFile) error {
+func (this *ThumbFile) processSquare(ctx context.Context, original *UploadedFile) error {
 	if this.Width == 0 {
 		return errors.New("Width cannot be 0")
 	}
@@ -176,7 +306,8 @@ func (this *ThumbFile) processSquare(original *UploadedFile) error {
 		return errors.New("Width too large")
 	}
 
-	filename, err := processorcommand.SquareThumb(original.GetPath(), this.Name, this.Width, this.Quality, this.GetOutputFormat(original))
+	format := this.gmOutputFormat(original)
+	filename, err := processorcommand.SquareThumb(ctx, original.GetPath(), this.Name, this.Width, this.Quality, format, this.IsAnimated(original, format))
 	if err != nil {
 		return err
 	}
@@ -188,7 +319,7 @@ func (this *ThumbFile) processSquare(original *UploadedFile) error {
 	return nil
 }
 
-func (this *ThumbFile) processCircle(original *UploadedFile) error {
+func (this *ThumbFile) processCircle(ctx context.Context, original *UploadedFile) error {
 	if this.Width == 0 {
 		return errors.New("Width cannot be 0")
 	}
@@ -199,7 +330,7 @@ func (this *ThumbFile) processCircle(original *UploadedFile) error {
 	//Circle thumbs should always be PNGs
 	outputFormat := thumbType.FromString("png")
 
-	filename, err := processorcommand.CircleThumb(original.GetPath(), this.Name, this.Width, this.Quality, outputFormat)
+	filename, err := processorcommand.CircleThumb(ctx, original.GetPath(), this.Name, this.Width, this.Quality, outputFormat)
 	if err != nil {
 		return err
 	}
@@ -211,7 +342,7 @@ func (this *ThumbFile) processCircle(original *UploadedFile) error {
 	return nil
 }
 
-func (this *ThumbFile) processThumb(original *UploadedFile) error {
+func (this *ThumbFile) processThumb(ctx context.Context, original *UploadedFile) error {
 	if this.Width == 0 {
 		return errors.New("Width cannot be 0")
 	}
@@ -225,7 +356,8 @@ func (this *ThumbFile) processThumb(original *UploadedFile) error {
 		return errors.New("Height too large")
 	}
 
-	filename, err := processorcommand.Thumb(original.GetPath(), this.Name, this.Width, this.Height, this.Quality, this.GetOutputFormat(original))
+	format := this.gmOutputFormat(original)
+	filename, err := processorcommand.Thumb(ctx, original.GetPath(), this.Name, this.Width, this.Height, this.Quality, format, this.IsAnimated(original, format))
 	if err != nil {
 		return err
 	}
@@ -237,7 +369,7 @@ func (this *ThumbFile) processThumb(original *UploadedFile) error {
 	return nil
 }
 
-func (this *ThumbFile) processCustom(original *UploadedFile) error {
+func (this *ThumbFile) processCustom(ctx context.Context, original *UploadedFile) error {
 	cropWidth := this.CropWidth
 	cropHeight := this.CropHeight
 	var err error
@@ -262,7 +394,22 @@ func (this *ThumbFile) processCustom(original *UploadedFile) error {
 		return errors.New("Invalid height")
 	}
 
-	filename, err := processorcommand.CustomThumb(original.GetPath(), this.Name, width, height, this.CropGravity, cropWidth, cropHeight, this.Quality, this.GetOutputFormat(original))
+	format := this.gmOutputFormat(original)
+	filename, err := processorcommand.CustomThumb(ctx, original.GetPath(), this.Name, width, height, this.CropGravity, cropWidth, cropHeight, this.Quality, format, this.IsAnimated(original, format))
+	if err != nil {
+		return err
+	}
+
+	if err := this.SetPath(filename); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *ThumbFile) processFull(ctx context.Context, original *UploadedFile) error {
+	format := this.gmOutputFormat(original)
+	filename, err := processorcommand.Full(ctx, original.GetPath(), this.Name, this.Quality, format, this.IsAnimated(original, format))
 	if err != nil {
 		return err
 	}
@@ -274,8 +421,25 @@ func (this *ThumbFile) processCustom(original *UploadedFile) error {
 	return nil
 }
 
-func (this *ThumbFile) processFull(original *UploadedFile) error {
-	filename, err := processorcommand.Full(original.GetPath(), this.Name, this.Quality, this.GetOutputFormat(original))
+// Video thumbnails of animated GIFs can be the whole animation or fit inside a thumb's width and height.
+func (this *ThumbFile) processVideo(ctx context.Context, original *UploadedFile, format thumbType.ThumbType) error {
+	if !original.IsGif() {
+		return errors.New("Video thumbnails can only be made from GIFs")
+	}
+
+	width, height := 0, 0
+	switch this.Shape {
+	case "":
+	case "thumb":
+		if this.Width <= 0 || this.Width > maxImageSideSize || this.Height <= 0 || this.Height > maxImageSideSize {
+			return errors.New("Invalid width or height")
+		}
+		width, height = this.Width, this.Height
+	default:
+		return fmt.Errorf("Video thumbnails can't be %s", this.Shape)
+	}
+
+	filename, err := processorcommand.ToVideo(ctx, original.GetPath(), this.Name, width, height, format)
 	if err != nil {
 		return err
 	}
@@ -286,3 +450,12 @@ func (this *ThumbFile) processFull(original *UploadedFile) error {
 
 	return nil
 }
+
+func (this *ThumbFile) encodeAvif(ctx context.Context) error {
+	filename, err := processorcommand.AvifEncode(ctx, this.GetPath(), this.Quality)
+	if err != nil {
+		return err
+	}
+
+	return this.SetPath(filename)
+}
@@ -6,7 +6,7 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"net/http"
+	"io"
 	"os"
 )
 
@@ -17,13 +17,27 @@ type UploadedFile struct {
 	hash     string
 	ocrText  string
 	thumbs   []*ThumbFile
+
+	renditions []*Rendition
 }
 
 var supportedTypes = map[string]bool{
-	"image/jpeg": true,
-	"image/jpg":  true,
-	"image/gif":  true,
-	"image/png":  true,
+	"image/jpeg":      true,
+	"image/jpg":       true,
+	"image/gif":       true,
+	"image/png":       true,
+	"image/webp":      true,
+	"image/heic":      true,
+	"image/heif":      true,
+	"image/avif":      true,
+	"image/bmp":       true,
+	"image/tiff":      true,
+	"image/x-icon":    true,
+	"image/svg+xml":   true,
+	"application/pdf": true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/quicktime": true,
 }
 
 func NewUploadedFile(filename, path string, thumbs []*ThumbFile) (*UploadedFile, error) {
@@ -32,18 +46,35 @@ func NewUploadedFile(filename, path string, thumbs []*ThumbFile) (*UploadedFile,
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
 	buff := make([]byte, 512) // http://golang.org/pkg/net/http/#DetectContentType
-	_, err = file.Read(buff)
+	n, err := file.Read(buff)
 
-	if err != nil {
+	if err == io.EOF {
+		return nil, invalidHeader("File is empty")
+	} else if err != nil {
 		return nil, err
 	}
 
-	filetype := http.DetectContentType(buff)
+	filetype := sniffImageType(buff[:n])
 
 	if _, ok := supportedTypes[filetype]; !ok {
-		return nil, errors.New("Unsupported file type!")
+		return nil, &ValidationError{Unsupported, "Unsupported file type!"}
+	}
+
+	// SVGs are sanitized as soon as they're read, so whatever the processing nothing unsafe is stored
+	if filetype == "image/svg+xml" {
+		sanitized, err := sanitizeSvg(path)
+		if err == errInvalidSvg {
+			return nil, corrupt("%s", err.Error())
+		} else if err != nil {
+			return nil, err
+		}
+
+		file.Close()
+		os.Remove(path)
+		path = sanitized
 	}
 
 	return &UploadedFile{
@@ -53,6 +84,7 @@ func NewUploadedFile(filename, path string, thumbs []*ThumbFile) (*UploadedFile,
 		"",
 		"",
 		thumbs,
+		nil,
 	}, nil
 }
 
@@ -129,9 +161,30 @@ func (this *UploadedFile) Clean() {
 	for _, thumb := range this.thumbs {
 		os.Remove(thumb.GetPath())
 	}
+
+	for _, rendition := range this.renditions {
+		os.Remove(rendition.GetPath())
+	}
+}
+
+func (this *UploadedFile) GetRenditions() []*Rendition {
+	return this.renditions
+}
+
+func (this *UploadedFile) AddRendition(rendition *Rendition) {
+	this.renditions = append(this.renditions, rendition)
 }
 
 func (this *UploadedFile) Dimensions() (int, int, error) {
+	if this.IsWebp() {
+		width, height, _, err := webpInfo(this.path)
+		return width, height, err
+	}
+
+	if this.IsSvg() {
+		return svgSize(this.path)
+	}
+
 	f, err := os.Open(this.path)
 	if err != nil {
 		return 0, 0, err
@@ -167,3 +220,60 @@ func (this *UploadedFile) IsPng() bool {
 func (this *UploadedFile) IsGif() bool {
 	return this.GetMime() == "image/gif"
 }
+
+// HEIC, HEIF and AVIF uploads are converted to a canonical format before anything else.
+func (this *UploadedFile) IsHeif() bool {
+	switch this.GetMime() {
+	case "image/heic", "image/heif", "image/avif":
+		return true
+	}
+
+	return false
+}
+
+// BMP, TIFF and ICO uploads are converted by gm before anything else.
+func (this *UploadedFile) IsLegacyRaster() bool {
+	switch this.GetMime() {
+	case "image/bmp", "image/tiff", "image/x-icon":
+		return true
+	}
+
+	return false
+}
+
+func (this *UploadedFile) IsTiff() bool {
+	return this.GetMime() == "image/tiff"
+}
+
+func (this *UploadedFile) IsSvg() bool {
+	return this.GetMime() == "image/svg+xml"
+}
+
+// PDFs are stored as they are, and rasterized a page at a time for thumbnails.
+func (this *UploadedFile) IsPdf() bool {
+	return this.GetMime() == "application/pdf"
+}
+
+// Videos are stored as they are, and thumbnailed from a poster frame.
+func (this *UploadedFile) IsVideo() bool {
+	switch this.GetMime() {
+	case "video/mp4", "video/webm", "video/quicktime":
+		return true
+	}
+
+	return false
+}
+
+func (this *UploadedFile) IsWebp() bool {
+	return this.GetMime() == "image/webp"
+}
+
+// gm only reads the first frame of animated WebPs, so they're left alone where it would drop the rest.
+func (this *UploadedFile) IsAnimatedWebp() bool {
+	if !this.IsWebp() {
+		return false
+	}
+
+	_, _, animated, err := webpInfo(this.path)
+	return err == nil && animated
+}
@@ -0,0 +1,753 @@
+package uploadedfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Limits are what uploads are checked against before they're processed. Zero means no limit.
+type Limits struct {
+	MaxPixels int64
+	MaxFrames int
+	// Of PDFs
+	MaxPages int
+}
+
+// ValidationReason is why an upload failed validation.
+type ValidationReason int
+
+const (
+	// The file isn't the type it was detected as
+	InvalidHeader ValidationReason = iota
+	// The file is truncated or its structure is broken
+	Corrupt
+	// The image has more pixels, frames or pages than the Limits
+	TooLarge
+	// The file isn't a type that can be processed
+	Unsupported
+)
+
+// ValidationError is an upload that can't be processed.
+type ValidationError struct {
+	Reason  ValidationReason
+	Message string
+}
+
+func (this *ValidationError) Error() string {
+	return this.Message
+}
+
+func invalidHeader(format string, args ...interface{}) error {
+	return &ValidationError{InvalidHeader, fmt.Sprintf(format, args...)}
+}
+
+func corrupt(format string, args ...interface{}) error {
+	return &ValidationError{Corrupt, fmt.Sprintf(format, args...)}
+}
+
+// Validate reads the structure of JPEGs, PNGs, GIFs and WebPs from start to end without decoding their pixels, so a
+// truncated or corrupt file, or a small file declaring a huge image, is caught before it reaches gm. Of the other
+// types, the sizes in the headers of BMPs, ICOs, TIFFs, HEIFs and AVIFs and the viewBox of SVGs are checked against
+// the Limits, and the pages of PDFs that can be counted without decompressing them. Videos aren't checked. Errors are
+// *ValidationError values.
+func (this *UploadedFile) Validate(limits Limits) error {
+	var validate func(*bufio.Reader, Limits) error
+	switch {
+	case this.IsJpeg():
+		validate = validateJpeg
+	case this.IsPng():
+		validate = validatePng
+	case this.IsGif():
+		validate = validateGif
+	case this.IsWebp():
+		validate = validateWebp
+	case this.GetMime() == "image/bmp":
+		validate = validateBmp
+	case this.GetMime() == "image/x-icon":
+		validate = validateIco
+	case this.IsHeif():
+		validate = validateHeif
+	case this.IsPdf():
+		validate = validatePdf
+	case this.IsSvg():
+		return validateSvg(this.path, limits)
+	case this.IsTiff():
+		// Read with validateTiff below
+	default:
+		return nil
+	}
+
+	f, err := os.Open(this.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// TIFFs' directories can be anywhere in the file
+	if this.IsTiff() {
+		return validateTiff(f, limits)
+	}
+
+	return validate(bufio.NewReader(f), limits)
+}
+
+func (this Limits) checkPixels(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return corrupt("Image has no pixels")
+	}
+
+	if this.MaxPixels > 0 && int64(width)*int64(height) > this.MaxPixels {
+		return &ValidationError{TooLarge, fmt.Sprintf("Image is %dx%d, more than %d pixels", width, height, this.MaxPixels)}
+	}
+
+	return nil
+}
+
+func (this Limits) checkFrames(frames int) error {
+	if this.MaxFrames > 0 && frames > this.MaxFrames {
+		return &ValidationError{TooLarge, fmt.Sprintf("Image has more than %d frames", this.MaxFrames)}
+	}
+
+	return nil
+}
+
+func (this Limits) checkPages(pages int) error {
+	if this.MaxPages > 0 && pages > this.MaxPages {
+		return &ValidationError{TooLarge, fmt.Sprintf("PDF has more than %d pages", this.MaxPages)}
+	}
+
+	return nil
+}
+
+// Walks the markers of a JPEG through to the end of image, skipping over entropy coded data.
+func validateJpeg(r *bufio.Reader, limits Limits) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return invalidHeader("Invalid JPEG header")
+	}
+
+	truncated := corrupt("JPEG is truncated")
+	sawFrame := false
+	var marker byte
+
+	for {
+		// Markers can be padded with any number of 0xff, entropy coded data leaves the marker after it already read
+		if marker == 0 {
+			b, err := r.ReadByte()
+			if err != nil {
+				return truncated
+			}
+			if b != 0xff {
+				return corrupt("JPEG has an invalid marker")
+			}
+
+			for b == 0xff {
+				if b, err = r.ReadByte(); err != nil {
+					return truncated
+				}
+			}
+			marker = b
+		}
+
+		switch {
+		case marker == 0xd9:
+			if !sawFrame {
+				return corrupt("JPEG has no frame")
+			}
+			return nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// No length
+			marker = 0
+			continue
+		}
+
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return truncated
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes)) - 2
+		if length < 0 {
+			return corrupt("JPEG has an invalid segment length")
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return truncated
+		}
+
+		// Start of frame markers besides DHT, JPG and DAC
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			if len(segment) < 5 {
+				return corrupt("JPEG has an invalid frame header")
+			}
+
+			height := int(binary.BigEndian.Uint16(segment[1:3]))
+			width := int(binary.BigEndian.Uint16(segment[3:5]))
+			if err := limits.checkPixels(width, height); err != nil {
+				return err
+			}
+			sawFrame = true
+		}
+
+		if marker != 0xda {
+			marker = 0
+			continue
+		}
+
+		if !sawFrame {
+			return corrupt("JPEG has a scan before its frame")
+		}
+
+		// Entropy coded data runs until a marker that isn't a stuffed 0xff or a restart marker
+		marker = 0
+		for marker == 0 {
+			b, err := r.ReadByte()
+			if err != nil {
+				return truncated
+			}
+			if b != 0xff {
+				continue
+			}
+
+			next, err := r.ReadByte()
+			for err == nil && next == 0xff {
+				next, err = r.ReadByte()
+			}
+			if err != nil {
+				return truncated
+			}
+
+			if next != 0x00 && (next < 0xd0 || next > 0xd7) {
+				marker = next
+			}
+		}
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Walks the chunks of a PNG through to IEND, checking each one's CRC.
+func validatePng(r *bufio.Reader, limits Limits) error {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return invalidHeader("Invalid PNG header")
+	}
+
+	truncated := corrupt("PNG is truncated")
+	sawData := false
+	header := make([]byte, 8)
+
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return truncated
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		chunk := string(header[4:8])
+		if length > 0x7fffffff {
+			return corrupt("PNG chunk %q has an invalid length", chunk)
+		}
+
+		if first && (chunk != "IHDR" || length != 13) {
+			return invalidHeader("Invalid PNG header")
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:8])
+
+		// Only the chunks checked against the limits are kept, the rest are hashed as they're read
+		var data []byte
+		switch chunk {
+		case "IHDR", "acTL":
+			if length > 13 {
+				return corrupt("PNG chunk %q is corrupt", chunk)
+			}
+
+			data = make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return truncated
+			}
+			crc.Write(data)
+		default:
+			if _, err := io.CopyN(crc, r, int64(length)); err != nil {
+				return truncated
+			}
+		}
+
+		expected := make([]byte, 4)
+		if _, err := io.ReadFull(r, expected); err != nil {
+			return truncated
+		}
+		if binary.BigEndian.Uint32(expected) != crc.Sum32() {
+			return corrupt("PNG chunk %q is corrupt", chunk)
+		}
+
+		switch chunk {
+		case "IHDR":
+			width := int(binary.BigEndian.Uint32(data[0:4]))
+			height := int(binary.BigEndian.Uint32(data[4:8]))
+			if err := limits.checkPixels(width, height); err != nil {
+				return err
+			}
+		case "acTL":
+			// Animated PNGs, the frame count comes first
+			if len(data) < 4 {
+				return corrupt("PNG chunk %q is corrupt", chunk)
+			}
+			if err := limits.checkFrames(int(binary.BigEndian.Uint32(data[0:4]))); err != nil {
+				return err
+			}
+		case "IDAT":
+			sawData = true
+		case "IEND":
+			if !sawData {
+				return corrupt("PNG has no image data")
+			}
+			return nil
+		}
+	}
+}
+
+// Walks the blocks of a GIF through to its trailer, counting the frames.
+func validateGif(r *bufio.Reader, limits Limits) error {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return invalidHeader("Invalid GIF header")
+	}
+	if version := string(header[0:6]); version != "GIF87a" && version != "GIF89a" {
+		return invalidHeader("Invalid GIF header")
+	}
+
+	width := int(binary.LittleEndian.Uint16(header[6:8]))
+	height := int(binary.LittleEndian.Uint16(header[8:10]))
+	if err := limits.checkPixels(width, height); err != nil {
+		return err
+	}
+
+	truncated := corrupt("GIF is truncated")
+	if _, err := r.Discard(colorTableSize(header[10])); err != nil {
+		return truncated
+	}
+
+	frames := 0
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return truncated
+		}
+
+		switch block {
+		case 0x21:
+			// Extension: a label then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return truncated
+			}
+		case 0x2c:
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return truncated
+			}
+
+			frames++
+			if err := limits.checkFrames(frames); err != nil {
+				return err
+			}
+
+			frameWidth := int(binary.LittleEndian.Uint16(descriptor[4:6]))
+			frameHeight := int(binary.LittleEndian.Uint16(descriptor[6:8]))
+			if err := limits.checkPixels(frameWidth, frameHeight); err != nil {
+				return err
+			}
+
+			// Then the local color table and the LZW minimum code size before the data sub-blocks
+			if _, err := r.Discard(colorTableSize(descriptor[8]) + 1); err != nil {
+				return truncated
+			}
+		case 0x3b:
+			if frames == 0 {
+				return corrupt("GIF has no frames")
+			}
+			return nil
+		default:
+			return corrupt("GIF has an invalid block")
+		}
+
+		if err := skipGifSubBlocks(r); err != nil {
+			return truncated
+		}
+	}
+}
+
+// The size of the color table following a GIF's screen or image descriptor with these flags.
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+
+	return 3 << (flags&0x07 + 1)
+}
+
+func skipGifSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// Walks the chunks of a WebP through to the end of its RIFF container, counting the frames of animations.
+func validateWebp(r *bufio.Reader, limits Limits) error {
+	header, err := r.Peek(30)
+	if err != nil || string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return invalidHeader("Invalid WebP header")
+	}
+
+	width, height, _, err := webpDimensions(header)
+	if err != nil {
+		return invalidHeader("Invalid WebP header")
+	}
+	if err := limits.checkPixels(width, height); err != nil {
+		return err
+	}
+
+	truncated := corrupt("WebP is truncated")
+
+	// The RIFF size counts from the WEBP FourCC
+	remaining := int64(binary.LittleEndian.Uint32(header[4:8])) - 4
+	r.Discard(12)
+
+	frames := 0
+	chunk := make([]byte, 8)
+	for remaining > 0 {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return truncated
+		}
+
+		// Chunks are padded to an even size
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		size += size & 1
+		if size+8 > remaining {
+			return corrupt("WebP chunk %q overruns the file", string(chunk[0:4]))
+		}
+
+		if string(chunk[0:4]) == "ANMF" {
+			frames++
+			if err := limits.checkFrames(frames); err != nil {
+				return err
+			}
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+			return truncated
+		}
+		remaining -= size + 8
+	}
+
+	return nil
+}
+
+// The SVG's size, from its viewBox or width and height, as it will be rasterized.
+func validateSvg(path string, limits Limits) error {
+	width, height, err := svgSize(path)
+	if err != nil {
+		return corrupt("%s", err.Error())
+	}
+
+	return limits.checkPixels(width, height)
+}
+
+// Checks the size in a BMP's header. Heights are negative for images stored top down.
+func validateBmp(r *bufio.Reader, limits Limits) error {
+	header := make([]byte, 26)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[0:2]) != "BM" {
+		return invalidHeader("Invalid BMP header")
+	}
+
+	var width, height int
+	switch binary.LittleEndian.Uint32(header[14:18]) {
+	case 12:
+		// The OS/2 header's sizes are unsigned 16 bit
+		width = int(binary.LittleEndian.Uint16(header[18:20]))
+		height = int(binary.LittleEndian.Uint16(header[20:22]))
+	default:
+		width = int(int32(binary.LittleEndian.Uint32(header[18:22])))
+		height = int(int32(binary.LittleEndian.Uint32(header[22:26])))
+	}
+
+	if height < 0 {
+		height = -height
+	}
+
+	return limits.checkPixels(width, height)
+}
+
+// Checks the number of images in an ICO and the size of each in its directory, where 0 means 256.
+func validateIco(r *bufio.Reader, limits Limits) error {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil || binary.LittleEndian.Uint16(header[0:2]) != 0 {
+		return invalidHeader("Invalid ICO header")
+	}
+
+	count := int(binary.LittleEndian.Uint16(header[4:6]))
+	if count == 0 {
+		return corrupt("ICO has no images")
+	}
+	if err := limits.checkFrames(count); err != nil {
+		return err
+	}
+
+	entry := make([]byte, 16)
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return corrupt("ICO is truncated")
+		}
+
+		width, height := int(entry[0]), int(entry[1])
+		if width == 0 {
+			width = 256
+		}
+		if height == 0 {
+			height = 256
+		}
+
+		if err := limits.checkPixels(width, height); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Walks the IFDs of a TIFF, one per page, checking each page's ImageWidth and ImageLength.
+func validateTiff(f io.ReaderAt, limits Limits) error {
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return invalidHeader("Invalid TIFF header")
+	}
+
+	var order binary.ByteOrder
+	switch string(header[0:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return invalidHeader("Invalid TIFF header")
+	}
+
+	truncated := corrupt("TIFF is truncated")
+	offset := int64(order.Uint32(header[4:8]))
+	visited := make(map[int64]bool)
+	pages := 0
+
+	for offset != 0 {
+		if visited[offset] {
+			return corrupt("TIFF has a loop in its directories")
+		}
+		visited[offset] = true
+
+		pages++
+		if err := limits.checkFrames(pages); err != nil {
+			return err
+		}
+
+		countBytes := make([]byte, 2)
+		if _, err := f.ReadAt(countBytes, offset); err != nil {
+			return truncated
+		}
+
+		// The entries, then the offset of the next IFD
+		ifd := make([]byte, int(order.Uint16(countBytes))*12+4)
+		if _, err := f.ReadAt(ifd, offset+2); err != nil {
+			return truncated
+		}
+
+		width, height := 0, 0
+		for entry := ifd[:len(ifd)-4]; len(entry) > 0; entry = entry[12:] {
+			// Sizes are a SHORT or a LONG, either way at the start of the value
+			var value int
+			switch order.Uint16(entry[2:4]) {
+			case 3:
+				value = int(order.Uint16(entry[8:10]))
+			case 4:
+				value = int(order.Uint32(entry[8:12]))
+			}
+
+			switch order.Uint16(entry[0:2]) {
+			case 256:
+				width = value
+			case 257:
+				height = value
+			}
+		}
+
+		if err := limits.checkPixels(width, height); err != nil {
+			return err
+		}
+
+		offset = int64(order.Uint32(ifd[len(ifd)-4:]))
+	}
+
+	if pages == 0 {
+		return corrupt("TIFF has no pages")
+	}
+
+	return nil
+}
+
+// Reads the header of an ISO-BMFF box, returning its type and the size of its contents, which is -1 for a box that
+// runs to the end of the file.
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	switch size {
+	case 0:
+		return string(header[4:8]), -1, nil
+	case 1:
+		large := make([]byte, 8)
+		if _, err := io.ReadFull(r, large); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large)) - 16
+	default:
+		size -= 8
+	}
+
+	if size < 0 {
+		return "", 0, corrupt("Box %q has an invalid size", string(header[4:8]))
+	}
+
+	return string(header[4:8]), size, nil
+}
+
+// Calls visit with each box in r and a reader of its contents, stopping early when visit reports it's done.
+func walkBoxes(r io.Reader, visit func(box string, contents io.Reader) (bool, error)) error {
+	for {
+		box, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		contents := r
+		if size >= 0 {
+			contents = io.LimitReader(r, size)
+		}
+
+		done, err := visit(box, contents)
+		if err != nil || done {
+			return err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, contents); err != nil {
+			return err
+		}
+	}
+}
+
+// Checks the image spatial extents, the ispe properties in meta/iprp/ipco, of a HEIF or AVIF. Each image of the file,
+// i.e. the tiles of a grid and the grid itself, has one.
+func validateHeif(r *bufio.Reader, limits Limits) error {
+	sawSize := false
+
+	var visit func(box string, contents io.Reader) (bool, error)
+	visit = func(box string, contents io.Reader) (bool, error) {
+		switch box {
+		case "meta":
+			// A full box, its version and flags come before its children
+			if _, err := io.ReadFull(contents, make([]byte, 4)); err != nil {
+				return false, err
+			}
+			return true, walkBoxes(contents, visit)
+		case "iprp", "ipco":
+			return false, walkBoxes(contents, visit)
+		case "ispe":
+			ispe := make([]byte, 12)
+			if _, err := io.ReadFull(contents, ispe); err != nil {
+				return false, err
+			}
+
+			sawSize = true
+			return false, limits.checkPixels(int(binary.BigEndian.Uint32(ispe[4:8])), int(binary.BigEndian.Uint32(ispe[8:12])))
+		}
+
+		return false, nil
+	}
+
+	err := walkBoxes(r, visit)
+	if verr, ok := err.(*ValidationError); ok {
+		return verr
+	} else if err != nil {
+		return corrupt("HEIF is truncated")
+	}
+
+	if !sawSize {
+		return corrupt("HEIF has no image size")
+	}
+
+	return nil
+}
+
+// The whitespace is limited so a match is always shorter than the overlap between chunks in validatePdf
+var pdfPageRegex = regexp.MustCompile(`/Type\s{0,16}/Page([^s]|$)`)
+
+// Counts the page objects of a PDF. Pages in compressed object streams can't be counted without decompressing them, so
+// this only catches PDFs with too many plain page objects; the pages are counted again when they're read.
+func validatePdf(r *bufio.Reader, limits Limits) error {
+	header, err := r.Peek(5)
+	if err != nil || string(header) != "%PDF-" {
+		return invalidHeader("Invalid PDF header")
+	}
+
+	// Matches are counted once they start before the overlap carried into the next chunk
+	const overlap = 32
+	chunk := make([]byte, 64*1024)
+	carried := 0
+	pages := 0
+
+	for {
+		n, err := io.ReadFull(r, chunk[carried:])
+		end := carried + n
+		last := err != nil
+
+		limit := end - overlap
+		if last {
+			limit = end
+		}
+
+		for _, match := range pdfPageRegex.FindAllIndex(chunk[:end], -1) {
+			if match[0] < limit {
+				pages++
+			}
+		}
+		if err := limits.checkPages(pages); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		carried = copy(chunk, chunk[limit:end])
+	}
+}
@@ -0,0 +1,263 @@
+package uploadedfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Validated without an error
+const valid ValidationReason = -1
+
+func checkValidation(t *testing.T, name string, err error, expected ValidationReason) {
+	if expected == valid {
+		if err != nil {
+			t.Fatalf("Expected %s to be valid, instead %s", name, err.Error())
+		}
+		return
+	}
+
+	verr, ok := err.(*ValidationError)
+	if !ok || verr.Reason != expected {
+		t.Fatalf("Expected %s to fail validation with reason %d, instead %v", name, expected, err)
+	}
+}
+
+func encodeImage(encode func(io.Writer, image.Image) error) []byte {
+	var b bytes.Buffer
+	encode(&b, image.NewRGBA(image.Rect(0, 0, 16, 8)))
+	return b.Bytes()
+}
+
+func pngChunk(name string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(append(chunk, name...), data...)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func gifFrames(frames int) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), []color.Color{color.Black}))
+		anim.Delay = append(anim.Delay, 0)
+	}
+
+	var b bytes.Buffer
+	gif.EncodeAll(&b, anim)
+	return b.Bytes()
+}
+
+func TestRastersAreValidatedWithoutDecoding(t *testing.T) {
+	jpg := encodeImage(func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) })
+	pngFile := encodeImage(png.Encode)
+
+	ihdr := func(width, height uint32) []byte {
+		data := make([]byte, 13)
+		binary.BigEndian.PutUint32(data[0:4], width)
+		binary.BigEndian.PutUint32(data[4:8], height)
+		data[8], data[9] = 8, 2
+		return append(append([]byte(nil), pngSignature...), pngChunk("IHDR", data)...)
+	}
+
+	badCRC := append([]byte(nil), pngFile...)
+	badCRC[len(pngSignature)+20]++
+
+	limits := Limits{MaxPixels: 1000, MaxFrames: 3}
+
+	cases := []struct {
+		name     string
+		validate func(*bufio.Reader, Limits) error
+		data     []byte
+		reason   ValidationReason
+	}{
+		{"JPEG", validateJpeg, jpg, valid},
+		{"truncated JPEG", validateJpeg, jpg[:len(jpg)-2], Corrupt},
+		{"JPEG cut in its headers", validateJpeg, jpg[:20], Corrupt},
+		{"JPEG without a frame", validateJpeg, []byte("\xff\xd8\xff\xd9"), Corrupt},
+		{"JPEG with a bad segment length", validateJpeg, []byte("\xff\xd8\xff\xe0\x00\x01"), Corrupt},
+		{"not a JPEG", validateJpeg, pngFile, InvalidHeader},
+		{"PNG", validatePng, pngFile, valid},
+		{"oversized PNG IHDR", validatePng, ihdr(60000, 60000), TooLarge},
+		{"PNG IHDR without pixels", validatePng, ihdr(0, 10), Corrupt},
+		{"PNG with a bad CRC", validatePng, badCRC, Corrupt},
+		{"truncated PNG", validatePng, pngFile[:len(pngFile)-6], Corrupt},
+		{"PNG without image data", validatePng, append(ihdr(10, 10), pngChunk("IEND", nil)...), Corrupt},
+		{"not a PNG", validatePng, jpg, InvalidHeader},
+		{"GIF", validateGif, gifFrames(1), valid},
+		{"GIF with as many frames as the limit", validateGif, gifFrames(3), valid},
+		{"GIF with more frames than the limit", validateGif, gifFrames(4), TooLarge},
+		{"truncated GIF", validateGif, gifFrames(2)[:40], Corrupt},
+		{"GIF without frames", validateGif, append([]byte("GIF89a\x04\x00\x04\x00\x00\x00\x00"), 0x3b), Corrupt},
+		{"oversized GIF screen", validateGif, []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00"), TooLarge},
+	}
+
+	for _, c := range cases {
+		err := c.validate(bufio.NewReader(bytes.NewReader(c.data)), limits)
+		checkValidation(t, c.name, err, c.reason)
+	}
+}
+
+func TestHeadersAreCheckedAgainstTheLimits(t *testing.T) {
+	bmp := func(headerSize, width, height uint32) []byte {
+		b := make([]byte, 26)
+		copy(b, "BM")
+		binary.LittleEndian.PutUint32(b[14:18], headerSize)
+		if headerSize == 12 {
+			binary.LittleEndian.PutUint16(b[18:20], uint16(width))
+			binary.LittleEndian.PutUint16(b[20:22], uint16(height))
+		} else {
+			binary.LittleEndian.PutUint32(b[18:22], width)
+			binary.LittleEndian.PutUint32(b[22:26], height)
+		}
+		return b
+	}
+
+	ico := func(sizes ...byte) []byte {
+		b := []byte{0, 0, 1, 0, byte(len(sizes) / 2), 0}
+		for i := 0; i+1 < len(sizes); i += 2 {
+			entry := make([]byte, 16)
+			entry[0], entry[1] = sizes[i], sizes[i+1]
+			b = append(b, entry...)
+		}
+		return b
+	}
+
+	// A little endian TIFF with a page of each size, linked in order
+	tiff := func(sizes ...uint32) []byte {
+		b := []byte("II*\x00\x08\x00\x00\x00")
+		for i := 0; i+1 < len(sizes); i += 2 {
+			ifd := make([]byte, 2+2*12+4)
+			binary.LittleEndian.PutUint16(ifd[0:2], 2)
+			for j, tag := range []uint16{256, 257} {
+				entry := ifd[2+j*12 : 14+j*12]
+				binary.LittleEndian.PutUint16(entry[0:2], tag)
+				binary.LittleEndian.PutUint16(entry[2:4], 4)
+				binary.LittleEndian.PutUint32(entry[4:8], 1)
+				binary.LittleEndian.PutUint32(entry[8:12], sizes[i+j])
+			}
+			if i+2 < len(sizes) {
+				binary.LittleEndian.PutUint32(ifd[26:30], uint32(len(b)+len(ifd)))
+			}
+			b = append(b, ifd...)
+		}
+		return b
+	}
+
+	box := func(name string, contents ...[]byte) []byte {
+		b := append(make([]byte, 4), name...)
+		for _, c := range contents {
+			b = append(b, c...)
+		}
+		binary.BigEndian.PutUint32(b[0:4], uint32(len(b)))
+		return b
+	}
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	heif := func(width, height uint32) []byte {
+		ispe := make([]byte, 12)
+		binary.BigEndian.PutUint32(ispe[4:8], width)
+		binary.BigEndian.PutUint32(ispe[8:12], height)
+		return append(append([]byte(nil), ftyp...), box("meta", make([]byte, 4), box("iprp", box("ipco", box("ispe", ispe))))...)
+	}
+	badBox := append(append([]byte(nil), ftyp...), 0, 0, 0, 4, 'm', 'e', 't', 'a')
+	truncatedHeif := heif(10, 10)
+	truncatedHeif = truncatedHeif[:len(truncatedHeif)-4]
+
+	limits := Limits{MaxPixels: 1000, MaxFrames: 3}
+
+	cases := []struct {
+		name     string
+		validate func(*bufio.Reader, Limits) error
+		data     []byte
+		reason   ValidationReason
+	}{
+		{"BMP", validateBmp, bmp(40, 10, 10), valid},
+		{"top down BMP", validateBmp, bmp(40, 10, uint32(-10&0xffffffff)), valid},
+		{"OS/2 BMP", validateBmp, bmp(12, 10, 10), valid},
+		{"oversized BMP", validateBmp, bmp(40, 60000, 60000), TooLarge},
+		{"oversized top down BMP", validateBmp, bmp(40, 100, uint32(-100&0xffffffff)), TooLarge},
+		{"BMP without pixels", validateBmp, bmp(40, 0, 10), Corrupt},
+		{"BMP with a negative width", validateBmp, bmp(40, uint32(-10&0xffffffff), 10), Corrupt},
+		{"truncated BMP header", validateBmp, bmp(40, 10, 10)[:20], InvalidHeader},
+		{"ICO", validateIco, ico(16, 16, 20, 20), valid},
+		{"ICO of 256x256 images", validateIco, ico(0, 0), TooLarge},
+		{"ICO without images", validateIco, ico(), Corrupt},
+		{"ICO with more images than the limit", validateIco, ico(1, 1, 1, 1, 1, 1, 1, 1), TooLarge},
+		{"truncated ICO directory", validateIco, ico(16, 16)[:10], Corrupt},
+		{"HEIF", validateHeif, heif(10, 10), valid},
+		{"oversized HEIF", validateHeif, heif(60000, 60000), TooLarge},
+		{"HEIF without pixels", validateHeif, heif(0, 0), Corrupt},
+		{"HEIF without a size", validateHeif, append(append([]byte(nil), ftyp...), box("meta", make([]byte, 4))...), Corrupt},
+		{"HEIF box smaller than its header", validateHeif, badBox, Corrupt},
+		{"truncated HEIF", validateHeif, truncatedHeif, Corrupt},
+	}
+
+	for _, c := range cases {
+		err := c.validate(bufio.NewReader(bytes.NewReader(c.data)), limits)
+		checkValidation(t, c.name, err, c.reason)
+	}
+
+	looped := tiff(10, 10)
+	binary.LittleEndian.PutUint32(looped[len(looped)-4:], 8)
+
+	tiffs := []struct {
+		name   string
+		data   []byte
+		reason ValidationReason
+	}{
+		{"TIFF", tiff(10, 10, 20, 20), valid},
+		{"TIFF with an oversized page", tiff(10, 10, 60000, 60000), TooLarge},
+		{"TIFF with a page without pixels", tiff(10, 0), Corrupt},
+		{"TIFF with more pages than the limit", tiff(1, 1, 1, 1, 1, 1, 1, 1), TooLarge},
+		{"TIFF with a loop in its directories", looped, Corrupt},
+		{"truncated TIFF", tiff(10, 10)[:20], Corrupt},
+		{"not a TIFF", []byte("II+\x00\x08\x00\x00\x00"), InvalidHeader},
+	}
+
+	for _, c := range tiffs {
+		checkValidation(t, c.name, validateTiff(bytes.NewReader(c.data), limits), c.reason)
+	}
+}
+
+func TestPdfPagesAreCountedAcrossChunks(t *testing.T) {
+	const chunk = 64 * 1024
+	page := "1 0 obj << /Type /Page >> endobj\n"
+
+	// A page object starting at each offset around the end of the first chunk, after one at the start
+	for offset := chunk - 48; offset <= chunk+8; offset++ {
+		pdf := "%PDF-1.4\n" + page
+		pdf += strings.Repeat(" ", offset-len(pdf)-len("1 0 obj << ")) + page + "%%EOF"
+
+		if err := validatePdf(bufio.NewReader(strings.NewReader(pdf)), Limits{MaxPages: 2}); err != nil {
+			t.Fatalf("Expected 2 pages with one at %d, instead %s", offset, err.Error())
+		}
+
+		err := validatePdf(bufio.NewReader(strings.NewReader(pdf)), Limits{MaxPages: 1})
+		checkValidation(t, "PDF with a page at "+strconv.Itoa(offset), err, TooLarge)
+	}
+
+	// Page tree nodes aren't pages, even when they're split from their s by the end of a chunk
+	for offset := chunk - 48; offset <= chunk+8; offset++ {
+		pdf := "%PDF-1.4\n" + page
+		pdf += strings.Repeat(" ", offset-len(pdf)) + "/Type" + strings.Repeat(" ", 30) + "/Pages"
+
+		if err := validatePdf(bufio.NewReader(strings.NewReader(pdf)), Limits{MaxPages: 1}); err != nil {
+			t.Fatalf("Expected a page tree at %d not to be counted, instead %s", offset, err.Error())
+		}
+	}
+
+	checkValidation(t, "PDF without a header", validatePdf(bufio.NewReader(strings.NewReader("<< /Type /Page >>")), Limits{}), InvalidHeader)
+}
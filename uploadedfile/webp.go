@@ -0,0 +1,66 @@
+package uploadedfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var errInvalidWebp = errors.New("Invalid WebP file")
+
+// Flag in the VP8X chunk of animated WebPs
+const webpAnimationFlag = 0x02
+
+// Reads the dimensions of a WebP, and whether it's animated, from the first chunk. The standard library has no WebP
+// decoder, and the header is all we need.
+func webpInfo(path string) (width, height int, animated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	// RIFF header, then the first chunk's FourCC, size, and enough of its payload for any of the formats
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, 0, false, errInvalidWebp
+	}
+
+	return webpDimensions(header)
+}
+
+// Parses the first 30 bytes of a WebP.
+func webpDimensions(header []byte) (width, height int, animated bool, err error) {
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return 0, 0, false, errInvalidWebp
+	}
+
+	payload := header[20:]
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// Lossy: a frame tag then a start code, then 14 bit dimensions
+		if payload[3] != 0x9d || payload[4] != 0x01 || payload[5] != 0x2a {
+			return 0, 0, false, errInvalidWebp
+		}
+		width = int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+	case "VP8L":
+		// Lossless: a signature then 14 bits each of width - 1 and height - 1
+		if payload[0] != 0x2f {
+			return 0, 0, false, errInvalidWebp
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		width = int(bits&0x3fff) + 1
+		height = int((bits>>14)&0x3fff) + 1
+	case "VP8X":
+		// Extended: flags, then 24 bits each of canvas width - 1 and height - 1
+		animated = payload[0]&webpAnimationFlag != 0
+		width = int(uint32(payload[4])|uint32(payload[5])<<8|uint32(payload[6])<<16) + 1
+		height = int(uint32(payload[7])|uint32(payload[8])<<8|uint32(payload[9])<<16) + 1
+	default:
+		return 0, 0, false, errInvalidWebp
+	}
+
+	return width, height, animated, nil
+}